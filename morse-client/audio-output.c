@@ -8,25 +8,36 @@ void initWave(double *w) {
     }
 }
 
-int initOut(Out *o, const unsigned int usersMax) {
+int initOut(Out *o, const unsigned int usersMax, const unsigned int localMax) {
+    unsigned int i;
     o->phase = 0;
     o->active = 1;
     o->usersMax = usersMax;
+    o->localMax = localMax;
     o->masterAmplitude = 1.0; 
     o->mixAmplitude = 0.95 / (double)o->usersMax;
-    o->instances = calloc(o->usersMax, sizeof(*o->instances));
+    o->instances = calloc(o->usersMax + o->localMax, sizeof(*o->instances));
     if (o->instances == NULL) {
         fprintf(stderr, "Error allocating memory for audio instances.\n");
         return -1;
     }
+    for (i = 0 ; i < o->usersMax + o->localMax ; i++) {
+        o->instances[i].level = 1.0;
+        /* Spread fading out so that instances don't all dip together */
+        o->instances[i].fadePhase = (double)i * 2.39996;
+    }
+    memset(&o->band, 0, sizeof(o->band));
+    memset(o->pink, 0, sizeof(o->pink));
+    o->seed = 2463534242;
+    o->crash = 0.0;
     initWave(o->wave);
     memset(o->buffer, 0, O_BUFFSIZE * sizeof(char));
-    memset(o->mixer, 0, BUFFSIZE * sizeof(double));
+    memset(o->mixer, 0, sizeof(o->mixer));
     ao_initialize();
     o->default_driver = ao_default_driver_id();
     memset(&o->format, 0, sizeof(o->format));
     o->format.bits = 16;
-    o->format.channels = 1;
+    o->format.channels = CHANNELS;
     o->format.rate = 48000;
     o->format.byte_format = AO_FMT_LITTLE;
     o->device = ao_open_live(o->default_driver, &o->format, NULL);
@@ -51,8 +62,86 @@ AudioInstance *getInstance(Out *o, const unsigned int i) {
     return &o->instances[i];
 }
 
+/* A cheap xorshift generator, returning -1.0 to 1.0. The C library's rand()
+ * is neither fast enough to call for every sample nor safe to share. */
+
+static double whiteNoise(Out *o) {
+    o->seed ^= o->seed << 13;
+    o->seed ^= o->seed >> 17;
+    o->seed ^= o->seed << 5;
+    return (double)o->seed / (double)UINT32_MAX * 2.0 - 1.0;
+}
+
+/* Paul Kellet's economy pink noise filter. */
+
+static double pinkNoise(Out *o) {
+    double w = whiteNoise(o);
+    o->pink[0] = 0.99765 * o->pink[0] + w * 0.0990460;
+    o->pink[1] = 0.96300 * o->pink[1] + w * 0.2965164;
+    o->pink[2] = 0.57000 * o->pink[2] + w * 1.0526913;
+    return (o->pink[0] + o->pink[1] + o->pink[2] + w * 0.1848) * 0.25;
+}
+
+/* Moves an instance's fading and drift along by one buffer, returning its
+ * gain for that buffer. */
+
+static double condition(Out *o, AudioInstance *ai) {
+    Conditions *c = &o->band;
+    double f;
+    if (c->drift > 0.0) {
+        ai->drift += whiteNoise(o) * c->drift * DRIFT_STEP;
+        ai->drift = fmax(-c->drift, fmin(c->drift, ai->drift));
+    } else {
+        ai->drift = 0.0;
+    }
+    if (c->fadeDepth <= 0.0) {
+        return 1.0;
+    }
+    if (c->fadeRandom) {
+        if (fabs(ai->fade - ai->fadeTarget) < 0.01) {
+            ai->fadeTarget = (whiteNoise(o) + 1.0) / 2.0;
+        }
+        ai->fade += (ai->fadeTarget - ai->fade) * c->fadeRate * 4.0 /
+                    (double)RESOLUTION;
+        f = ai->fade;
+    } else {
+        ai->fadePhase = fmod(ai->fadePhase + TWOPI * c->fadeRate /
+                             (double)RESOLUTION, TWOPI);
+        f = 0.5 + 0.5 * sin(ai->fadePhase);
+    }
+    return 1.0 - c->fadeDepth * fmax(0.0, fmin(1.0, f));
+}
+
+/* Adds background noise and static crashes to the mix. Both are scaled like
+ * any one instance, so the noise level reads as a signal to noise ratio. */
+
+static void addNoise(Out *o) {
+    unsigned int i;
+    Conditions *c = &o->band;
+    double d, n = c->noise * o->mixAmplitude;
+    if (c->qrn > 0.0 && (whiteNoise(o) + 1.0) / 2.0 < c->qrn /
+        (double)RESOLUTION) {
+        o->crash = o->mixAmplitude * (2.5 + 1.5 * whiteNoise(o));
+    }
+    for (i = 0 ; i < BUFFSIZE ; i++) {
+        d = 0.0;
+        if (n > 0.0) {
+            d += n * (c->pink ? pinkNoise(o) : whiteNoise(o));
+        }
+        if (o->crash > 0.001) {
+            d += o->crash * whiteNoise(o);
+            o->crash *= QRN_DECAY;
+        }
+        o->mixer[i * CHANNELS] += d;
+        o->mixer[i * CHANNELS + 1] += d;
+    }
+}
+
 /* Main playback loop. Sines are synthesized from simple truncating wavetable
  * lookup, since audio fidelity is not a concern with something like morse.
+ * Local instances are mixed at the same level as everyone else, so the mix is
+ * clipped rather than risk wrapping around when they play over a full room.
+ * Band conditions, when any are set, are applied along the way.
  * Runs in a single thread for the time being. The algorithm is trivial to
  * parallelize, but the lack of pthread barriers on macOS makes it more trouble
  * than it's worth. The Out.phase field is capable of overflowing (after a 
@@ -60,13 +149,13 @@ AudioInstance *getInstance(Out *o, const unsigned int i) {
 
 void playback(Out *o) {
     unsigned int i, j;
-    double d;
+    double d, g, inc, left, right;
     int16_t b;
     AudioInstance *ai = NULL;
     while (o->active == 1) {
         o->phase++;
-        memset(o->mixer, 0, BUFFSIZE * sizeof(double));
-        for (i = 0 ; i < o->usersMax ; i++) {
+        memset(o->mixer, 0, sizeof(o->mixer));
+        for (i = 0 ; i < o->usersMax + o->localMax ; i++) {
             ai = &o->instances[i];
             if (ai->newPitch != 0.0) {
                 ai->pitch = ai->newPitch * EVENT_INCREMENT;
@@ -74,14 +163,30 @@ void playback(Out *o) {
                                  (double)BUFFSIZE, TWOPI);
                 ai->newPitch = 0.0;
             }
+            g = ai->dry ? 1.0 : condition(o, ai);
+            left = ai->pan > 0.0 ? 1.0 - ai->pan : 1.0;
+            right = ai->pan < 0.0 ? 1.0 + ai->pan : 1.0;
             for (j = 0 ; j < BUFFSIZE ; j++) {
-                ai->phase += ai->pitch;
+                if (ai->on && !ai->wasOn && !ai->dry) {
+                    ai->chirp = o->band.chirp;
+                }
+                ai->wasOn = ai->on;
+                inc = ai->pitch + (ai->drift + ai->chirp) * EVENT_INCREMENT;
+                ai->chirp *= CHIRP_DECAY;
+                ai->phase += inc > 0.0 ? inc : 0.0;
                 d = o->wave[(unsigned int)ai->phase % WAVELEN];
-                o->mixer[j] += d * o->mixAmplitude * ai->on;
+                d *= o->mixAmplitude * ai->level * g * ai->on;
+                o->mixer[j * CHANNELS] += d * left;
+                o->mixer[j * CHANNELS + 1] += d * right;
             }
         }
-        for (i = 0, j = 0 ; i < BUFFSIZE ; i++, j += 2) {
-            b = (int16_t)(o->mixer[i] * o->masterAmplitude * SHRT_MAX);
+        if (o->band.noise > 0.0 || o->band.qrn > 0.0 || o->crash > 0.001) {
+            addNoise(o);
+        }
+        for (i = 0, j = 0 ; i < BUFFSIZE * CHANNELS ; i++, j += 2) {
+            d = o->mixer[i] * o->masterAmplitude;
+            d = d > 1.0 ? 1.0 : (d < -1.0 ? -1.0 : d);
+            b = (int16_t)(d * SHRT_MAX);
             o->buffer[j] = (char)(b & 255);
             o->buffer[j+1] = (char)(b >> 8);
         }
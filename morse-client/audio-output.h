@@ -9,6 +9,8 @@
 
 /* The main synthesis and audio output loop. Every User has a corresponding
  * AudioInstance struct, which contains his/her note status and frequency info.
+ * A handful of local instances follow the Users' instances. These are only
+ * ever heard by the client itself, and are used to play practice material.
  * All instances, along with other playback info, are stored in an Out struct,
  * which is exposed to the Go code. Audio playback runs constantly in its own
  * goroutine. Updates to playback are made through direct atomic changes to
@@ -16,12 +18,16 @@
 
 #define RATE 48000
 #define RESOLUTION 96
+#define CHANNELS 2
 #define BUFFSIZE (RATE / RESOLUTION)
-#define O_BUFFSIZE (BUFFSIZE * 2)
+#define O_BUFFSIZE (BUFFSIZE * CHANNELS * 2)
 #define WAVELEN 4096
 #define TWOPI (2.0 * M_PI)
 #define SINE_INCREMENT (TWOPI / (double)WAVELEN)
 #define EVENT_INCREMENT ((double)WAVELEN / (double)RATE)
+#define CHIRP_DECAY 0.999
+#define DRIFT_STEP 0.05
+#define QRN_DECAY 0.9995
 
 /* The AudioInstance type contains a User's relevant playback information. This
  * struct is referenced and updated while filling the audio buffer. The
@@ -30,36 +36,74 @@
  * AudioInstance.on field atomically in the middle of a buffer filling
  * operation, which ensures high click resolution regardless of buffer size.
  * New pitches are written to AudioInstance.newPitch, which is checked between
- * buffer fills and updated accordingly, avoiding the need for mutexes. */
+ * buffer fills and updated accordingly, avoiding the need for mutexes. The
+ * level scales the instance in the mix, and is 1.0 unless changed. Pan runs
+ * from -1.0 (left) to 1.0 (right), turning down the other side. The
+ * remaining fields track the band conditions applied to the instance, which
+ * are skipped altogether for dry instances such as the user's own sidetone. */
 
 typedef struct AudioInstance {
     unsigned int on;
     double newPitch;
     double phase;
     double pitch;
+    double level;
+    double pan;
+    unsigned int dry;
+    unsigned int wasOn;
+    double fade;
+    double fadeTarget;
+    double fadePhase;
+    double drift;
+    double chirp;
 } AudioInstance;
 
+/* The Conditions type describes simulated band conditions, all of which are
+ * off at zero. Noise is the ratio of background noise to a full strength
+ * signal, which is white unless pink is set. Fading dips each instance by as
+ * much as fadeDepth (0.0 to 1.0), fadeRate times a second, either smoothly or
+ * at random. Drift wanders each instance's pitch by up to that many hz, and
+ * chirp bends it by that many hz at key-down. QRN is the average number of
+ * static crashes a second. */
+
+typedef struct Conditions {
+    double noise;
+    unsigned int pink;
+    double fadeDepth;
+    double fadeRate;
+    unsigned int fadeRandom;
+    double drift;
+    double chirp;
+    double qrn;
+} Conditions;
+
 /* The Out type is a Go-facing struct that contains all playback information.
  * It is meant to be stack allocated. Check the values of BUFFSIZE and
- * O_BUFFSIZE if this presents a problem. */
+ * O_BUFFSIZE if this presents a problem. Output is stereo, so the mixer holds
+ * interleaved left and right samples. */
 
 typedef struct Out {
     uint32_t phase;
     int active;
     unsigned int usersMax;
+    unsigned int localMax;
     double masterAmplitude;
     double mixAmplitude;
     AudioInstance *instances;
+    Conditions band;
+    uint32_t seed;
+    double pink[3];
+    double crash;
     double wave[WAVELEN];
     char buffer[O_BUFFSIZE];
-    double mixer[BUFFSIZE];
+    double mixer[BUFFSIZE * CHANNELS];
     ao_device *device;
     ao_sample_format format;
     int default_driver;
 } Out;
 
 void initWave(double *);
-int initOut(Out *, const unsigned int);
+int initOut(Out *, const unsigned int, const unsigned int);
 void destroyOut(Out *);
 AudioInstance * getInstance(Out *, const unsigned int);
 void playback(Out *);
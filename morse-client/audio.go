@@ -5,7 +5,7 @@ package main
 
 /*
 #cgo CFLAGS: -I/usr/include
-#cgo LDFLAGS: -L/usr/lib -lao -lcurses
+#cgo LDFLAGS: -L/usr/lib -lao -lncursesw
 #include <curses.h>
 #include "audio-output.h"
 Out O;
@@ -14,9 +14,12 @@ import "C"
 
 import (
     "encoding/gob"
+    "fmt"
     "io"
     "log"
     "net"
+    "strings"
+    "time"
 )
 
 // The User type contains all of a client's relevant audio playback info.
@@ -31,9 +34,22 @@ type User struct {
     Key uint8
     Hz float64
     Name string
+    Muted bool
+    Whispering bool
+    Presence Presence
     Instance *C.AudioInstance
 }
 
+// User.pitch() is what the User is played at, which is shifted while they are
+// whispering to the user.
+
+func (u *User) pitch() C.double {
+    if u.Whispering {
+        return C.double(u.Hz * WHISPER_SHIFT)
+    }
+    return C.double(u.Hz)
+}
+
 // The Audio struct contains all User info and connections to the server. It
 // also contains a C Out struct, which is the master of all AudioInstance and
 // libao structs.
@@ -42,12 +58,24 @@ type Audio struct {
     Server net.Conn
     Reader *gob.Decoder
     Writer *gob.Encoder
+    Name string
     UserKey uint8
+    Spectator bool
     Users []User
     Out *C.Out
+    Keyer *Keyer
+    Fist Fist
+    OverTimer *time.Timer
+    Copy []Recorder
+    Log *Logbook
+    Prefs *Preferences
     ToUI chan Msg
     FromUI chan Msg
     FromServer chan Msg
+    Done chan struct{}
+    UDP *UDPLink
+    WantUDP bool
+    Presence Presence
 }
 
 // The main loop that initializes sound playback, then the user interface, then
@@ -55,15 +83,20 @@ type Audio struct {
 // information based upon.
 
 func (a *Audio) ListenToServer() {
-    var m Msg
-    defer a.Server.Close()
     log.Println("Initializing audio ...")
-    if int(a.UserKey) >= USERS_MAX {
+    if int(a.UserKey) >= USERS_MAX && !a.Spectator {
         log.Fatal("Invalid user key.")
     }
     a.Users = make([]User, USERS_MAX)
+    a.Copy = make([]Recorder, USERS_MAX)
+    log.Println("Opening logbook ...")
+    l, err := LoadLogbook()
+    if err != nil {
+        log.Println("Logbook unreadable, starting afresh:", err)
+    }
+    a.Log = l
     a.Out = &C.O
-    if err := C.initOut(a.Out, C.uint(USERS_MAX)); err < 0 {
+    if err := C.initOut(a.Out, C.uint(USERS_MAX), LOCAL_MAX); err < 0 {
         log.Fatal("Error initializing C-side audio output.")
     }
     go C.playback(a.Out)
@@ -73,17 +106,77 @@ func (a *Audio) ListenToServer() {
     for i, _ := range a.Users {
         a.Users[i].Instance = C.getInstance(a.Out, C.uint(i))
     }
+    a.Keyer = NewKeyer(a.Out, USERS_MAX, LOCAL_MAX)
     log.Println("Got them.")
     log.Println("Launching user interface ...")
     a.ToUI = make(chan Msg)
     a.FromUI = make(chan Msg)
     a.FromServer = make(chan Msg)
-    a.Users[a.UserKey].Instance.newPitch = 440.0
-    ui := UI{FromAudio: a.ToUI, ToAudio: a.FromUI}
-    go ui.ListenToAudio(&a.Users[a.UserKey].Instance.on)
+    a.Done = make(chan struct{})
+    a.OverTimer = time.AfterFunc(OVER_GAP, func() {
+        a.FromUI <- Msg{Type: MSG_INTERNAL_FIST}
+    })
+    a.OverTimer.Stop()
+    ui := UI{FromAudio: a.ToUI, ToAudio: a.FromUI, Name: a.Name,
+             Key: a.UserKey, Spectator: a.Spectator, Keyer: a.Keyer,
+             Log: a.Log, Band: &a.Out.band, Out: a.Out, Prefs: a.Prefs,
+             Presence: Presence{WPM: WPM, Skill: a.Prefs.Get().Skill}}
+    if a.Spectator {
+        // Spectators have no sound of their own to switch on
+        go ui.ListenToAudio(nil)
+    } else {
+        a.Users[a.UserKey].Instance.newPitch = DEFAULT_HZ
+        a.Users[a.UserKey].Instance.dry = 1
+        go ui.ListenToAudio(&a.Users[a.UserKey].Instance.on)
+    }
     go a.ListenToAllMsgs()
+    if a.Server == nil {
+        // Offline, there is nothing to listen to
+        a.Users[a.UserKey].Name = a.Name
+        a.ToUI <- Msg{Type: MSG_ENTER, Key: a.UserKey, Hz: DEFAULT_HZ,
+                      Name: a.Name}
+    } else {
+        go a.ListenTo(a.Reader, a.FromServer, a.Done)
+    }
+    cfg := a.Prefs.Get()
+    a.FromUI <- Msg{Type: MSG_INTERNAL_VOLUME, Hz: cfg.Volume}
+    if !a.Spectator && cfg.Pitch != 0.0 {
+        a.FromUI <- Msg{Type: MSG_HZ, Hz: cfg.Pitch}
+    }
+    if a.WantUDP {
+        a.FromUI <- Msg{Type: MSG_UDP}
+    }
+    select {}
+}
+
+// Audio.Use() switches to a new Session. Spectators are given a key past the
+// end of the Users, whatever size the server's room is.
+
+func (a *Audio) Use(s Session) {
+    a.Server = s.Server
+    a.Reader = s.Reader
+    a.Writer = s.Writer
+    a.UserKey = s.UserKey
+    if a.Spectator {
+        a.UserKey = uint8(USERS_MAX)
+    }
+}
+
+// Audio.ListenTo() decodes Msgs from one server connection and passes them
+// along. It stops quietly once done is closed, which happens when the user
+// joins another room.
+
+func (a *Audio) ListenTo(r *gob.Decoder, from chan Msg, done chan struct{}) {
+    var m Msg
     for {
-        if err := a.Reader.Decode(&m); err != nil {
+        // Gob leaves out zero fields, so nothing may linger from the last Msg
+        m = Msg{}
+        if err := r.Decode(&m); err != nil {
+            select {
+            case <- done:
+                return
+            default:
+            }
             if err == io.EOF {
                 C.endwin()
                 log.Fatal("Server closed.")
@@ -93,7 +186,11 @@ func (a *Audio) ListenToServer() {
         }
         m.On -= 1 // Decoding back to potential zeros
         m.Key -= 1
-        a.FromServer <- m
+        select {
+        case from <- m:
+        case <- done:
+            return
+        }
     }
 }
 
@@ -102,28 +199,76 @@ func (a *Audio) ListenToServer() {
 
 func (a *Audio) ListenToAllMsgs() {
     var m Msg
+    tick := time.NewTicker(COPY_GAP / 4)
+    ping := time.NewTicker(PING_INTERVAL)
     for {
         select {
+        case now := <- tick.C:
+            a.CopyAll(now)
+        case now := <- ping.C:
+            a.Ping(now)
         case m = <- a.FromServer:
             a.HandleMsg(&m)
         case m = <- a.FromUI:
             switch {
-            case m.Type > MSG_INTERNAL && m.Type < MSG_ERROR_OK:
+            case m.Type > MSG_INTERNAL && m.Type < MSG_ERROR_OK,
+                 m.Type >= MSG_INTERNAL_FIST:
                 // Internal Msgs are routed back into Audio
                 a.HandleMsg(&m)
             case m.Type >= MSG_ERROR_OK:
                 // Errors are ignored for now
             default:
-                m.On += 1 // Encoding away potential zero values
-                m.Key = a.UserKey + 1
-                if err := a.Writer.Encode(m); err != nil {
-                    log.Println(err)
+                if m.Type == MSG_ON || m.Type == MSG_OFF {
+                    a.Fist.Recorder.Key(m.Type == MSG_ON, time.Now())
+                    a.OverTimer.Reset(OVER_GAP)
+                }
+                if m.Type == MSG_PRESENCE {
+                    // Kept to be published again in any room joined later
+                    a.Presence = presenceOf(&m)
                 }
+                if a.UDP != nil && (m.Type == MSG_ON || m.Type == MSG_OFF) {
+                    a.UDP.Key(m.Type == MSG_ON)
+                    continue
+                }
+                if a.Server == nil {
+                    // Offline, the client answers for the server
+                    if m.Type == MSG_ON || m.Type == MSG_OFF ||
+                       m.Type == MSG_HZ || m.Type == MSG_PRESENCE {
+                        m.Key = a.UserKey
+                        a.HandleMsg(&m)
+                    } else if m.Type == MSG_WHISPER {
+                        // There is nobody to whisper to
+                        m.Key = a.UserKey
+                        m.On = 0
+                        a.HandleMsg(&m)
+                    } else if m.Type == MSG_TEXT {
+                        m.Key = a.UserKey
+                        m.On = 1
+                        m.Name = a.Name
+                        a.HandleMsg(&m)
+                    } else if m.Type == MSG_HISTORY {
+                        // There is no room, so no history of one
+                        m.Hz = 0.0
+                        a.HandleMsg(&m)
+                    }
+                    continue
+                }
+                a.Send(m)
             }
         }
     }
 }
 
+// Audio.Send() passes one of the user's own Msgs on to the server.
+
+func (a *Audio) Send(m Msg) {
+    m.On += 1 // Encoding away potential zero values
+    m.Key = a.UserKey + 1
+    if err := a.Writer.Encode(m); err != nil {
+        log.Println(err)
+    }
+}
+
 // Actions taken in response to Msgs from server and UI alike.
 
 func (a *Audio) HandleMsg(m *Msg) {
@@ -131,15 +276,23 @@ func (a *Audio) HandleMsg(m *Msg) {
     // On/off events for the local User are engaged ASAP on the C level, but
     // there is no harm in receiving redundant Msgs from the server as well.
     case MSG_ON:
+        if a.Users[m.Key].Name == "" {
+            // Keying over UDP can overtake a MSG_LEAVE, or a MSG_ENTER
+            return
+        }
         a.Users[m.Key].Instance.on = 1
         a.Users[m.Key].On = 1 
+        a.Heard(m)
+        a.ToUI <- *m
     case MSG_OFF:
         a.Users[m.Key].Instance.on = 0
         a.Users[m.Key].On = 0
+        a.Heard(m)
+        a.ToUI <- *m
     case MSG_HZ:
         m.Name = a.Users[m.Key].Name
-        a.Users[m.Key].Instance.newPitch = C.double(m.Hz)
         a.Users[m.Key].Hz = m.Hz
+        a.Users[m.Key].Instance.newPitch = a.Users[m.Key].pitch()
         a.ToUI <- *m
     case MSG_ENTER:
         a.Users[m.Key].Instance.on = C.uint(m.On)
@@ -148,25 +301,233 @@ func (a *Audio) HandleMsg(m *Msg) {
         a.Users[m.Key].Key = m.Key
         a.Users[m.Key].Hz = m.Hz
         a.Users[m.Key].Name = m.Name
+        a.Users[m.Key].Whispering = false
+        a.Users[m.Key].Presence = Presence{}
+        a.Users[m.Key].Instance.pan = C.double(a.Prefs.Pan(m.Name))
         a.ToUI <- *m
+        if m.Key != a.UserKey && a.Prefs.Muted(m.Name) {
+            a.Users[m.Key].Muted = true
+            a.Users[m.Key].Instance.level = 0.0
+            a.ToUI <- Msg{Type: MSG_INTERNAL_MUTE, On: 1, Key: m.Key,
+                          Name: m.Name}
+        }
     case MSG_LEAVE:
+        a.Flush(m.Key)
+        a.Copy[m.Key] = Recorder{}
+        if err := a.Log.Close(m.Key); err != nil {
+            log.Println(err)
+        }
         m.Name = a.Users[m.Key].Name
         a.Users[m.Key].Instance.on = 0
         a.Users[m.Key].Instance.newPitch = 0.0
         a.Users[m.Key].On = 0
         a.Users[m.Key].Hz = 0.0
         a.Users[m.Key].Name = ""
+        a.Users[m.Key].Muted = false
+        a.Users[m.Key].Whispering = false
+        a.Users[m.Key].Presence = Presence{}
+        a.Users[m.Key].Instance.level = 1.0
+        a.Users[m.Key].Instance.pan = 0.0
+        a.ToUI <- *m
+    case MSG_FLOOR:
+        // An open floor is signaled by an out of range key
+        if m.On == 1 {
+            m.Name = a.Users[m.Key].Name
+        }
+        a.ToUI <- *m
+    case MSG_FLOOR_REQUEST:
+        m.Name = a.Users[m.Key].Name
+        a.ToUI <- *m
+    case MSG_MUTE, MSG_PITCH, MSG_TEXT, MSG_HISTORY:
+        a.ToUI <- *m
+    case MSG_PRESENCE:
+        a.Users[m.Key].Presence = presenceOf(m)
+        a.ToUI <- *m
+    case MSG_UDP:
+        a.StartUDP(m)
+    case MSG_WHISPER:
+        // Only whispers to the user are played differently; their own are
+        // followed by the UI
+        if m.Key != a.UserKey {
+            a.Users[m.Key].Whispering = m.On == 1
+            a.Users[m.Key].Instance.newPitch = a.Users[m.Key].pitch()
+        }
+        a.ToUI <- *m
+    case MSG_PING:
+        sent := time.Unix(0, int64(m.Hz * float64(time.Second)))
+        m.Hz = time.Since(sent).Seconds()
         a.ToUI <- *m
     case MSG_INTERNAL_VOLUME:
         a.Out.masterAmplitude = C.double(m.Hz)
+        a.ToUI <- *m
+    case MSG_INTERNAL_FIST:
+        if lines := a.Fist.Over(time.Now()); lines != nil {
+            m.Text = strings.Join(lines, "\n")
+            a.ToUI <- *m
+        }
+    case MSG_INTERNAL_MUTE:
+        m.Key = 255
+        for i, u := range a.Users {
+            if u.Name != "" && u.Name == m.Name {
+                a.Users[i].Muted = !u.Muted
+                a.Users[i].Instance.level = 1.0
+                m.On = 0
+                if a.Users[i].Muted {
+                    a.Users[i].Instance.level = 0.0
+                    m.On = 1
+                }
+                m.Key = uint8(i)
+            }
+        }
+        a.ToUI <- *m
+    case MSG_INTERNAL_WPM:
+        WPM = m.Hz
+        a.ToUI <- *m
+    case MSG_INTERNAL_PAN:
+        for i, u := range a.Users {
+            if u.Name != "" && u.Name == m.Name {
+                a.Users[i].Instance.pan = C.double(m.Hz)
+            }
+        }
+    case MSG_INTERNAL_JOIN:
+        a.Join(m)
+    case MSG_INTERNAL_HISTOGRAM:
+        m.Text = strings.Join(a.Fist.Last.Histogram(), "\n")
+        a.ToUI <- *m
     case MSG_INTERNAL_NAMES:
-        m.Type = MSG_HZ
         for _, u := range a.Users {
             if u.Name != "" {
+                m.Key = u.Key
                 m.Name = u.Name
                 m.Hz = u.Hz
+                m.Text = u.Presence.String()
                 a.ToUI <- *m
             }
         }
     }
 }
+
+// Audio.Heard() follows the keying of other stations for the logbook. The
+// user's own keying is left to the Fist.
+
+func (a *Audio) Heard(m *Msg) {
+    if m.Key == a.UserKey {
+        return
+    }
+    now := time.Now()
+    a.Copy[m.Key].Key(m.Type == MSG_ON, now)
+    a.Log.Key(m.Key, a.Users[m.Key].Name, a.Users[m.Key].Hz, now)
+}
+
+// Audio.CopyAll() decodes whatever other stations have finished sending, and
+// closes logbook entries that have gone quiet.
+
+func (a *Audio) CopyAll(t time.Time) {
+    for i, _ := range a.Copy {
+        if a.Copy[i].Idle(t) > COPY_GAP {
+            a.Flush(uint8(i))
+        }
+    }
+    if err := a.Log.Expire(t); err != nil {
+        log.Println(err)
+    }
+}
+
+func (a *Audio) Flush(key uint8) {
+    k := a.Copy[key].Take()
+    a.Log.Copy(key, k.Decode())
+}
+
+// Audio.Ping() asks the server to echo the time back, which gives the round
+// trip time once it arrives.
+
+func (a *Audio) Ping(t time.Time) {
+    if a.Server == nil {
+        return
+    }
+    m := Msg{Type: MSG_PING, On: 1, Key: a.UserKey + 1,
+             Hz: float64(t.UnixNano()) / float64(time.Second)}
+    if err := a.Writer.Encode(m); err != nil {
+        log.Println(err)
+    }
+}
+
+// Audio.Join() leaves the current room for the one at m.Text. Everyone in the
+// old room is cleared out as if they had left, and the user's own sound moves
+// to whatever key the new room gives them. The UI is told how it went, with
+// m.On set on success and m.Text holding the error otherwise.
+
+func (a *Audio) Join(m *Msg) {
+    m.On = 0
+    if a.Server == nil {
+        m.Text = "There are no rooms to join offline."
+        a.ToUI <- *m
+        return
+    }
+    s, err := connect(a.Name, m.Text, a.Spectator)
+    if err != nil {
+        m.Text = err.Error()
+        a.ToUI <- *m
+        return
+    } else if s.UsersMax > USERS_MAX {
+        s.Server.Close()
+        m.Text = fmt.Sprintf("That room holds %d users, more than the %d " +
+                             "this session has room for.", s.UsersMax,
+                             USERS_MAX)
+        a.ToUI <- *m
+        return
+    }
+    close(a.Done)
+    a.Server.Close()
+    if a.UDP != nil {
+        a.UDP.Conn.Close()
+        a.UDP = nil
+    }
+    for i, u := range a.Users {
+        if u.Name != "" {
+            leave := Msg{Type: MSG_LEAVE, Key: uint8(i)}
+            a.HandleMsg(&leave)
+        }
+    }
+    if !a.Spectator {
+        a.Users[a.UserKey].Instance.on = 0
+        a.Users[a.UserKey].Instance.dry = 0
+    }
+    a.Use(s)
+    if !a.Spectator {
+        a.Users[a.UserKey].Instance.newPitch = DEFAULT_HZ
+        a.Users[a.UserKey].Instance.dry = 1
+        if hz := a.Prefs.Get().Pitch; hz != 0.0 {
+            a.Send(Msg{Type: MSG_HZ, Hz: hz})
+        }
+        a.Send(a.Presence.Msg())
+    }
+    if a.WantUDP {
+        a.Send(Msg{Type: MSG_UDP})
+    }
+    a.FromServer = make(chan Msg)
+    a.Done = make(chan struct{})
+    go a.ListenTo(a.Reader, a.FromServer, a.Done)
+    m.On = 1
+    m.Key = a.UserKey
+    a.ToUI <- *m
+}
+
+// Audio.StartUDP() takes up the server's answer to a MSG_UDP, after which
+// the user's keying goes by UDP and the room's comes by both. The UI is told
+// either way.
+
+func (a *Audio) StartUDP(m *Msg) {
+    if m.On == 1 {
+        u, err := dialUDP(a.Server, m)
+        if err != nil {
+            m.On = 0
+            m.Name = err.Error()
+        } else {
+            a.UDP = u
+            go u.Listen(a.FromServer, a.Done)
+            go u.Keepalive(a.Done)
+        }
+    }
+    a.ToUI <- *m
+}
@@ -0,0 +1,599 @@
+package main
+
+// Everything but keying itself is done by typing a command on the input line,
+// such as "/pitch 600" or "/mute alice". Tab completes command and user names,
+// and up/down step back through the commands already entered.
+
+/*
+#include <stdlib.h>
+#include "curses-ui.h"
+*/
+import "C"
+
+import (
+    "errors"
+    "fmt"
+    "math"
+    "os"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "unicode"
+    "unicode/utf8"
+    "unsafe"
+)
+
+// A Command is run with whatever words follow its name. An error is shown to
+// the user as is, so it should say how to get it right.
+
+type Command struct {
+    Name string
+    Args string
+    Help string
+    Run func(*UI, []string) error
+}
+
+// The table is filled in by init(), since /help refers back to it.
+
+var COMMANDS []Command
+
+func init() {
+    COMMANDS = []Command{
+        {"help", "[command]", "list commands", cmdHelp},
+        {"who", "", "list who is here", cmdWho},
+        {"pitch", "<hz>", "change your pitch", cmdPitch},
+        {"vol", "<0.0 to 1.0>", "change the volume", cmdVol},
+        {"wpm", "<speed>", "change the sending speed", cmdWpm},
+        {"mute", "<name>", "mute or unmute someone", cmdMute},
+        {"pan", "<name> <-1.0 to 1.0>", "move someone left or right",
+         cmdPan},
+        {"whisper", "[name]", "key to one person only, or the room",
+         cmdWhisper},
+        {"say", "<text>", "chat, as does any line that isn't a command",
+         cmdSay},
+        {"away", "", "mark yourself away, or back", cmdAway},
+        {"status", "[text]", "set or clear your status", cmdStatus},
+        {"skill", "[level]", "set or clear your skill", cmdSkill},
+        {"history", "[minutes] [text|audio|stop]", "catch up on the room",
+         cmdHistory},
+        {"bind", "[key] [command]", "run a command from F1 to F12", cmdBind},
+        {"send", "[text]", "key text, or stop keying it", cmdSend},
+        {"on", "", "lock sound on", cmdOn},
+        {"off", "", "lock sound off", cmdOff},
+        {"floor", "", "request the floor", cmdFloor},
+        {"join", "<host:port>", "leave for another room", cmdJoin},
+        {"histogram", "", "timing histogram of your last over", cmdHistogram},
+        {"koch", "", "Koch practice", cmdKoch},
+        {"contest", "", "contest simulator", cmdContest},
+        {"band", "[condition]", "band conditions", cmdBand},
+        {"view", "[name]", "messages, timeline or waterfall", cmdView},
+        {"log", "[n field value]", "list and edit the logbook", cmdLog},
+        {"export", "", "export the logbook", cmdExport},
+        {"quit", "", "quit", cmdQuit},
+    }
+}
+
+// UI.RunCommand() runs a line typed by the user, or sends it as text chat if
+// it is not a command. Unknown commands are met with the closest known one,
+// going by the same edit distance used to score copy.
+
+func (ui *UI) RunCommand(line string) {
+    words := strings.Fields(line)
+    if len(words) == 0 {
+        return
+    } else if !strings.HasPrefix(words[0], "/") {
+        if err := ui.Say(strings.TrimSpace(line)); err != nil {
+            printLine(err.Error())
+        }
+        return
+    }
+    name := strings.ToLower(words[0][1:])
+    for _, c := range COMMANDS {
+        if c.Name == name {
+            if err := c.Run(ui, words[1:]); err != nil {
+                printLine(err.Error())
+            }
+            return
+        }
+    }
+    best, score := "", 0.0
+    for _, c := range COMMANDS {
+        if s := accuracy(c.Name, name); s > score {
+            best, score = c.Name, s
+        }
+    }
+    if best != "" {
+        printLine(fmt.Sprintf("Unknown command /%s. Did you mean /%s? Type " +
+                              "/help for a list.", name, best))
+    } else {
+        printLine(fmt.Sprintf("Unknown command /%s. Type /help for a list.",
+                              name))
+    }
+}
+
+// UI.Complete() finishes the last word of a line, as far as it can. The first
+// word of a command is completed from the command names, and any other word
+// from the names of those in the room. If there is more than one candidate,
+// they are listed.
+
+func (ui *UI) Complete(line string) string {
+    i := strings.LastIndex(line, " ") + 1
+    word := strings.ToLower(line[i:])
+    var names []string
+    if i == 0 && strings.HasPrefix(word, "/") {
+        for _, c := range COMMANDS {
+            names = append(names, "/" + c.Name)
+        }
+    } else {
+        names = ui.names()
+    }
+    var matches []string
+    for _, n := range names {
+        if strings.HasPrefix(strings.ToLower(n), word) {
+            matches = append(matches, n)
+        }
+    }
+    switch len(matches) {
+    case 0:
+        return line
+    case 1:
+        return line[:i] + matches[0] + " "
+    }
+    printLine(strings.Join(matches, " "))
+    common := []rune(matches[0])
+    for _, n := range matches[1:] {
+        rs := []rune(n)
+        j := 0
+        for j < len(common) && j < len(rs) &&
+            unicode.ToLower(common[j]) == unicode.ToLower(rs[j]) {
+            j++
+        }
+        common = common[:j]
+    }
+    if len(string(common)) < len(word) {
+        return line
+    }
+    return line[:i] + string(common)
+}
+
+// UI.Remember() adds a line to the command history, and UI.Recall() steps
+// through it, returning the empty line when stepping past the newest.
+
+func (ui *UI) Remember(line string) {
+    n := len(ui.Typed)
+    if line != "" && (n == 0 || ui.Typed[n-1] != line) {
+        ui.Typed = append(ui.Typed, line)
+        if len(ui.Typed) > COMMAND_HISTORY {
+            ui.Typed = ui.Typed[1:]
+        }
+    }
+    ui.Recalled = len(ui.Typed)
+}
+
+func (ui *UI) Recall(step int) string {
+    ui.Recalled += step
+    if ui.Recalled < 0 {
+        ui.Recalled = 0
+    } else if ui.Recalled >= len(ui.Typed) {
+        ui.Recalled = len(ui.Typed)
+        return ""
+    }
+    return ui.Typed[ui.Recalled]
+}
+
+// Replaces the line being typed.
+
+func setInput(buf *C.char, n *C.int, s string) {
+    cs := C.CString(s)
+    C.setInput(buf, C.TEXT_MAX, n, cs)
+    C.free(unsafe.Pointer(cs))
+}
+
+// The commands themselves follow.
+
+func cmdHelp(ui *UI, args []string) error {
+    if len(args) == 0 {
+        printLine("click - sound")
+    }
+    for _, c := range COMMANDS {
+        if len(args) == 0 || strings.TrimPrefix(args[0], "/") == c.Name {
+            printLine(fmt.Sprintf("/%s %s - %s", c.Name, c.Args, c.Help))
+        }
+    }
+    return nil
+}
+
+func cmdWho(ui *UI, args []string) error {
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_NAMES}
+    return nil
+}
+
+func cmdPitch(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectator
+    }
+    d, err := number(args, "/pitch 600")
+    if err != nil {
+        return err
+    }
+    d = clamp(d, FREQ_MIN, FREQ_MAX)
+    ui.ToAudio <- Msg{Type: MSG_HZ, Hz: d}
+    ui.save(func(c *Config) {
+        c.Pitch = d
+    })
+    return nil
+}
+
+func cmdVol(ui *UI, args []string) error {
+    d, err := number(args, "/vol 0.4")
+    if err != nil {
+        return err
+    }
+    d = clamp(d, VOLUME_MIN, VOLUME_MAX)
+    printLine("Volume = " + strconv.FormatFloat(d, 'f', 3, 64))
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_VOLUME, Hz: d}
+    ui.save(func(c *Config) {
+        c.Volume = d
+    })
+    return nil
+}
+
+func cmdWpm(ui *UI, args []string) error {
+    d, err := number(args, "/wpm 20")
+    if err != nil {
+        return err
+    }
+    d = clamp(d, WPM_MIN, WPM_MAX)
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_WPM, Hz: d}
+    ui.save(func(c *Config) {
+        c.Wpm = d
+    })
+    ui.publish(func(p *Presence) {
+        p.WPM = d
+    })
+    return nil
+}
+
+func cmdMute(ui *UI, args []string) error {
+    if len(args) == 0 {
+        return errors.New("Give a name to mute, such as /mute alice.")
+    }
+    name := strings.Join(args, " ")
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_MUTE, Name: name}
+    return nil
+}
+
+// /pan takes the name first, to match /mute, though names with spaces then
+// need the number split off the end.
+
+func cmdPan(ui *UI, args []string) error {
+    if len(args) < 2 {
+        return errors.New("Give a name and a pan, such as /pan alice -0.5.")
+    }
+    name := strings.Join(args[:len(args)-1], " ")
+    d, err := number(args[len(args)-1:], "/pan alice -0.5")
+    if err != nil {
+        return err
+    }
+    d = clamp(d, -1.0, 1.0)
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_PAN, Name: name, Hz: d}
+    ui.save(func(c *Config) {
+        if d == 0.0 {
+            delete(c.Pans, name)
+        } else {
+            c.Pans[name] = d
+        }
+    })
+    printLine(fmt.Sprintf("%s panned to %.2f.", name, d))
+    return nil
+}
+
+// /whisper with a name keys to that user alone, and without one keys to the
+// room again. The server answers either way.
+
+func cmdWhisper(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectator
+    }
+    ui.ToAudio <- Msg{Type: MSG_WHISPER, Name: strings.Join(args, " ")}
+    return nil
+}
+
+// /say is only needed to bind text chat to a key.
+
+func cmdSay(ui *UI, args []string) error {
+    return ui.Say(strings.Join(args, " "))
+}
+
+// UI.Say() sends a line of text chat. It is shown once the server passes it
+// back, unless the room is kept to CW.
+
+func (ui *UI) Say(text string) error {
+    if ui.Spectator {
+        return errors.New("Spectators cannot chat.")
+    } else if text == "" {
+        return errors.New("Give something to say, such as /say QRS please.")
+    } else if utf8.RuneCountInString(text) > TEXT_CHARS_MAX {
+        return fmt.Errorf("Text may be %d characters at most.", TEXT_CHARS_MAX)
+    }
+    ui.ToAudio <- Msg{Type: MSG_TEXT, Text: text}
+    return nil
+}
+
+// /away marks the user away until they use it again. Keying or chatting does
+// not bring them back, as it does from idle.
+
+func cmdAway(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectatorPresence
+    }
+    if ui.Presence.State == PRESENCE_AWAY {
+        ui.publish(func(p *Presence) {
+            p.State = PRESENCE_HERE
+        })
+        printLine("You are back.")
+    } else {
+        ui.publish(func(p *Presence) {
+            p.State = PRESENCE_AWAY
+        })
+        printLine("You are away.")
+    }
+    return nil
+}
+
+func cmdStatus(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectatorPresence
+    }
+    status := strings.Join(args, " ")
+    if utf8.RuneCountInString(status) > STATUS_CHARS_MAX {
+        return fmt.Errorf("A status may be %d characters at most.",
+                          STATUS_CHARS_MAX)
+    }
+    ui.publish(func(p *Presence) {
+        p.Status = status
+    })
+    if status == "" {
+        printLine("Status cleared.")
+    } else {
+        printLine("Status: " + status)
+    }
+    return nil
+}
+
+// /skill is saved, so that it is published in every session.
+
+func cmdSkill(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectatorPresence
+    }
+    skill := strings.ToLower(strings.Join(args, " "))
+    if skill != "" && !validSkill(skill) {
+        return fmt.Errorf("Give a skill of %s, or none to clear it.",
+                          strings.Join(SKILLS, ", "))
+    }
+    ui.publish(func(p *Presence) {
+        p.Skill = skill
+    })
+    ui.save(func(c *Config) {
+        c.Skill = skill
+    })
+    if skill == "" {
+        printLine("Skill cleared.")
+    } else {
+        printLine("Skill: " + skill)
+    }
+    return nil
+}
+
+// /history takes its minutes and what to recall in either order. Text is
+// printed, and audio is replayed until it is done or stopped.
+
+func cmdHistory(ui *UI, args []string) error {
+    m := Msg{Type: MSG_HISTORY, Hz: REPLAY_MINUTES}
+    for _, arg := range args {
+        switch strings.ToLower(arg) {
+        case "text":
+            m.On = 0
+        case "audio":
+            m.On = 1
+        case "stop":
+            ui.stopReplay()
+            return nil
+        default:
+            d, err := strconv.ParseFloat(arg, 64)
+            if err != nil || !(d > 0.0) || math.IsInf(d, 1) {
+                return errors.New("Give minutes and text or audio, such " +
+                                  "as /history 10 audio.")
+            }
+            m.Hz = d
+        }
+    }
+    ui.ToAudio <- m
+    return nil
+}
+
+// /bind lists the bindings, shows one, or sets one. A key bound to nothing is
+// unbound.
+
+func cmdBind(ui *UI, args []string) error {
+    if len(args) > 0 && !validKey(args[0]) {
+        return errors.New("Only F1 to F12 may be bound, such as /bind F1 " +
+                          "/send CQ CQ.")
+    }
+    if len(args) > 1 && !strings.HasPrefix(args[1], "/") {
+        return errors.New("Keys are bound to commands, which start with a " +
+                          "slash.")
+    }
+    for i := 1; i <= 12; i++ {
+        key := fmt.Sprintf("F%d", i)
+        if len(args) == 0 || strings.EqualFold(args[0], key) {
+            if len(args) > 1 {
+                line := strings.Join(args[1:], " ")
+                ui.save(func(c *Config) {
+                    c.Binds[key] = line
+                })
+            } else if len(args) == 1 && ui.Prefs.Bind(key) != "" {
+                ui.save(func(c *Config) {
+                    delete(c.Binds, key)
+                })
+                printLine(key + " is unbound.")
+                continue
+            }
+            if line := ui.Prefs.Bind(key); line != "" {
+                printLine(key + ": " + line)
+            }
+        }
+    }
+    return nil
+}
+
+// /send keys its text just as if the user were clicking, at WPM. Another
+// /send takes over from one still going, and a bare /send simply stops it.
+
+func cmdSend(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectator
+    }
+    gen := atomic.AddInt32(&ui.Sending, 1)
+    if len(args) == 0 {
+        return nil
+    }
+    live := func() bool {
+        return atomic.LoadInt32(&ui.Sending) == gen
+    }
+    key := func(on bool) {
+        if on {
+            ui.key(1, MSG_ON)
+        } else {
+            ui.key(0, MSG_OFF)
+        }
+    }
+    go sendMorse(strings.Join(args, " "), NewTiming(WPM, WPM), key, live)
+    return nil
+}
+
+func cmdOn(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectator
+    }
+    ui.key(1, MSG_ON)
+    return nil
+}
+
+func cmdOff(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectator
+    }
+    ui.key(0, MSG_OFF)
+    return nil
+}
+
+func cmdFloor(ui *UI, args []string) error {
+    if ui.Spectator {
+        return errSpectator
+    }
+    ui.ToAudio <- Msg{Type: MSG_FLOOR_REQUEST}
+    return nil
+}
+
+func cmdJoin(ui *UI, args []string) error {
+    if len(args) != 1 {
+        return errors.New("Give the room's address, such as /join " +
+                          "example.com:7400.")
+    }
+    printLine("Joining " + args[0] + "...")
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_JOIN, Text: args[0]}
+    return nil
+}
+
+func cmdHistogram(ui *UI, args []string) error {
+    ui.ToAudio <- Msg{Type: MSG_INTERNAL_HISTOGRAM}
+    return nil
+}
+
+func cmdKoch(ui *UI, args []string) error {
+    ui.Koch()
+    return nil
+}
+
+func cmdContest(ui *UI, args []string) error {
+    ui.Contest()
+    return nil
+}
+
+func cmdBand(ui *UI, args []string) error {
+    ui.Conditions(args)
+    return nil
+}
+
+func cmdView(ui *UI, args []string) error {
+    if len(args) == 0 {
+        ui.CycleView()
+        return nil
+    }
+    for i, v := range VIEW_NAMES {
+        if strings.HasPrefix(v, strings.ToLower(args[0])) {
+            atomic.StoreInt32(&ui.View, int32(i))
+            return nil
+        }
+    }
+    return fmt.Errorf("There is no %s view. Try %s.", args[0],
+                      strings.Join(VIEW_NAMES, ", "))
+}
+
+func cmdLog(ui *UI, args []string) error {
+    ui.EditLog(args)
+    return nil
+}
+
+func cmdExport(ui *UI, args []string) error {
+    ui.ExportLog()
+    return nil
+}
+
+func cmdQuit(ui *UI, args []string) error {
+    if ui.Log != nil {
+        ui.Log.CloseAll()
+    }
+    C.endwin()
+    os.Exit(1)
+    return nil
+}
+
+var errSpectator = errors.New("Spectators cannot key.")
+var errSpectatorPresence = errors.New("Spectators publish no presence.")
+
+// UI.key() switches the user's sound on or off right away, as a click does,
+// and lets everyone else know.
+
+func (ui *UI) key(on C.uint, t uint8) {
+    if ui.Screen.audioOn != nil {
+        *ui.Screen.audioOn = on
+    }
+    ui.ToAudio <- Msg{Type: t}
+}
+
+// number() reads the single number a command takes, with an example of its
+// use in case there isn't one.
+
+func number(args []string, example string) (float64, error) {
+    if len(args) != 1 {
+        return 0.0, fmt.Errorf("Give a single number, such as %s.", example)
+    }
+    d, err := strconv.ParseFloat(args[0], 64)
+    if err != nil || math.IsNaN(d) {
+        return 0.0, fmt.Errorf("%s is not a number. Try %s.", args[0],
+                               example)
+    }
+    return d, nil
+}
+
+func clamp(d float64, lo float64, hi float64) float64 {
+    if d > hi {
+        return hi
+    } else if d < lo {
+        return lo
+    }
+    return d
+}
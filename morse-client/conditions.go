@@ -0,0 +1,127 @@
+package main
+
+// Simulated band conditions. These are applied locally, in the C playback
+// loop, to every other user and to practice material alike. The user's own
+// sidetone is always left clean.
+
+/*
+#include "audio-output.h"
+*/
+import "C"
+
+import (
+    "fmt"
+    "math"
+    "strconv"
+    "strings"
+)
+
+// UI.Conditions() changes one of the band conditions, given as words such as
+// "noise 10 pink" or "fade 0.8 0.2 random". Without any, it shows the current
+// conditions and asks for a change.
+
+func (ui *UI) Conditions(args []string) {
+    if len(args) == 0 {
+        printLine("Band conditions: " + describeBand(ui.Band))
+        printLine("Change one of: noise <snr dB> [pink], " +
+                  "fade <depth 0-1> <hz> [random], drift <hz>, chirp <hz>, " +
+                  "qrn <crashes a second>, or clear. Zero turns one off.")
+        args = strings.Fields(readLine())
+    }
+    if err := setBand(ui.Band, strings.Fields(strings.ToLower(
+                      strings.Join(args, " ")))); err != nil {
+        printLine(err.Error())
+        return
+    }
+    printLine("Band conditions: " + describeBand(ui.Band))
+}
+
+func setBand(b *C.Conditions, args []string) error {
+    if len(args) == 0 {
+        return nil
+    } else if args[0] == "clear" {
+        *b = C.Conditions{}
+        return nil
+    }
+    nums := []float64{}
+    flag := ""
+    for _, s := range args[1:] {
+        if d, err := strconv.ParseFloat(s, 64); err == nil {
+            if d < 0.0 || math.IsNaN(d) || math.IsInf(d, 0) {
+                return fmt.Errorf("%s is out of range.", s)
+            }
+            nums = append(nums, d)
+        } else {
+            flag = s
+        }
+    }
+    if len(nums) == 0 {
+        return fmt.Errorf("%s needs a value.", args[0])
+    }
+    switch args[0] {
+    case "noise":
+        // Zero is taken to mean off rather than a deafening 0dB
+        b.noise = 0.0
+        if nums[0] > 0.0 {
+            b.noise = C.double(math.Pow(10.0, -nums[0] / 20.0))
+        }
+        b.pink = 0
+        if flag == "pink" {
+            b.pink = 1
+        }
+    case "fade":
+        if len(nums) < 2 {
+            return fmt.Errorf("fade needs a depth and a rate.")
+        }
+        b.fadeDepth = C.double(math.Min(nums[0], 1.0))
+        b.fadeRate = C.double(nums[1])
+        b.fadeRandom = 0
+        if flag == "random" {
+            b.fadeRandom = 1
+        }
+    case "drift":
+        b.drift = C.double(nums[0])
+    case "chirp":
+        b.chirp = C.double(nums[0])
+    case "qrn":
+        b.qrn = C.double(nums[0])
+    default:
+        return fmt.Errorf("Unknown condition %s.", args[0])
+    }
+    return nil
+}
+
+func describeBand(b *C.Conditions) string {
+    s := []string{}
+    if b.noise > 0.0 {
+        kind := "white"
+        if b.pink == 1 {
+            kind = "pink"
+        }
+        s = append(s, fmt.Sprintf("%s noise at %.0fdB SNR", kind,
+                                  -20.0 * math.Log10(float64(b.noise))))
+    }
+    if b.fadeDepth > 0.0 {
+        kind := "sine"
+        if b.fadeRandom == 1 {
+            kind = "random"
+        }
+        s = append(s, fmt.Sprintf("%s fading %.0f%% deep at %.2fHz", kind,
+                                  float64(b.fadeDepth) * 100.0,
+                                  float64(b.fadeRate)))
+    }
+    if b.drift > 0.0 {
+        s = append(s, fmt.Sprintf("drift of %.0fHz", float64(b.drift)))
+    }
+    if b.chirp > 0.0 {
+        s = append(s, fmt.Sprintf("chirp of %.0fHz", float64(b.chirp)))
+    }
+    if b.qrn > 0.0 {
+        s = append(s, fmt.Sprintf("%.1f static crashes a second",
+                                  float64(b.qrn)))
+    }
+    if len(s) == 0 {
+        return "clean"
+    }
+    return strings.Join(s, ", ")
+}
@@ -0,0 +1,257 @@
+package main
+
+// Preferences are kept in ~/.morse-client/config, one setting to a line, as
+// its name followed by its value:
+//
+//     server example.com:7400
+//     name alice
+//     pitch 600
+//     volume 0.8
+//     wpm 20
+//     fwpm 10
+//     skill intermediate
+//     mute bob
+//     pan -0.5 carol
+//     bind F1 /send CQ CQ DE ALICE K
+//
+// Names come last, since they may contain spaces. Without a pitch, the server
+// picks one clear of everybody else's. Blank lines and lines
+// starting with # are skipped. The file is rewritten whenever a setting is
+// changed from within the client, so comments do not survive that.
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "math"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// A Config holds every setting. A Pitch of zero leaves it to the server. Mutes
+// and pans are by user name, and bindings are from function key names ("F1"
+// to "F12") to command lines.
+
+type Config struct {
+    Server string
+    Name string
+    Pitch float64
+    Volume float64
+    Wpm float64
+    Fwpm float64
+    Skill string
+    Mutes map[string]bool
+    Pans map[string]float64
+    Binds map[string]string
+}
+
+func NewConfig() Config {
+    return Config{Volume: VOLUME_MAX, Wpm: WPM,
+                  Fwpm: FARNSWORTH_WPM, Mutes: make(map[string]bool),
+                  Pans: make(map[string]float64),
+                  Binds: make(map[string]string)}
+}
+
+// Preferences hold the Config in effect, which is the file's plus whatever
+// flags overrode it, and the file's own. Changes made in the client go to
+// both, and the file is saved, so that flags only last a session. The file is
+// never saved if it could not be read in the first place, so as not to throw
+// away whatever the user wrote.
+
+type Preferences struct {
+    sync.Mutex
+    Config Config
+    File Config
+    Path string
+}
+
+func LoadPreferences(path string) (*Preferences, error) {
+    p := Preferences{Config: NewConfig(), File: NewConfig(), Path: path}
+    if path == "" {
+        if p.Path, _ = stateFile("config"); p.Path == "" {
+            return &p, nil
+        }
+    }
+    f, err := os.Open(p.Path)
+    if os.IsNotExist(err) {
+        return &p, nil
+    } else if err != nil {
+        p.Path = ""
+        return &p, err
+    }
+    defer f.Close()
+    scanner := bufio.NewScanner(f)
+    for n := 1; scanner.Scan(); n++ {
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || strings.HasPrefix(line, "#") {
+            continue
+        }
+        fields := strings.SplitN(line, " ", 2)
+        if len(fields) < 2 {
+            fields = append(fields, "")
+        }
+        if err := p.File.Set(fields[0], strings.TrimSpace(fields[1]));
+           err != nil {
+            path := p.Path
+            p.Path = ""
+            return &p, fmt.Errorf("%s line %d: %s", path, n, err)
+        }
+        p.Config.Set(fields[0], strings.TrimSpace(fields[1]))
+    }
+    if err := scanner.Err(); err != nil {
+        p.Path = ""
+        return &p, err
+    }
+    return &p, nil
+}
+
+// Config.Set() changes one setting, given as it would be written in the file.
+
+func (c *Config) Set(setting string, value string) error {
+    var err error
+    number := func(lo float64, hi float64) float64 {
+        d, e := strconv.ParseFloat(value, 64)
+        if e != nil || math.IsNaN(d) {
+            err = fmt.Errorf("A number is needed for %s.", setting)
+        }
+        return clamp(d, lo, hi)
+    }
+    switch setting {
+    case "server":
+        c.Server = value
+    case "name":
+        c.Name = value
+    case "pitch":
+        c.Pitch = number(FREQ_MIN, FREQ_MAX)
+    case "volume":
+        c.Volume = number(VOLUME_MIN, VOLUME_MAX)
+    case "wpm":
+        c.Wpm = number(WPM_MIN, WPM_MAX)
+    case "fwpm":
+        c.Fwpm = number(WPM_MIN, WPM_MAX)
+    case "skill":
+        if value != "" && !validSkill(value) {
+            return fmt.Errorf("Skill must be one of %s.",
+                              strings.Join(SKILLS, ", "))
+        }
+        c.Skill = value
+    case "mute":
+        if value == "" {
+            return errors.New("Mute needs a name.")
+        }
+        c.Mutes[value] = true
+    case "pan":
+        fields := strings.SplitN(value, " ", 2)
+        value = fields[0]
+        pan := number(-1.0, 1.0)
+        if len(fields) < 2 || strings.TrimSpace(fields[1]) == "" {
+            return errors.New("Pan needs a number and a name.")
+        }
+        c.Pans[strings.TrimSpace(fields[1])] = pan
+    case "bind":
+        fields := strings.SplitN(value, " ", 2)
+        if !validKey(fields[0]) || len(fields) < 2 {
+            return errors.New("Bind needs a key from F1 to F12 and a " +
+                              "command.")
+        }
+        c.Binds[strings.ToUpper(fields[0])] = strings.TrimSpace(fields[1])
+    default:
+        return fmt.Errorf("Unknown setting %s.", setting)
+    }
+    return err
+}
+
+// Config.String() writes out the Config as the file would hold it.
+
+func (c *Config) String() string {
+    var b strings.Builder
+    b.WriteString("# morse-client settings, rewritten whenever they are " +
+                  "changed in the client\n")
+    if c.Server != "" {
+        fmt.Fprintf(&b, "server %s\n", c.Server)
+    }
+    if c.Name != "" {
+        fmt.Fprintf(&b, "name %s\n", c.Name)
+    }
+    if c.Pitch != 0.0 {
+        fmt.Fprintf(&b, "pitch %g\n", c.Pitch)
+    }
+    fmt.Fprintf(&b, "volume %g\nwpm %g\nfwpm %g\n", c.Volume, c.Wpm,
+                c.Fwpm)
+    if c.Skill != "" {
+        fmt.Fprintf(&b, "skill %s\n", c.Skill)
+    }
+    for _, name := range sortedKeys(c.Mutes) {
+        fmt.Fprintf(&b, "mute %s\n", name)
+    }
+    for _, name := range sortedKeys(c.Pans) {
+        fmt.Fprintf(&b, "pan %g %s\n", c.Pans[name], name)
+    }
+    keys := sortedKeys(c.Binds)
+    sort.Slice(keys, func(i, j int) bool {
+        return len(keys[i]) < len(keys[j]) ||
+               (len(keys[i]) == len(keys[j]) && keys[i] < keys[j])
+    })
+    for _, key := range keys {
+        fmt.Fprintf(&b, "bind %s %s\n", key, c.Binds[key])
+    }
+    return b.String()
+}
+
+// Preferences.Change() applies a change to both Configs and saves the file.
+
+func (p *Preferences) Change(f func(*Config)) error {
+    p.Lock()
+    defer p.Unlock()
+    f(&p.Config)
+    f(&p.File)
+    if p.Path == "" {
+        return nil
+    }
+    return os.WriteFile(p.Path, []byte(p.File.String()), 0644)
+}
+
+// Preferences.Get() returns a copy of the Config in effect. The maps are
+// shared, so only its other settings should be read from the copy.
+
+func (p *Preferences) Get() Config {
+    p.Lock()
+    defer p.Unlock()
+    return p.Config
+}
+
+func (p *Preferences) Muted(name string) bool {
+    p.Lock()
+    defer p.Unlock()
+    return p.Config.Mutes[name]
+}
+
+func (p *Preferences) Pan(name string) float64 {
+    p.Lock()
+    defer p.Unlock()
+    return p.Config.Pans[name]
+}
+
+func (p *Preferences) Bind(key string) string {
+    p.Lock()
+    defer p.Unlock()
+    return p.Config.Binds[key]
+}
+
+func validKey(key string) bool {
+    key = strings.ToUpper(key)
+    n, err := strconv.Atoi(strings.TrimPrefix(key, "F"))
+    return err == nil && strings.HasPrefix(key, "F") && n >= 1 && n <= 12
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+    keys := make([]string, 0, len(m))
+    for k, _ := range m {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -3,18 +3,16 @@ package main
 // Global values, some of which are not technically constant, but which are
 // referenced during runtime and changed infrequently.
 
+import (
+    "time"
+)
+
 const (
     
-    // Curses keys
+    // Curses keys, as mouse events are reported
 
-    KEY_ENTER = 10
-    KEY_E = 101
-    KEY_H = 104
-    KEY_N = 110
     KEY_O = 111
     KEY_P = 112
-    KEY_Q = 113
-    KEY_V = 118
 
     // Min/max inputs
 
@@ -22,11 +20,101 @@ const (
     FREQ_MAX = 20000.0
     VOLUME_MIN = 0.0
     VOLUME_MAX = 1.0
+    WPM_MIN = 5.0
+    WPM_MAX = 60.0
+
+    // The longest line of text chat and the longest status the server takes,
+    // in characters
+
+    TEXT_CHARS_MAX = 200
+    STATUS_CHARS_MAX = 60
 
     // Text buffer length (set HISTORY_LEN_MAX to 1 more than intended max)
 
     HISTORY_LEN_MAX = 31 
     HISTORY_MAX = HISTORY_LEN_MAX - 1
+
+    // Commands remembered for up/down on the input line
+
+    COMMAND_HISTORY = 100
+
+    // Local AudioInstances available for practice material
+
+    LOCAL_MAX = 8
+
+    // The pitch a user starts at, unless they have chosen another
+
+    DEFAULT_HZ = 440.0
+
+    // Someone whispering to the user is played this much higher than their
+    // pitch, a fifth, so that the whisper stands apart from the room
+
+    WHISPER_SHIFT = 1.5
+
+    // How many minutes of the room's history /history asks for unless told,
+    // and the longest silence a replay of it keeps
+
+    REPLAY_MINUTES = 5.0
+    REPLAY_GAP = 2 * time.Second
+
+    // Practice settings
+
+    PRACTICE_HZ = 600.0
+    KOCH_GROUPS = 10
+    KOCH_GROUP_LEN = 5
+    KOCH_PASS = 0.9
+
+    // Contest simulator settings. Stations are spread around PRACTICE_HZ,
+    // and as many as CONTEST_PILEUP may answer a CQ at once.
+
+    CONTEST_TIME = 10 * time.Minute
+    CONTEST_PILEUP = 3
+    CONTEST_SPREAD = 300.0
+    CONTEST_WPM_MIN = 18
+    CONTEST_WPM_MAX = 34
+    CONTEST_LEVEL_MIN = 0.2
+
+    // Silence that marks the end of the user's over, when their sending is
+    // summarized
+
+    OVER_GAP = 3 * time.Second
+
+    // Silence after which another station's keying is decoded, and after
+    // which their logbook entry is closed
+
+    COPY_GAP = 2 * time.Second
+    QSO_IDLE = 5 * time.Minute
+
+    // How often the server is pinged for the round trip time
+
+    PING_INTERVAL = 5 * time.Second
+
+    // Keying over UDP. Each datagram repeats the latest UDP_REDUNDANCY
+    // transitions, and is sent again UDP_RESENDS times, UDP_RESEND apart. The
+    // server is reminded where the client is every UDP_KEEPALIVE. As many as
+    // UDP_QUEUE datagrams wait to be handled.
+
+    UDP_REDUNDANCY = 4
+    UDP_RESENDS = 2
+    UDP_RESEND = 20 * time.Millisecond
+    UDP_KEEPALIVE = 2 * time.Second
+    UDP_PACKET_MAX = 512
+    UDP_QUEUE = 64
+
+    // Timeline and waterfall views. Keying is kept for VIEW_HISTORY, and the
+    // views are redrawn every VIEW_REFRESH. The waterfall spans at least
+    // WATERFALL_SPAN hz, leaving WATERFALL_MARGIN either side of the room.
+
+    VIEW_HISTORY = time.Minute
+    VIEW_REFRESH = 100 * time.Millisecond
+    TIMELINE_STEP = 50 * time.Millisecond
+    WATERFALL_STEP = 250 * time.Millisecond
+    WATERFALL_SPAN = 400.0
+    WATERFALL_MARGIN = 100.0
+
+    // Logbook exports are written here, with .adi and .csv appended
+
+    LOG_EXPORT = "morse-log"
 )
 
 
@@ -35,3 +123,20 @@ const (
 // up.
 
 var USERS_MAX int
+
+// Sending speed in words per minute, and the slower overall speed that
+// characters are spaced out to (Farnsworth). Used for practice material.
+
+var WPM = 20.0
+var FARNSWORTH_WPM = 10.0
+
+// Simulated loss (0.0 to 1.0) and jitter for keying over UDP, in both
+// directions. Specified by -loss and -jitter
+
+var UDP_LOSS float64
+var UDP_JITTER time.Duration
+
+// How far behind the room's keying over UDP is played, so that late or
+// recovered transitions still sound when they should. Specified by -playout
+
+var UDP_PLAYOUT time.Duration
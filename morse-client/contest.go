@@ -0,0 +1,249 @@
+package main
+
+// A contest simulator, in the manner of the standalone contest trainers.
+// Synthetic stations are played on the local AudioInstances, each at its own
+// pitch, speed and signal level, and the user works as many of them as they
+// can before CONTEST_TIME runs out. Replies may be typed or keyed. Nothing is
+// sent to the server, so the simulator works just as well offline.
+
+/*
+#include <stdlib.h>
+#include "curses-ui.h"
+*/
+import "C"
+
+import (
+    "fmt"
+    "math/rand"
+    "strconv"
+    "strings"
+    "time"
+    "unsafe"
+)
+
+// Callsign prefixes that stations are drawn from.
+
+var CONTEST_PREFIXES = []string{"K", "W", "N", "AA", "KB", "VE", "G", "M",
+                                "DL", "F", "EA", "I", "ON", "PA", "OH", "SM",
+                                "OK", "SP", "JA", "LU", "PY", "VK", "ZL"}
+
+// A Station is one of the synthetic stations. Each is played on a slot of its
+// own, and sends Nr as its serial number.
+
+type Station struct {
+    Call string
+    Nr int
+    Slot int
+    Hz float64
+    Wpm float64
+}
+
+// The Contest keeps score. Copy totals the accuracy of every logged QSO, and
+// Recorder follows the user's keying while they reply. The user's own sending
+// is played on slot 0, so stations take slots 1 and up.
+
+type Contest struct {
+    UI *UI
+    Start time.Time
+    QSOs int
+    Clean int
+    Copy float64
+    Recorder Recorder
+    Buffer *C.char
+}
+
+// UI.Contest() runs a session. Each round either has the user call CQ and
+// answer one of a pileup, or has a station call CQ for the user to answer.
+// Replying QRT ends the session early.
+
+func (ui *UI) Contest() {
+    c := Contest{UI: ui, Start: time.Now()}
+    c.Buffer = (*C.char)(C.malloc(C.TEXT_MAX))
+    defer C.free(unsafe.Pointer(c.Buffer))
+    ui.Keyer.Dry(0, true)
+    defer ui.Keyer.Dry(0, false)
+    printLine(fmt.Sprintf("Contest for %.0f minutes. Type or key your " +
+                          "replies, or QRT to stop.", CONTEST_TIME.Minutes()))
+    printLine("Log each QSO as the call and serial number you copied.")
+    for time.Since(c.Start) < CONTEST_TIME {
+        var more bool
+        if rand.Intn(2) == 0 {
+            more = c.Run()
+        } else {
+            more = c.Answer()
+        }
+        if !more {
+            break
+        }
+    }
+    c.Quiet()
+    for i := 1 ; i <= CONTEST_PILEUP ; i++ {
+        ui.Keyer.Level(i, 1.0)
+    }
+    rate := float64(c.QSOs) / time.Since(c.Start).Hours()
+    printLine(fmt.Sprintf("%d QSOs, %d clean, %.0f per hour.", c.QSOs, c.Clean,
+                          rate))
+    if c.QSOs > 0 {
+        printLine(fmt.Sprintf("Copy accuracy: %.0f%%",
+                              c.Copy / float64(c.QSOs) * 100.0))
+    }
+}
+
+// Contest.Run() has the user call CQ. Up to CONTEST_PILEUP stations answer,
+// and the one whose call is closest to the user's reply sends its number. A
+// near miss gets the call repeated once.
+
+func (c *Contest) Run() bool {
+    printLine("Call CQ.")
+    r, ok := c.Reply()
+    if !ok {
+        return false
+    } else if !strings.Contains(r, "CQ") {
+        printLine("Nobody heard a CQ.")
+        return true
+    }
+    callers := c.Stations(1 + rand.Intn(CONTEST_PILEUP))
+    for _, st := range callers {
+        go c.Send(st, st.Call)
+    }
+    var st Station
+    for tries := 0 ; tries < 2 ; tries++ {
+        if r, ok = c.Reply(); !ok {
+            return false
+        }
+        best := 0.0
+        for _, s := range callers {
+            if a := accuracy(s.Call, firstField(r)); a > best {
+                best, st = a, s
+            }
+        }
+        if best < 0.5 {
+            printLine("Nobody answered.")
+            return true
+        } else if best == 1.0 || tries > 0 {
+            break
+        }
+        go c.Send(st, st.Call + " " + st.Call)
+    }
+    go c.Send(st, "5NN " + strconv.Itoa(st.Nr))
+    return c.Log(st)
+}
+
+// Contest.Answer() has a station call CQ for the user to answer. The station
+// repeats back whatever call the user sent, then its number.
+
+func (c *Contest) Answer() bool {
+    st := c.Stations(1)[0]
+    go c.Send(st, "CQ TEST " + st.Call + " " + st.Call + " TEST")
+    r, ok := c.Reply()
+    if !ok {
+        return false
+    }
+    go c.Send(st, firstField(r) + " 5NN " + strconv.Itoa(st.Nr))
+    return c.Log(st)
+}
+
+// Contest.Log() takes the user's log entry for a station and scores it.
+
+func (c *Contest) Log(st Station) bool {
+    r, ok := c.Reply()
+    if !ok {
+        return false
+    }
+    fields := strings.Fields(r)
+    call, nr := firstField(r), ""
+    if len(fields) > 1 {
+        nr = fields[len(fields) - 1]
+    }
+    want := st.Call + " " + strconv.Itoa(st.Nr)
+    c.QSOs++
+    c.Copy += accuracy(want, call + " " + nr)
+    if call + " " + nr == want {
+        c.Clean++
+        printLine(want + " logged.")
+    } else {
+        printLine("Busted: that was " + want + ".")
+    }
+    return true
+}
+
+// Contest.Reply() waits for the user's reply, which is either a typed line or
+// keying followed by COPY_GAP of silence. Replying cuts off any stations
+// still sending, and typed replies are played back on slot 0 as if the user
+// had sent them. It returns false if the user sent QRT.
+
+func (c *Contest) Reply() (string, bool) {
+    var n C.int
+    c.Recorder = Recorder{}
+    for {
+        switch C.getResponse(c.UI.Screen, c.Buffer, C.TEXT_MAX, &n) {
+        case C.RESPONSE_LINE:
+            r := strings.ToUpper(strings.TrimSpace(C.GoString(c.Buffer)))
+            c.Quiet()
+            c.UI.Keyer.Send(0, r, PRACTICE_HZ, WPM, WPM)
+            return r, r != "QRT"
+        case C.RESPONSE_KEY:
+            if !c.UI.Spectator {
+                c.Recorder.Key(c.UI.Screen.ch == KEY_O, time.Now())
+            }
+        case C.RESPONSE_NONE:
+            if c.Recorder.Idle(time.Now()) > COPY_GAP {
+                c.Quiet()
+                k := c.Recorder.Take()
+                r := k.Decode()
+                C.clearInput()
+                printLine(r)
+                return r, r != "QRT"
+            }
+        }
+    }
+}
+
+// Contest.Stations() makes up n stations with distinct calls. Their levels
+// are set on their slots straight away.
+
+func (c *Contest) Stations(n int) []Station {
+    sts := make([]Station, n)
+    calls := make(map[string]bool)
+    for i, _ := range sts {
+        call := callsign()
+        for calls[call] {
+            call = callsign()
+        }
+        calls[call] = true
+        sts[i] = Station{Call: call, Nr: 1 + rand.Intn(999), Slot: i + 1,
+                         Hz: PRACTICE_HZ + (rand.Float64() * 2.0 - 1.0) *
+                             CONTEST_SPREAD,
+                         Wpm: float64(CONTEST_WPM_MIN +
+                              rand.Intn(CONTEST_WPM_MAX - CONTEST_WPM_MIN))}
+        c.UI.Keyer.Level(sts[i].Slot, CONTEST_LEVEL_MIN +
+                         rand.Float64() * (1.0 - CONTEST_LEVEL_MIN))
+    }
+    return sts
+}
+
+func (c *Contest) Send(st Station, text string) {
+    c.UI.Keyer.Send(st.Slot, text, st.Hz, st.Wpm, st.Wpm)
+}
+
+func (c *Contest) Quiet() {
+    for i := 1 ; i <= CONTEST_PILEUP ; i++ {
+        c.UI.Keyer.Stop(i)
+    }
+}
+
+func callsign() string {
+    b := []byte(CONTEST_PREFIXES[rand.Intn(len(CONTEST_PREFIXES))])
+    b = append(b, byte('0' + rand.Intn(10)))
+    for i := rand.Intn(3) ; i >= 0 ; i-- {
+        b = append(b, byte('A' + rand.Intn(26)))
+    }
+    return string(b)
+}
+
+func firstField(s string) string {
+    if fields := strings.Fields(s); len(fields) > 0 {
+        return fields[0]
+    }
+    return ""
+}
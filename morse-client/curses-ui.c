@@ -1,57 +1,541 @@
 #include "curses-ui.h"
 
+/* Screen functions called from Go outside of the input loop (printing,
+ * mostly) don't take a Screen, so the one passed to initScreen() is kept
+ * here. */
+
+static Screen *screen = NULL;
+
+/* Returns the length in bytes of the UTF-8 character at s, up to n bytes,
+ * and its width in columns in *w. Bytes that don't make up a character are
+ * taken one at a time, as one column each. */
+
+static int character(const char *s, const int n, int *w) {
+    wchar_t wc;
+    mbstate_t state;
+    size_t len;
+    memset(&state, 0, sizeof(state));
+    len = mbrtowc(&wc, s, n, &state);
+    if (len == (size_t)-1 || len == (size_t)-2 || len == 0) {
+        *w = 1;
+        return 1;
+    }
+    *w = wcwidth(wc);
+    if (*w < 0) {
+        *w = 1;
+    }
+    return (int)len;
+}
+
+/* Returns how many of the first n bytes of s fit in w columns, always taking
+ * at least one character so that callers make progress. */
+
+static int fit(const char *s, const int n, const int w) {
+    int b, used, cw, len;
+    b = used = 0;
+    while (b < n) {
+        len = character(s + b, n - b, &cw);
+        if (used + cw > w && b > 0) {
+            break;
+        }
+        used += cw;
+        b += len;
+    }
+    return b;
+}
+
+static int width(const char *s, const int n) {
+    int b, used, cw;
+    b = used = 0;
+    while (b < n) {
+        b += character(s + b, n - b, &cw);
+        used += cw;
+    }
+    return used;
+}
+
+/* Returns the length of a line being typed, less any character at its end
+ * that is still waiting for the rest of its bytes. */
+
+static int complete(const char *buffer, const int n) {
+    int start, need;
+    unsigned char c;
+    for (start = n ; start > 0 && start > n - 4 ; start--) {
+        c = buffer[start - 1];
+        if ((c & 0xC0) != 0x80) {
+            break;
+        }
+    }
+    if (start == 0) {
+        return n;
+    }
+    c = buffer[start - 1];
+    need = c >= 0xF0 ? 4 : c >= 0xE0 ? 3 : c >= 0xC0 ? 2 : 1;
+    return n - (start - 1) < need ? start - 1 : n;
+}
+
+/* (Re)creates the panes to fit the terminal, which is also how resizing is
+ * handled. The message pane takes whatever the roster leaves. */
+
+static void layout(Screen *s) {
+    int rosterWidth = COLS >= ROSTER_WIDTH + MESSAGES_MIN ? ROSTER_WIDTH : 0;
+    int height = LINES > 2 ? LINES - 2 : 1;
+    if (s->messages != NULL) {
+        delwin(s->messages);
+        delwin(s->status);
+        delwin(s->input);
+    }
+    if (s->roster != NULL) {
+        delwin(s->roster);
+        s->roster = NULL;
+    }
+    s->messages = newwin(height, COLS - rosterWidth, 0, 0);
+    if (rosterWidth > 0) {
+        s->roster = newwin(height, rosterWidth, 0, COLS - rosterWidth);
+    }
+    s->status = newwin(1, COLS, LINES - 2, 0);
+    s->input = newwin(1, COLS, LINES - 1, 0);
+    wattron(s->status, A_REVERSE);
+    keypad(s->input, TRUE);
+}
+
+/* Fills the message pane from the bottom up, starting Screen.scroll lines
+ * back from the newest. Long lines are wrapped. A view is drawn from the top
+ * down instead, and is cut off rather than wrapped. */
+
+static void drawMessages(Screen *s) {
+    int h, w, y, i, k, rows, r, n, b;
+    const char *line, *rest;
+    getmaxyx(s->messages, h, w);
+    werase(s->messages);
+    if (s->view) {
+        for (i = 0 ; i < s->viewCount && i < h ; i++) {
+            line = s->viewLines[i];
+            mvwaddnstr(s->messages, i, 0, line, fit(line, strlen(line), w));
+        }
+        wnoutrefresh(s->messages);
+        return;
+    }
+    y = h;
+    for (i = s->scroll ; i < s->count && y > 0 ; i++) {
+        k = (s->head - 1 - i + SCROLLBACK) % SCROLLBACK;
+        line = s->lines[k];
+        wattrset(s->messages, s->attrs[k]);
+        rows = 0;
+        rest = line;
+        n = strlen(line);
+        do {
+            b = fit(rest, n, w);
+            rest += b;
+            n -= b;
+            rows++;
+        } while (n > 0);
+        y -= rows;
+        rest = line;
+        n = strlen(line);
+        for (r = 0 ; r < rows ; r++) {
+            b = fit(rest, n, w);
+            if (y + r >= 0) {
+                mvwaddnstr(s->messages, y + r, 0, rest, b);
+            }
+            rest += b;
+            n -= b;
+        }
+    }
+    wattrset(s->messages, A_NORMAL);
+    wnoutrefresh(s->messages);
+}
+
+static void drawRosterPane(Screen *s) {
+    int h, w, i;
+    const char *line;
+    if (s->roster == NULL) {
+        return;
+    }
+    getmaxyx(s->roster, h, w);
+    werase(s->roster);
+    mvwvline(s->roster, 0, 0, ACS_VLINE, h);
+    for (i = 0 ; i < s->rosterCount && i < h ; i++) {
+        line = s->rosterLines[i];
+        mvwaddnstr(s->roster, i, 2, line, fit(line, strlen(line), w - 2));
+    }
+    wnoutrefresh(s->roster);
+}
+
+/* The status bar notes when the message pane is scrolled back, since new
+ * messages won't be seen until it is scrolled down again. */
+
+static void drawStatusPane(Screen *s) {
+    werase(s->status);
+    mvwhline(s->status, 0, 0, ' ', COLS);
+    if (s->statusLine != NULL) {
+        mvwaddnstr(s->status, 0, 1, s->statusLine,
+                   fit(s->statusLine, strlen(s->statusLine), COLS - 1));
+    }
+    if (s->scroll > 0 && COLS > 12) {
+        mvwaddstr(s->status, 0, COLS - 12, "[scrolled]");
+    }
+    wnoutrefresh(s->status);
+}
+
+/* Shows the line being typed, keeping its end in view. */
+
+static void drawInput(Screen *s, const char *buffer, int n) {
+    int w = getmaxx(s->input) - 3;
+    int start, cw;
+    n = complete(buffer, n);
+    start = 0;
+    while (start < n && width(buffer + start, n - start) > w) {
+        start += character(buffer + start, n - start, &cw);
+    }
+    werase(s->input);
+    mvwaddstr(s->input, 0, 0, "> ");
+    waddnstr(s->input, buffer + start, n - start);
+    wnoutrefresh(s->input);
+}
+
+static void redraw(Screen *s) {
+    clearok(curscr, TRUE);
+    drawMessages(s);
+    drawRosterPane(s);
+    drawStatusPane(s);
+    drawInput(s, "", 0);
+    doupdate();
+}
+
 void initScreen(Screen *s, unsigned int *audioOn) {
+    int i;
+    setlocale(LC_ALL, "");
     initscr();
     noecho();
     raw();
     mousemask(BUTTON1_PRESSED | BUTTON1_RELEASED, NULL);
     mouseinterval(0);
-    keypad(stdscr, TRUE);
-    scrollok(stdscr, TRUE);
     s->audioOn = audioOn;
+    s->messages = s->roster = s->status = s->input = NULL;
+    for (i = 0 ; i < SCROLLBACK ; i++) {
+        s->lines[i] = NULL;
+        s->attrs[i] = A_NORMAL;
+    }
+    s->head = s->count = s->scroll = 0;
+    for (i = 0 ; i < ROSTER_MAX ; i++) {
+        s->rosterLines[i] = NULL;
+    }
+    s->rosterCount = 0;
+    s->statusLine = NULL;
+    for (i = 0 ; i < VIEW_MAX ; i++) {
+        s->viewLines[i] = NULL;
+    }
+    s->viewCount = s->view = 0;
+    pthread_mutex_init(&s->lock, NULL);
+    screen = s;
+    layout(s);
+    redraw(s);
+}
+
+/* Go's runtime claims SIGWINCH before curses gets the chance, so resizes are
+ * passed along from Go instead. */
+
+void resizeScreen(void) {
+    struct winsize w;
+    if (ioctl(STDOUT_FILENO, TIOCGWINSZ, &w) < 0) {
+        return;
+    }
+    pthread_mutex_lock(&screen->lock);
+    resizeterm(w.ws_row, w.ws_col);
+    layout(screen);
+    redraw(screen);
+    pthread_mutex_unlock(&screen->lock);
 }
 
-/* Screen.ch will be checked fully in Go. The purpose of this function is to
- * short circuit the on/off process */
+/* Waits up to ms milliseconds for a key, or forever if ms is negative, and
+ * returns ERR if none came. The screen is only locked for INPUT_POLL at a
+ * time, so that Go can print while the user is idle. Resizing and scrolling
+ * are dealt with here, so callers never see them. */
 
-void getInput(Screen *s) {
-    s->ch = getch();
+static int readKey(Screen *s, int ms) {
+    int ch;
+    bool handled;
+    for (;;) {
+        pthread_mutex_lock(&s->lock);
+        wtimeout(s->input, INPUT_POLL);
+        ch = wgetch(s->input);
+        handled = true;
+        switch (ch) {
+        case KEY_RESIZE:
+            layout(s);
+            redraw(s);
+            break;
+        case KEY_PPAGE:
+        case KEY_NPAGE:
+            s->scroll += (ch == KEY_PPAGE ? 1 : -1) *
+                         (getmaxy(s->messages) - 1);
+            if (s->scroll > s->count - 1) {
+                s->scroll = s->count - 1;
+            }
+            if (s->scroll < 0) {
+                s->scroll = 0;
+            }
+            drawMessages(s);
+            drawStatusPane(s);
+            doupdate();
+            break;
+        case KEY_MOUSE:
+            handled = getmouse(&s->event) != OK;
+            break;
+        default:
+            handled = ch == ERR;
+        }
+        pthread_mutex_unlock(&s->lock);
+        if (!handled) {
+            return ch;
+        } else if (ch == ERR && ms >= 0) {
+            ms -= INPUT_POLL;
+            if (ms <= 0) {
+                return ERR;
+            }
+        }
+    }
+}
+
+/* Turns a mouse event already fetched by readKey() into 'o' or 'p'. Screen.ch
+ * will be checked fully in Go. The purpose of this function is to short
+ * circuit the on/off process */
+
+void readMouse(Screen *s) {
     if (s->ch == KEY_MOUSE) {
-        if (getmouse(&s->event) == OK) {
-            if (s->event.bstate & BUTTON1_PRESSED) {
-                s->ch = 111; /* the 'o' (on) key */
+        if (s->event.bstate & BUTTON1_PRESSED) {
+            s->ch = 111; /* the 'o' (on) key */
+            if (s->audioOn != NULL) {
                 *s->audioOn = 1;
-            } else {
-                s->ch = 112; /* the 'p' (pff?) key */
+            }
+        } else {
+            s->ch = 112; /* the 'p' (pff?) key */
+            if (s->audioOn != NULL) {
                 *s->audioOn = 0;
             }
         }
     }
 }
 
+/* Adds a line to the message pane. If the pane is scrolled back, it stays put
+ * on the lines being read. */
+
+static void addLine(const char *s, attr_t attr) {
+    Screen *sc = screen;
+    pthread_mutex_lock(&sc->lock);
+    free(sc->lines[sc->head]);
+    sc->lines[sc->head] = strdup(s);
+    sc->attrs[sc->head] = attr;
+    sc->head = (sc->head + 1) % SCROLLBACK;
+    if (sc->count < SCROLLBACK) {
+        sc->count++;
+    }
+    if (sc->scroll > 0 && sc->scroll < sc->count - 1) {
+        sc->scroll++;
+    }
+    drawMessages(sc);
+    wnoutrefresh(sc->input);
+    doupdate();
+    pthread_mutex_unlock(&sc->lock);
+}
+
 void cursesPrintln(const char *s) {
-    printw("%s\n", s);
-    refresh();
+    addLine(s, A_NORMAL);
 }
 
-/* Grabs typed in user values and returns an actual number. Used to set hz and
- * volume */
+/* Text chat is set in bold, apart from decoded Morse and notices. */
 
-double getText() {
-    echo();
-    char buffer[STR_MAX] = { 0 };
-    double d;
+void cursesPrintChat(const char *s) {
+    addLine(s, A_BOLD);
+}
+
+/* The roster is set a line at a time, then drawn with the number of lines it
+ * now has. */
+
+void setRoster(const int i, const char *s) {
+    if (i < 0 || i >= ROSTER_MAX) {
+        return;
+    }
+    pthread_mutex_lock(&screen->lock);
+    free(screen->rosterLines[i]);
+    screen->rosterLines[i] = strdup(s);
+    pthread_mutex_unlock(&screen->lock);
+}
+
+void drawRoster(const int n) {
+    pthread_mutex_lock(&screen->lock);
+    screen->rosterCount = n < ROSTER_MAX ? n : ROSTER_MAX;
+    drawRosterPane(screen);
+    wnoutrefresh(screen->input);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+}
+
+void drawStatus(const char *s) {
+    pthread_mutex_lock(&screen->lock);
+    free(screen->statusLine);
+    screen->statusLine = strdup(s);
+    drawStatusPane(screen);
+    wnoutrefresh(screen->input);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+}
+
+/* Views are set and drawn like the roster. Switching back to messages shows
+ * whatever was printed in the meantime. */
+
+void showView(const int view) {
+    pthread_mutex_lock(&screen->lock);
+    screen->view = view;
+    screen->viewCount = 0;
+    drawMessages(screen);
+    wnoutrefresh(screen->input);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+}
+
+void setView(const int i, const char *s) {
+    if (i < 0 || i >= VIEW_MAX) {
+        return;
+    }
+    pthread_mutex_lock(&screen->lock);
+    free(screen->viewLines[i]);
+    screen->viewLines[i] = strdup(s);
+    pthread_mutex_unlock(&screen->lock);
+}
+
+void drawView(const int n) {
+    pthread_mutex_lock(&screen->lock);
+    screen->viewCount = n < VIEW_MAX ? n : VIEW_MAX;
+    drawMessages(screen);
+    wnoutrefresh(screen->input);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+}
+
+int viewWidth(void) {
+    int n;
+    pthread_mutex_lock(&screen->lock);
+    n = getmaxx(screen->messages);
+    pthread_mutex_unlock(&screen->lock);
+    return n;
+}
+
+int viewHeight(void) {
+    int n;
+    pthread_mutex_lock(&screen->lock);
+    n = getmaxy(screen->messages);
+    pthread_mutex_unlock(&screen->lock);
+    return n;
+}
+
+/* Adds a key to a line being typed, handling backspace. Characters outside
+ * ASCII arrive from curses a byte at a time, and backspace takes them away a
+ * whole character at a time. Returns false for keys that don't belong in a
+ * line. */
+
+static bool typeKey(char *buffer, const int n, int *i, const int ch) {
+    if (ch == KEY_BACKSPACE || ch == 127 || ch == 8) {
+        while (*i > 0 && (buffer[*i - 1] & 0xC0) == 0x80) {
+            (*i)--;
+        }
+        if (*i > 0) {
+            (*i)--;
+        }
+    } else if ((ch >= ' ' && ch <= '~') || (ch >= 0x80 && ch <= 0xFF)) {
+        if (*i < n - 1) {
+            buffer[(*i)++] = ch;
+        }
+    } else {
+        return false;
+    }
+    pthread_mutex_lock(&screen->lock);
+    drawInput(screen, buffer, *i);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+    return true;
+}
+
+/* Replaces the line being typed, for completion and history. */
+
+void setInput(char *buffer, const int n, int *i, const char *text) {
+    strncpy(buffer, text, n - 1);
+    buffer[n - 1] = '\0';
+    *i = complete(buffer, strlen(buffer));
+    buffer[*i] = '\0';
+    pthread_mutex_lock(&screen->lock);
+    drawInput(screen, buffer, *i);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+}
+
+void clearInput(void) {
+    pthread_mutex_lock(&screen->lock);
+    drawInput(screen, "", 0);
+    doupdate();
+    pthread_mutex_unlock(&screen->lock);
+}
+
+/* Grabs a typed in line of text, such as copy during practice. It is typed
+ * on the input line, and echoed to the message pane once entered. Mouse
+ * events and other special keys are swallowed. The buffer is always
+ * terminated. */
+
+void getLine(char *buffer, const int n) {
     int i, ch;
-    i = ch = 0;
-    while (i < STR_MAX - 1 && ch != '\n') {
-        ch = getch();
-        buffer[i++] = ch;
+    i = 0;
+    clearInput();
+    while ((ch = readKey(screen, -1)) != '\n') {
+        typeKey(buffer, n, &i, ch);
     }
-    noecho();
-    sscanf(buffer, "%lf", &d);
-    if (i == STR_MAX - 1) {
-        printw("\n");
-        refresh();
+    i = complete(buffer, i);
+    buffer[i] = '\0';
+    clearInput();
+    cursesPrintln(buffer);
+}
+
+/* Like getLine(), but for when the user may either type or key. The line is
+ * built up in the buffer across calls, with *i holding its length. Returns
+ * RESPONSE_LINE once enter is pressed, RESPONSE_KEY on a mouse event (with
+ * Screen.ch set as in readMouse()), RESPONSE_TAB, RESPONSE_UP or RESPONSE_DOWN
+ * for those keys, RESPONSE_FUNCTION for F1 to F12 (with Screen.ch set to the
+ * key's number), or RESPONSE_NONE if nothing happened in RESPONSE_POLL
+ * milliseconds, so that the caller can keep time. */
+
+int getResponse(Screen *s, char *buffer, const int n, int *i) {
+    int ch, r;
+    r = RESPONSE_NONE;
+    while (r == RESPONSE_NONE) {
+        ch = readKey(s, RESPONSE_POLL);
+        if (ch == ERR) {
+            break;
+        } else if (ch == KEY_MOUSE) {
+            s->ch = ch;
+            readMouse(s);
+            r = RESPONSE_KEY;
+        } else if (ch == '\n') {
+            r = RESPONSE_LINE;
+        } else if (ch == '\t') {
+            r = RESPONSE_TAB;
+        } else if (ch == KEY_UP) {
+            r = RESPONSE_UP;
+        } else if (ch == KEY_DOWN) {
+            r = RESPONSE_DOWN;
+        } else if (ch >= KEY_F(1) && ch <= KEY_F(12)) {
+            s->ch = ch - KEY_F0;
+            r = RESPONSE_FUNCTION;
+        } else {
+            typeKey(buffer, n, i, ch);
+        }
+    }
+    if (r == RESPONSE_LINE) {
+        *i = complete(buffer, *i);
+    }
+    buffer[*i] = '\0';
+    if (r == RESPONSE_LINE) {
+        clearInput();
+        cursesPrintln(buffer);
     }
-    return d;
+    return r;
 }
@@ -1,27 +1,101 @@
 #include <curses.h>
+#include <locale.h>
+#include <pthread.h>
 #include <stdbool.h>
 #include <stdio.h>
 #include <stdlib.h>
+#include <string.h>
+#include <sys/ioctl.h>
+#include <unistd.h>
+#include <wchar.h>
 
 /* The client uses a primitive curses interface, mainly to retrieve mouse/key
- * events and send Msgs from them. */
+ * events and send Msgs from them. The screen is split into panes: messages
+ * on the left, a roster of users on the right, and a status bar above a
+ * single input line at the bottom. All text is UTF-8, which needs the wide
+ * character version of curses (ncursesw) to be drawn properly. Lengths are
+ * kept in bytes, but lines are laid out by the columns each character takes
+ * up on the terminal. */
 
-#define STR_MAX 16
+#define TEXT_MAX 256
+
+/* Pane sizes. The roster is dropped on terminals too narrow to fit it next to
+ * a reasonable message pane. */
+
+#define ROSTER_WIDTH 24
+#define ROSTER_MAX 256
+#define MESSAGES_MIN 40
+#define SCROLLBACK 1000
+#define VIEW_MAX 256
+
+/* How often, in milliseconds, the input loop lets go of the screen so that
+ * other threads may draw to it */
+
+#define INPUT_POLL 20
+
+/* Results of getResponse() */
+
+#define RESPONSE_LINE 0
+#define RESPONSE_KEY 1
+#define RESPONSE_NONE 2
+#define RESPONSE_TAB 3
+#define RESPONSE_UP 4
+#define RESPONSE_DOWN 5
+#define RESPONSE_FUNCTION 6
+#define RESPONSE_POLL 100
 
 /* The Screen type contains a pointer for mouse events, as well as a pointer
  * directly to the client's AudioInstance.on value, so that sound may be
  * rendered ASAP. All other (non time sensitive) events are routed through
- * Msgs to the server */
+ * Msgs to the server. Spectators have no AudioInstance, in which case the
+ * pointer is NULL. The Screen also keeps its own copy of everything drawn to
+ * the panes, so that they can be redrawn when the terminal is resized.
+ * Message lines are a ring buffer, each drawn with its own attributes, and
+ * scroll is how many lines back from the newest the message pane is showing.
+ * When view is set, the message pane shows the view's lines instead, which are
+ * drawn by Go. */
 
 typedef struct Screen {
     int ch;
     unsigned int *audioOn;
     MEVENT event;
+    WINDOW *messages;
+    WINDOW *roster;
+    WINDOW *status;
+    WINDOW *input;
+    char *lines[SCROLLBACK];
+    attr_t attrs[SCROLLBACK];
+    int head;
+    int count;
+    int scroll;
+    char *rosterLines[ROSTER_MAX];
+    int rosterCount;
+    char *statusLine;
+    char *viewLines[VIEW_MAX];
+    int viewCount;
+    int view;
+    pthread_mutex_t lock;
 } Screen;
 
-void initScreen(Screen *, unsigned int *);
-void getInput(Screen *);
-void cursesPrintln(const char *);
-double getText(void);
+/* Not every libc declares wcwidth() unless _XOPEN_SOURCE is defined, which
+ * hides other things in turn. */
 
+int wcwidth(wchar_t);
 
+void initScreen(Screen *, unsigned int *);
+void resizeScreen(void);
+void readMouse(Screen *);
+void cursesPrintln(const char *);
+void cursesPrintChat(const char *);
+void setRoster(const int, const char *);
+void drawRoster(const int);
+void drawStatus(const char *);
+void showView(const int);
+void setView(const int, const char *);
+void drawView(const int);
+int viewWidth(void);
+int viewHeight(void);
+void clearInput(void);
+void setInput(char *, const int, int *, const char *);
+void getLine(char *, const int);
+int getResponse(Screen *, char *, const int, int *);
@@ -0,0 +1,23 @@
+package main
+
+// Anything the client keeps between sessions lives in ~/.morse-client.
+
+import (
+    "os"
+    "path/filepath"
+)
+
+// stateFile() returns the path of a file in the client's directory, creating
+// the directory if need be.
+
+func stateFile(name string) (string, error) {
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return "", err
+    }
+    dir := filepath.Join(home, ".morse-client")
+    if err := os.MkdirAll(dir, 0755); err != nil {
+        return "", err
+    }
+    return filepath.Join(dir, name), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+// Feedback on the user's own sending. Every on/off event the user makes is
+// recorded, and once they have been quiet for OVER_GAP the over is measured
+// against ideal timing and summarized in the UI.
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "time"
+)
+
+// The Fist type records the user's keying. Last holds the previous over so
+// that it may be drawn as a histogram on request.
+
+type Fist struct {
+    Recorder Recorder
+    Last Keying
+}
+
+// Fist.Over() ends the current over if the user has been quiet long enough,
+// returning its summary. Nothing is returned otherwise.
+
+func (f *Fist) Over(t time.Time) []string {
+    if f.Recorder.Idle(t) < OVER_GAP {
+        return nil
+    }
+    f.Last = f.Recorder.Take()
+    return f.Last.Summary()
+}
+
+func mean(ds []time.Duration) time.Duration {
+    if len(ds) == 0 {
+        return 0
+    }
+    var sum time.Duration
+    for _, d := range ds {
+        sum += d
+    }
+    return sum / time.Duration(len(ds))
+}
+
+// Keying.Summary() compares an over with the ideal proportions of 1:3 for
+// dits to dahs, and 1, 3 and 7 dits of space between elements, characters and
+// words. Each character's evenness is the deviation of its elements and
+// spaces from their ideal lengths, and the least even ones are listed.
+
+func (k *Keying) Summary() []string {
+    var dits, dahs []time.Duration
+    var gaps [8][]time.Duration
+    unit := k.Unit()
+    if unit == 0 {
+        return nil
+    }
+    for i, _ := range k.Marks {
+        if k.Dah(i, unit) {
+            dahs = append(dahs, k.Marks[i])
+        } else {
+            dits = append(dits, k.Marks[i])
+        }
+    }
+    for i, _ := range k.Spaces {
+        g := k.Gap(i, unit)
+        gaps[g] = append(gaps[g], k.Spaces[i])
+    }
+    lines := []string{fmt.Sprintf("Over: %d elements at about %.1f wpm",
+                                  len(k.Marks), 1.2 / unit.Seconds())}
+    lines = append(lines, "Copy: " + k.Decode())
+    if len(dits) > 0 && len(dahs) > 0 {
+        lines = append(lines, fmt.Sprintf("Dah/dit ratio: %.2f (ideal 3)",
+                       float64(mean(dahs)) / float64(mean(dits))))
+    }
+    names := map[int]string{1: "Element", 3: "Character", 7: "Word"}
+    for _, g := range []int{1, 3, 7} {
+        if len(gaps[g]) > 0 {
+            lines = append(lines, fmt.Sprintf(
+                           "%s spacing: %.2f dits (ideal %d)", names[g],
+                           float64(mean(gaps[g])) / float64(unit), g))
+        }
+    }
+    if uneven := k.Unevenness(unit); uneven != "" {
+        lines = append(lines, "Least even: " + uneven)
+    }
+    return lines
+}
+
+// Keying.Unevenness() returns the three characters whose timing strayed the
+// most, as the mean relative deviation of their parts from ideal.
+
+func (k *Keying) Unevenness(unit time.Duration) string {
+    starts, codes := k.Characters(unit)
+    total := make(map[rune]float64)
+    count := make(map[rune]int)
+    for i, code := range codes {
+        ch, ok := CODES[code]
+        if !ok {
+            continue
+        }
+        ratios := []float64{}
+        for j, el := range code {
+            n := starts[i] + j
+            ideal := unit
+            if el == '-' {
+                ideal = 3 * unit
+            }
+            ratios = append(ratios, float64(k.Marks[n]) / float64(ideal))
+            if j > 0 {
+                ratios = append(ratios, float64(k.Spaces[n-1]) / float64(unit))
+            }
+        }
+        dev := 0.0
+        for _, r := range ratios {
+            dev += math.Abs(r - 1.0)
+        }
+        total[ch] += dev / float64(len(ratios))
+        count[ch]++
+    }
+    chars := []rune{}
+    for ch, _ := range total {
+        total[ch] /= float64(count[ch])
+        chars = append(chars, ch)
+    }
+    sort.Slice(chars, func(i, j int) bool {
+        return total[chars[i]] > total[chars[j]]
+    })
+    out := []string{}
+    for i := 0; i < len(chars) && i < 3; i++ {
+        out = append(out, fmt.Sprintf("%c ±%.0f%%", chars[i],
+                                      total[chars[i]] * 100.0))
+    }
+    return strings.Join(out, ", ")
+}
+
+// Keying.Histogram() draws marks and spaces side by side, bucketed by half a
+// dit. The last bucket holds everything longer.
+
+func (k *Keying) Histogram() []string {
+    const buckets = 16
+    const width = 24
+    var marks, spaces [buckets]int
+    unit := k.Unit()
+    if unit == 0 {
+        return []string{"Nothing keyed yet."}
+    }
+    bucket := func(d time.Duration) int {
+        return min(int(float64(d) / float64(unit) * 2.0), buckets - 1)
+    }
+    for _, m := range k.Marks {
+        marks[bucket(m)]++
+    }
+    for _, s := range k.Spaces {
+        spaces[bucket(s)]++
+    }
+    most := 1
+    for i := 0; i < buckets; i++ {
+        most = max(most, marks[i], spaces[i])
+    }
+    bar := func(n int) string {
+        return strings.Repeat("#", (n * width + most - 1) / most)
+    }
+    lines := []string{fmt.Sprintf("dits  %-*s  %s", width, "marks", "spaces")}
+    for i := 0; i < buckets; i++ {
+        label := fmt.Sprintf("%4.1f", float64(i) / 2.0)
+        if i == buckets - 1 {
+            label += "+"
+        } else {
+            label += " "
+        }
+        lines = append(lines, fmt.Sprintf("%s %-*s  %s", label, width,
+                                          bar(marks[i]), bar(spaces[i])))
+    }
+    return lines
+}
@@ -0,0 +1,111 @@
+package main
+
+// The client's own sending machinery, which turns text into morse on one of
+// the local AudioInstances.
+
+/*
+#include "audio-output.h"
+*/
+import "C"
+
+import (
+    "strings"
+    "sync/atomic"
+    "time"
+)
+
+// The Keyer owns the local AudioInstances, which sit after the Users' own
+// instances in the C Out struct. Nothing played on them leaves the client.
+// Each instance is called a slot. A slot's generation is bumped whenever it
+// is stopped, which tells any Keyer.Send() still playing on it to give up.
+
+type Keyer struct {
+    Instances []*C.AudioInstance
+    Generations []int32
+}
+
+func NewKeyer(o *C.Out, first int, n int) *Keyer {
+    k := Keyer{make([]*C.AudioInstance, n), make([]int32, n)}
+    for i, _ := range k.Instances {
+        k.Instances[i] = C.getInstance(o, C.uint(first + i))
+    }
+    return &k
+}
+
+func (k *Keyer) Stop(slot int) {
+    atomic.AddInt32(&k.Generations[slot], 1)
+    k.Instances[slot].on = 0
+}
+
+// Keyer.Level() sets how loud a slot is in the mix, from 0.0 to 1.0.
+
+func (k *Keyer) Level(slot int, level float64) {
+    k.Instances[slot].level = C.double(level)
+}
+
+// Keyer.Dry() keeps band conditions off a slot, such as one playing the
+// user's own sending.
+
+func (k *Keyer) Dry(slot int, dry bool) {
+    k.Instances[slot].dry = 0
+    if dry {
+        k.Instances[slot].dry = 1
+    }
+}
+
+// Keyer.Send() plays text on a slot at the given pitch and speeds, and
+// returns once it is done. It returns false if the slot was stopped before
+// then.
+
+func (k *Keyer) Send(slot int, text string, hz float64, wpm float64,
+                     fwpm float64) bool {
+    ai := k.Instances[slot]
+    gen := atomic.LoadInt32(&k.Generations[slot])
+    live := func() bool {
+        return atomic.LoadInt32(&k.Generations[slot]) == gen
+    }
+    ai.newPitch = C.double(hz)
+    return sendMorse(text, NewTiming(wpm, fwpm), func(on bool) {
+        ai.on = 0
+        if on {
+            ai.on = 1
+        }
+    }, live)
+}
+
+// sendMorse() keys text at the given timing, calling key at every change.
+// It gives up as soon as live returns false, and otherwise returns true once
+// done. Characters with no morse equivalent are skipped.
+
+func sendMorse(text string, t Timing, key func(bool), live func() bool) bool {
+    for i, word := range strings.Fields(strings.ToUpper(text)) {
+        if i > 0 {
+            time.Sleep(t.Word)
+        }
+        for j, ch := range word {
+            code, ok := MORSE[ch]
+            if !ok {
+                continue
+            }
+            if j > 0 {
+                time.Sleep(t.Char)
+            }
+            for e, el := range code {
+                if e > 0 {
+                    time.Sleep(t.Element)
+                }
+                if !live() {
+                    return false
+                }
+                key(true)
+                if el == '.' {
+                    time.Sleep(t.Dit)
+                } else {
+                    time.Sleep(t.Dah)
+                }
+                key(false)
+            }
+        }
+    }
+    return live()
+}
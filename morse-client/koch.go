@@ -0,0 +1,147 @@
+package main
+
+// Koch method practice. Characters are learned at full speed, starting with
+// two of them, and a new one is added once copy of the current set reaches
+// KOCH_PASS accuracy. Each user's lesson is remembered between sessions.
+
+/*
+#include "curses-ui.h"
+*/
+import "C"
+
+import (
+    "bufio"
+    "fmt"
+    "math/rand"
+    "os"
+    "strconv"
+    "strings"
+)
+
+// The order in which characters are introduced, as popularized by LCWO.
+
+const KOCH_ORDER = "KMURESNAPTLWI.JZ=FOY,VG5/Q92H38B?47C1D60X"
+
+// UI.Koch() runs a single practice session. Random groups drawn from the
+// current lesson's characters are played on the first local slot while the
+// user types what they hear. The session is scored once enter is pressed,
+// which also cuts short any playback still going.
+
+func (ui *UI) Koch() {
+    lesson := loadLesson(ui.Name)
+    chars := KOCH_ORDER[:lesson]
+    printLine(fmt.Sprintf("Koch lesson %d: %s", lesson - 1, chars))
+    printLine("Type what you hear, then press enter.")
+    sent := kochGroups(chars)
+    go ui.Keyer.Send(0, sent, PRACTICE_HZ, WPM, FARNSWORTH_WPM)
+    copied := readLine()
+    ui.Keyer.Stop(0)
+    score := accuracy(sent, copied)
+    printLine("Sent:   " + sent)
+    printLine("Copied: " + strings.ToUpper(copied))
+    printLine(fmt.Sprintf("Accuracy: %.0f%%", score * 100.0))
+    if score < KOCH_PASS || lesson >= len(KOCH_ORDER) {
+        return
+    }
+    lesson++
+    printLine(fmt.Sprintf("On to lesson %d, which adds %c.", lesson - 1,
+                          KOCH_ORDER[lesson - 1]))
+    if err := saveLesson(ui.Name, lesson); err != nil {
+        printLine("Could not save progress: " + err.Error())
+    }
+}
+
+func kochGroups(chars string) string {
+    groups := make([]string, KOCH_GROUPS)
+    for i, _ := range groups {
+        g := make([]byte, KOCH_GROUP_LEN)
+        for j, _ := range g {
+            g[j] = chars[rand.Intn(len(chars))]
+        }
+        groups[i] = string(g)
+    }
+    return strings.Join(groups, " ")
+}
+
+// accuracy() scores copy against what was sent by edit distance, so that a
+// dropped or doubled character only costs one mistake rather than throwing
+// off the rest of the line.
+
+func accuracy(sent string, copied string) float64 {
+    a := []rune(strings.Join(strings.Fields(strings.ToUpper(sent)), " "))
+    b := []rune(strings.Join(strings.Fields(strings.ToUpper(copied)), " "))
+    if len(a) == 0 {
+        return 1.0
+    }
+    prev := make([]int, len(b) + 1)
+    cur := make([]int, len(b) + 1)
+    for j, _ := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(a); i++ {
+        cur[0] = i
+        for j := 1; j <= len(b); j++ {
+            cost := 1
+            if a[i-1] == b[j-1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j] + 1, cur[j-1] + 1, prev[j-1] + cost)
+        }
+        prev, cur = cur, prev
+    }
+    score := 1.0 - float64(prev[len(b)]) / float64(len(a))
+    if score < 0.0 {
+        score = 0.0
+    }
+    return score
+}
+
+// Progress is kept in ~/.morse-client/koch as one "name lesson" pair per line,
+// where the lesson is the number of characters in play. Names may contain
+// spaces, so the lesson is whatever follows the last one.
+
+func parseLesson(line string) (string, int, bool) {
+    i := strings.LastIndexByte(line, ' ')
+    if i < 0 {
+        return "", 0, false
+    }
+    n, err := strconv.Atoi(line[i + 1:])
+    return line[:i], n, err == nil
+}
+
+func loadLesson(name string) int {
+    path, err := stateFile("koch")
+    if err != nil {
+        return 2
+    }
+    f, err := os.Open(path)
+    if err != nil {
+        return 2
+    }
+    defer f.Close()
+    s := bufio.NewScanner(f)
+    for s.Scan() {
+        who, n, ok := parseLesson(s.Text())
+        if ok && who == name && n >= 2 && n <= len(KOCH_ORDER) {
+            return n
+        }
+    }
+    return 2
+}
+
+func saveLesson(name string, lesson int) error {
+    path, err := stateFile("koch")
+    if err != nil {
+        return err
+    }
+    lines := []string{}
+    if b, err := os.ReadFile(path); err == nil {
+        for _, l := range strings.Split(string(b), "\n") {
+            if who, _, ok := parseLesson(l); ok && who != name {
+                lines = append(lines, l)
+            }
+        }
+    }
+    lines = append(lines, name + " " + strconv.Itoa(lesson))
+    return os.WriteFile(path, []byte(strings.Join(lines, "\n") + "\n"), 0644)
+}
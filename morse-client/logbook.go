@@ -0,0 +1,304 @@
+package main
+
+// A logbook of contacts (QSOs) with other stations. An entry is opened the
+// first time a station keys, and closed when they leave or have been quiet
+// for QSO_IDLE. Their keying is copied into the entry as it is decoded.
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+type QSO struct {
+    Call string
+    Start time.Time
+    End time.Time
+    Hz float64
+    Text string
+    Notes string
+}
+
+// The Logbook is shared by Audio, which fills it in, and the UI, which lists
+// and edits it, so every method takes the lock. Open maps a User's key to the
+// index of their current entry, and Heard to when they last keyed. Entries
+// are saved as JSON to ~/.morse-client/logbook whenever one is closed or
+// edited.
+
+type Logbook struct {
+    sync.Mutex
+    Entries []QSO
+    Open map[uint8]int
+    Heard map[uint8]time.Time
+}
+
+func LoadLogbook() (*Logbook, error) {
+    l := Logbook{Open: make(map[uint8]int), Heard: make(map[uint8]time.Time)}
+    path, err := stateFile("logbook")
+    if err != nil {
+        return &l, err
+    }
+    b, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return &l, nil
+    } else if err != nil {
+        return &l, err
+    }
+    return &l, json.Unmarshal(b, &l.Entries)
+}
+
+func (l *Logbook) save() error {
+    path, err := stateFile("logbook")
+    if err != nil {
+        return err
+    }
+    b, err := json.MarshalIndent(l.Entries, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(path, b, 0644)
+}
+
+// Logbook.Key() notes that a station keyed, opening an entry for them if
+// there isn't one already.
+
+func (l *Logbook) Key(key uint8, call string, hz float64, t time.Time) {
+    l.Lock()
+    defer l.Unlock()
+    l.Heard[key] = t
+    if _, ok := l.Open[key]; ok {
+        return
+    }
+    l.Entries = append(l.Entries, QSO{Call: call, Start: t, Hz: hz})
+    l.Open[key] = len(l.Entries) - 1
+}
+
+// Logbook.Copy() adds decoded text to a station's open entry.
+
+func (l *Logbook) Copy(key uint8, text string) {
+    l.Lock()
+    defer l.Unlock()
+    i, ok := l.Open[key]
+    if !ok || text == "" {
+        return
+    }
+    q := &l.Entries[i]
+    if q.Text != "" {
+        q.Text += " "
+    }
+    q.Text += text
+}
+
+// Logbook.Close() ends a station's open entry at the last time they keyed.
+
+func (l *Logbook) Close(key uint8) error {
+    l.Lock()
+    defer l.Unlock()
+    return l.close(key)
+}
+
+func (l *Logbook) close(key uint8) error {
+    i, ok := l.Open[key]
+    if !ok {
+        return nil
+    }
+    l.Entries[i].End = l.Heard[key]
+    delete(l.Open, key)
+    delete(l.Heard, key)
+    return l.save()
+}
+
+// Logbook.Expire() closes entries for stations that have been quiet for
+// QSO_IDLE. Logbook.CloseAll() closes everything, such as when quitting.
+
+func (l *Logbook) Expire(t time.Time) error {
+    l.Lock()
+    defer l.Unlock()
+    var err error
+    for key, heard := range l.Heard {
+        if t.Sub(heard) > QSO_IDLE {
+            err = l.close(key)
+        }
+    }
+    return err
+}
+
+func (l *Logbook) CloseAll() error {
+    l.Lock()
+    defer l.Unlock()
+    var err error
+    for key, _ := range l.Open {
+        err = l.close(key)
+    }
+    return err
+}
+
+// Logbook.List() describes every entry, one per line, numbered from 1.
+
+func (l *Logbook) List() []string {
+    l.Lock()
+    defer l.Unlock()
+    lines := []string{}
+    for i, q := range l.Entries {
+        end := "open"
+        if !q.End.IsZero() {
+            end = q.End.UTC().Format("15:04")
+        }
+        s := fmt.Sprintf("%d. %s %s-%s UTC %.0fHz", i + 1, q.Call,
+                         q.Start.UTC().Format("2006-01-02 15:04"), end, q.Hz)
+        if q.Text != "" {
+            s += " \"" + q.Text + "\""
+        }
+        if q.Notes != "" {
+            s += " (" + q.Notes + ")"
+        }
+        lines = append(lines, s)
+    }
+    return lines
+}
+
+// Logbook.Edit() changes one field of the nth entry, counting from 1.
+
+func (l *Logbook) Edit(n int, field string, value string) error {
+    l.Lock()
+    defer l.Unlock()
+    if n < 1 || n > len(l.Entries) {
+        return fmt.Errorf("There is no entry %d.", n)
+    }
+    q := &l.Entries[n-1]
+    switch strings.ToLower(field) {
+    case "call":
+        q.Call = value
+    case "text":
+        q.Text = value
+    case "notes":
+        q.Notes = value
+    case "hz":
+        hz, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            return err
+        }
+        q.Hz = hz
+    default:
+        return fmt.Errorf("Unknown field %s.", field)
+    }
+    return l.save()
+}
+
+// Logbook.Export() writes every closed entry to path.adi as ADIF and to
+// path.csv.
+
+func (l *Logbook) Export(path string) error {
+    l.Lock()
+    defer l.Unlock()
+    adi, err := os.Create(path + ".adi")
+    if err != nil {
+        return err
+    }
+    defer adi.Close()
+    fmt.Fprint(adi, "morse-client log\n")
+    fmt.Fprint(adi, adifField("ADIF_VER", "3.1.4"))
+    fmt.Fprint(adi, adifField("PROGRAMID", "MORSECHAT"), "<EOH>\n")
+    c, err := os.Create(path + ".csv")
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    w := csv.NewWriter(c)
+    w.Write([]string{"call", "start", "end", "hz", "text", "notes"})
+    for _, q := range l.Entries {
+        if q.End.IsZero() {
+            continue
+        }
+        start, end := q.Start.UTC(), q.End.UTC()
+        hz := strconv.FormatFloat(q.Hz, 'f', -1, 64)
+        fmt.Fprint(adi,
+                   adifField("CALL", q.Call),
+                   adifField("QSO_DATE", start.Format("20060102")),
+                   adifField("TIME_ON", start.Format("150405")),
+                   adifField("QSO_DATE_OFF", end.Format("20060102")),
+                   adifField("TIME_OFF", end.Format("150405")),
+                   adifField("MODE", "CW"),
+                   adifField("APP_MORSECHAT_PITCH", hz),
+                   adifField("COMMENT", q.Text),
+                   adifField("NOTES", q.Notes),
+                   "<EOR>\n")
+        w.Write([]string{q.Call, start.Format(time.RFC3339),
+                         end.Format(time.RFC3339), hz, q.Text, q.Notes})
+    }
+    w.Flush()
+    return w.Error()
+}
+
+// ADIF fields are tagged with their length in bytes. Empty fields are left
+// out altogether.
+
+func adifField(name string, value string) string {
+    if value == "" {
+        return ""
+    }
+    return fmt.Sprintf("<%s:%d>%s ", name, len(value), value)
+}
+
+// UI.EditLog() changes one field of an entry, given as words such as
+// "3 notes good signal". Without any, it lists the logbook and offers to make
+// a change, where pressing enter at any prompt leaves it as it was.
+
+func (ui *UI) EditLog(args []string) {
+    var n int
+    var field, value string
+    var err error
+    if len(args) > 0 {
+        if len(args) < 3 {
+            printLine("Give an entry, a field and a new value, such as " +
+                      "/log 3 notes good signal.")
+            return
+        } else if n, err = strconv.Atoi(args[0]); err != nil {
+            printLine(args[0] + " is not an entry number.")
+            return
+        }
+        field, value = args[1], strings.Join(args[2:], " ")
+    } else {
+        lines := ui.Log.List()
+        if len(lines) == 0 {
+            printLine("The logbook is empty.")
+            return
+        }
+        for _, s := range lines {
+            printLine(s)
+        }
+        printLine("Entry to edit: (enter to skip)")
+        n, err = strconv.Atoi(strings.TrimSpace(readLine()))
+        if err != nil {
+            return
+        }
+        printLine("Field: (call, hz, text or notes)")
+        field = strings.TrimSpace(readLine())
+        if field == "" {
+            return
+        }
+        printLine("New value:")
+        value = readLine()
+    }
+    if err := ui.Log.Edit(n, field, value); err != nil {
+        printLine(err.Error())
+        return
+    }
+    printLine(ui.Log.List()[n-1])
+}
+
+// UI.ExportLog() writes the logbook to the working directory.
+
+func (ui *UI) ExportLog() {
+    if err := ui.Log.Export(LOG_EXPORT); err != nil {
+        printLine("Could not export the logbook: " + err.Error())
+        return
+    }
+    printLine("Logbook written to " + LOG_EXPORT + ".adi and " + LOG_EXPORT +
+              ".csv.")
+}
@@ -1,15 +1,102 @@
 package main
 
 import (
+    "flag"
+    "fmt"
     "log"
-    "os"
+    "strings"
+    "time"
 )
 
+// Settings given as flags override the config file for this session only.
+// Each flag takes a value as the file would, apart from -pan and -bind, which
+// take name=value and key=command so as to read more naturally.
+
+func settingFlag(settings *[][2]string, name string, usage string) {
+    flag.Func(name, usage, func(value string) error {
+        if name == "pan" || name == "bind" {
+            kv := strings.SplitN(value, "=", 2)
+            if len(kv) != 2 {
+                return fmt.Errorf("-%s takes the form %s", name, usage)
+            } else if name == "pan" {
+                value = kv[1] + " " + kv[0]
+            } else {
+                value = kv[0] + " " + kv[1]
+            }
+        }
+        *settings = append(*settings, [2]string{name, value})
+        return nil
+    })
+}
+
 func main() {
-    if len(os.Args[1:]) != 2 {
-        log.Println("usage: morse-client username url:port") 
+    var settings [][2]string
+    spectate := flag.Bool("spectate", false, "listen without keying")
+    offline := flag.Bool("offline", false, "practice without a server")
+    udp := flag.Bool("udp", false, "key over UDP, if the server allows")
+    flag.Float64Var(&UDP_LOSS, "loss", 0.0, "simulated UDP loss, 0.0 to 1.0")
+    flag.DurationVar(&UDP_JITTER, "jitter", 0, "simulated UDP jitter")
+    flag.DurationVar(&UDP_PLAYOUT, "playout", 100 * time.Millisecond,
+                     "how far behind UDP keying is played")
+    config := flag.String("config", "", "settings file, in place of " +
+                          "~/.morse-client/config")
+    settingFlag(&settings, "server", "url:port to connect to")
+    settingFlag(&settings, "name", "username")
+    settingFlag(&settings, "pitch", "pitch in hz")
+    settingFlag(&settings, "volume", "volume, from 0.0 to 1.0")
+    settingFlag(&settings, "wpm", "sending speed")
+    settingFlag(&settings, "fwpm", "overall (Farnsworth) speed of practice")
+    settingFlag(&settings, "skill", "beginner, intermediate or advanced")
+    settingFlag(&settings, "mute", "user to mute, may be repeated")
+    settingFlag(&settings, "pan", "name=pan, from -1.0 (left) to 1.0 " +
+                "(right), may be repeated")
+    settingFlag(&settings, "bind", "key=command, for F1 to F12, may be " +
+                "repeated")
+    flag.Parse()
+    prefs, err := LoadPreferences(*config)
+    if err != nil {
+        log.Println(err)
+        log.Println("Settings will not be saved this session.")
+    }
+    for _, s := range settings {
+        if err := prefs.Config.Set(s[0], s[1]); err != nil {
+            log.Fatal(err)
+        }
+    }
+    cfg := prefs.Get()
+    WPM, FARNSWORTH_WPM = cfg.Wpm, cfg.Fwpm
+    name, url := cfg.Name, cfg.Server
+    if len(flag.Args()) > 0 {
+        name = flag.Arg(0)
+    }
+    if len(flag.Args()) > 1 {
+        url = flag.Arg(1)
+    }
+    if *offline && name != "" && len(flag.Args()) < 2 {
+        a := initOffline(name)
+        a.Prefs = prefs
+        a.ListenToServer()
         return
     }
-    a := initConnection(os.Args[1], os.Args[2])
+    if name == "" || url == "" || len(flag.Args()) > 2 || *offline {
+        log.Println("usage: morse-client [-spectate] [-udp] [-loss n] " +
+                    "[-jitter duration] [-playout duration] [settings] " +
+                    "[username [url:port]]\n" +
+                    "       morse-client -offline [settings] [username]\n" +
+                    "The username and url:port may come from the config " +
+                    "file instead. See -help for settings.") 
+        return
+    }
+    a := initConnection(name, url, *spectate)
+    a.Prefs = prefs
+    a.WantUDP = *udp && !*spectate
+    if prefs.File.Name == "" && prefs.File.Server == "" {
+        // The first server joined becomes the default
+        if err := prefs.Change(func(c *Config) {
+            c.Name, c.Server = name, url
+        }); err != nil {
+            log.Println(err)
+        }
+    }
     a.ListenToServer()
 }
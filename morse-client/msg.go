@@ -6,7 +6,7 @@ package main
 // Msg of a given type transmits all of these at once.
 
 import (
-    "log"
+    "errors"
 )
 
 // Zeros seem to be handled strangely by the gob protocol sometimes, which is
@@ -19,6 +19,18 @@ const (
     MSG_HZ
     MSG_ENTER
     MSG_LEAVE
+    MSG_SPECTATE
+    MSG_FLOOR
+    MSG_FLOOR_REQUEST
+    MSG_MUTE
+    MSG_PING
+    MSG_PITCH
+    MSG_LINK
+    MSG_UDP
+    MSG_WHISPER
+    MSG_TEXT
+    MSG_PRESENCE
+    MSG_HISTORY
     MSG_INTERNAL
     MSG_INTERNAL_VOLUME
     MSG_INTERNAL_NAMES
@@ -27,6 +39,21 @@ const (
     MSG_ERROR_NAME_LEN
     MSG_ERROR_NAME_EXISTS
     MSG_ERROR_USERS_MAX
+    MSG_ERROR_SPECTATORS_MAX
+    MSG_ERROR_NAME_CHARS
+)
+
+// Types that only ever pass between the client's own channels. They are
+// numbered apart from the rest, which must match the server's, so that adding
+// one never shifts the errors the server sends.
+
+const (
+    MSG_INTERNAL_FIST uint8 = iota + 128
+    MSG_INTERNAL_HISTOGRAM
+    MSG_INTERNAL_MUTE
+    MSG_INTERNAL_WPM
+    MSG_INTERNAL_JOIN
+    MSG_INTERNAL_PAN
 )
 
 type Msg struct {
@@ -35,17 +62,25 @@ type Msg struct {
     Key uint8
     Hz float64
     Name string
+    Text string
 }
 
-func errMsgDisplay(err byte) {
+func errMsg(err byte) error {
     switch err {
     case MSG_ERROR_INIT:
-        log.Println("Error initializing server connection.")
+        return errors.New("Error initializing server connection.")
     case MSG_ERROR_NAME_LEN:
-        log.Println("User name is too long or two short.")
+        return errors.New("User name is too long or two short.")
     case MSG_ERROR_NAME_EXISTS:
-        log.Println("User name already taken.")
+        return errors.New("User name already taken.")
     case MSG_ERROR_USERS_MAX:
-        log.Println("Room is full.")
+        return errors.New("Room is full.")
+    case MSG_ERROR_SPECTATORS_MAX:
+        return errors.New("No more room for spectators.")
+    case MSG_ERROR_NAME_CHARS:
+        return errors.New("User name may only contain printable " +
+                          "characters other than @, and may not begin or " +
+                          "end with a space.")
     }
+    return nil
 }
@@ -0,0 +1,116 @@
+package main
+
+// What users publish of themselves: the speed they like to work at, their
+// skill, a status, and whether they are away. The server marks those who do
+// nothing for a while idle. A MSG_PRESENCE carries the state as On, the speed
+// as Hz, the skill as Name and the status as Text, and always carries all of
+// it, so the UI keeps the user's own and sends the lot on every change.
+
+import (
+    "fmt"
+    "strings"
+)
+
+const (
+    PRESENCE_HERE uint8 = iota
+    PRESENCE_AWAY
+    PRESENCE_IDLE
+)
+
+// The skill levels a user may claim, as the server knows them
+
+var SKILLS = []string{"beginner", "intermediate", "advanced"}
+
+type Presence struct {
+    State uint8
+    WPM float64
+    Skill string
+    Status string
+}
+
+func presenceOf(m *Msg) Presence {
+    return Presence{m.On, m.Hz, m.Name, m.Text}
+}
+
+// Presence.Msg() is the MSG_PRESENCE that publishes it.
+
+func (p Presence) Msg() Msg {
+    return Msg{Type: MSG_PRESENCE, On: p.State, Hz: p.WPM, Name: p.Skill,
+               Text: p.Status}
+}
+
+// Presence.String() lists whatever has been published, for /who.
+
+func (p Presence) String() string {
+    var s []string
+    if p.WPM != 0.0 {
+        s = append(s, fmt.Sprintf("%.0f wpm", p.WPM))
+    }
+    if p.Skill != "" {
+        s = append(s, p.Skill)
+    }
+    if away := p.Away(); away != "" {
+        s = append(s, away)
+    }
+    if p.Status != "" {
+        s = append(s, "\"" + p.Status + "\"")
+    }
+    return strings.Join(s, ", ")
+}
+
+// Presence.Away() says "away" or "idle", or nothing if the user is here.
+
+func (p Presence) Away() string {
+    switch p.State {
+    case PRESENCE_AWAY:
+        return "away"
+    case PRESENCE_IDLE:
+        return "idle"
+    }
+    return ""
+}
+
+// UI.publish() applies change, unless it is nil, to the user's own presence
+// and sends the whole of it to the room. Spectators publish nothing. Only
+// the input loop may call it.
+
+func (ui *UI) publish(change func(*Presence)) {
+    if ui.Spectator {
+        return
+    }
+    if change != nil {
+        change(&ui.Presence)
+    }
+    ui.ToAudio <- ui.Presence.Msg()
+}
+
+// UI.tellPresence() prints what has changed in another user's presence that
+// is worth a line: going away or idle, coming back, and a new status.
+
+func (ui *UI) tellPresence(k uint8, was Presence, now Presence) {
+    ui.RosterLock.Lock()
+    name := ui.Roster[k].Name
+    ui.RosterLock.Unlock()
+    if name == "" {
+        return
+    }
+    if now.State != was.State {
+        if away := now.Away(); away != "" {
+            printLine(name + " is " + away + ".")
+        } else {
+            printLine(name + " is back.")
+        }
+    }
+    if now.Status != was.Status && now.Status != "" {
+        printLine(name + "'s status: " + now.Status)
+    }
+}
+
+func validSkill(skill string) bool {
+    for _, s := range SKILLS {
+        if s == skill {
+            return true
+        }
+    }
+    return false
+}
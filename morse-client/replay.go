@@ -0,0 +1,121 @@
+package main
+
+// Catching up on a room. The server keeps a history of what its room heard
+// lately, and /history asks for the last so many minutes of it, as the text
+// chatted and copied by the server, or as the keying itself, which is played
+// back on the local slots. Each sender keeps their own slot and pitch, and
+// silences longer than REPLAY_GAP are cut short, so that a quiet net takes
+// less time to hear than it did to send.
+
+/*
+#include "audio-output.h"
+*/
+import "C"
+
+import (
+    "encoding/json"
+    "fmt"
+    "sync/atomic"
+    "time"
+)
+
+// A Past is one event from the server's history, timed in seconds before it
+// was asked for. It is a key down or up if Text is empty, and otherwise a
+// line that was chatted, or copied from someone's keying.
+
+type Past struct {
+    Ago float64 `json:"ago"`
+    Name string `json:"name"`
+    Hz float64 `json:"hz,omitempty"`
+    On bool `json:"on,omitempty"`
+    Text string `json:"text,omitempty"`
+    Chat bool `json:"chat,omitempty"`
+}
+
+// UI.recall() takes up the server's answer to a MSG_HISTORY, whose On says
+// whether it is keying or text.
+
+func (ui *UI) recall(m *Msg) {
+    if m.Hz == 0.0 {
+        printLine("This room keeps no history.")
+        return
+    }
+    var ps []Past
+    if err := json.Unmarshal([]byte(m.Text), &ps); err != nil {
+        printLine("Could not read the history: " + err.Error())
+        return
+    }
+    switch {
+    case len(ps) == 0 && m.On == 1:
+        printLine("Nobody has keyed lately.")
+    case len(ps) == 0:
+        printLine("Nothing has been said lately.")
+    case m.On == 1:
+        ui.stopReplay()
+        printLine(fmt.Sprintf("Replaying keying from the last %s. /history " +
+                              "stop stops it.", ago(ps[0].Ago)))
+        go ui.Keyer.Replay(ps)
+    default:
+        for _, p := range ps {
+            if p.Chat {
+                printLine(ago(p.Ago) + " ago <" + p.Name + "> " + p.Text)
+            } else {
+                printLine(ago(p.Ago) + " ago " + p.Name + ": " + p.Text)
+            }
+        }
+    }
+}
+
+func (ui *UI) stopReplay() {
+    for i := 0; i < LOCAL_MAX; i++ {
+        ui.Keyer.Stop(i)
+    }
+}
+
+func ago(secs float64) string {
+    return time.Duration(secs * float64(time.Second)).Round(time.Second).
+           String()
+}
+
+// Keyer.Replay() plays keying from the history, giving each sender a slot of
+// their own, in order of their first key down, and sharing them out again
+// once there are more senders than slots. It gives up as soon as a slot it
+// plays on is stopped, and returns false if it did. Anyone still keying when
+// the history was sent is keyed up at the end.
+
+func (k *Keyer) Replay(ps []Past) bool {
+    slots := make(map[string]int)
+    gens := make([]int32, len(k.Instances))
+    for i, _ := range k.Instances {
+        gens[i] = atomic.LoadInt32(&k.Generations[i])
+        k.Level(i, 1.0)
+    }
+    defer func() {
+        for i, ai := range k.Instances {
+            if atomic.LoadInt32(&k.Generations[i]) == gens[i] {
+                ai.on = 0
+            }
+        }
+    }()
+    for i, p := range ps {
+        if i > 0 {
+            gap := time.Duration((ps[i-1].Ago - p.Ago) * float64(time.Second))
+            time.Sleep(min(gap, REPLAY_GAP))
+        }
+        slot, ok := slots[p.Name]
+        if !ok {
+            slot = len(slots) % len(k.Instances)
+            slots[p.Name] = slot
+        }
+        if atomic.LoadInt32(&k.Generations[slot]) != gens[slot] {
+            return false
+        }
+        ai := k.Instances[slot]
+        ai.newPitch = C.double(p.Hz)
+        ai.on = 0
+        if p.On {
+            ai.on = 1
+        }
+    }
+    return true
+}
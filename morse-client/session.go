@@ -6,48 +6,90 @@ package main
 
 import (
     "encoding/gob"
+    "errors"
     "log"
     "net"
 )
 
-func initConnection(name string, url string) Audio {
+// A Session is a connection to a server that has accepted the user.
+
+type Session struct {
+    Server net.Conn
+    Reader *gob.Decoder
+    Writer *gob.Encoder
+    UserKey uint8
+    UsersMax int
+}
+
+// initOffline() sets the client up for practice without a server. The user is
+// alone in a room of one, and their keying is heard by nobody else.
+
+func initOffline(name string) Audio {
+    USERS_MAX = 1
+    return Audio{Name: name, UserKey: 0}
+}
+
+func initConnection(name string, url string, spectate bool) Audio {
     a := Audio{}
-    m := Msg{}
     log.Println("Connecting to", url, "as", name, "...")
+    s, err := connect(name, url, spectate)
+    if err != nil {
+        log.Println(err)
+        log.Fatal("Re-connect when these conditions change.")
+    }
+    log.Println(name,"is okay.")
+    USERS_MAX = s.UsersMax
+    a.Name = name
+    a.Spectator = spectate
+    a.Use(s)
+    return a
+}
+
+// connect() dials a server and introduces the user. Spectators are never
+// given a key of their own, so theirs is the room size.
+
+func connect(name string, url string, spectate bool) (Session, error) {
+    var s Session
+    m := Msg{Type: MSG_ENTER, Name: name}
+    if spectate {
+        m.Type = MSG_SPECTATE
+    }
+    want := m.Type
     c, err := net.Dial("tcp", url)
     if err != nil {
-        log.Fatal(err)
+        return s, err
     }
     r := gob.NewDecoder(c)
     w := gob.NewEncoder(c)
-    if err := w.Encode(name); err != nil {
+    if err := w.Encode(m); err != nil {
         c.Close()
-        log.Fatal(err)
+        return s, err
     }
     if err := r.Decode(&m); err != nil {
         c.Close()
-        log.Fatal(err)
+        return s, err
     }
-    if m.Type != MSG_ENTER {
-        errMsgDisplay(m.Type)
+    if m.Type != want {
         c.Close()
-        log.Fatal("Re-connect when these conditions change.")
+        if err := errMsg(m.Type); err != nil {
+            return s, err
+        }
+        return s, errors.New("Unexpected reply from the server.")
     }
-    log.Println(name,"is okay.")
-    USERS_MAX = int(m.Key - 1)
-    if USERS_MAX == 0 || USERS_MAX > 254 {
+    s = Session{Server: c, Reader: r, Writer: w, UsersMax: int(m.Key - 1)}
+    if s.UsersMax == 0 || s.UsersMax > 254 {
         c.Close()
-        log.Fatal("Error retrieving max user count from the server.") 
+        return s, errors.New("Error retrieving max user count from the " +
+                             "server.")
+    }
+    if spectate {
+        s.UserKey = uint8(s.UsersMax)
+        return s, nil
     }
-    log.Println("Retrieving user key ...")
     if err := r.Decode(&m); err != nil {
         c.Close()
-        log.Fatal(err)
+        return s, err
     }
-    a.Server = c
-    a.Reader = r
-    a.Writer = w
-    a.UserKey = m.Key - 1
-    return a
+    s.UserKey = m.Key - 1
+    return s, nil
 }
-
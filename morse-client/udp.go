@@ -0,0 +1,284 @@
+package main
+
+// Keying over UDP, for links where TCP's head-of-line blocking holds up
+// MSG_ON and MSG_OFF in bursts. Everything else stays on TCP. Every datagram
+// repeats the latest UDP_REDUNDANCY transitions, numbered in sequence, and
+// the server's also say who in the room is keying, so that transitions lost
+// beyond that are put right by the next datagram. See the server's udp.go
+// for the layout.
+//
+// Transitions are timed, and the room's are played UDP_PLAYOUT behind when
+// the server passed them on, so that one recovered from a later datagram
+// still sounds when it should and Morse keeps its rhythm.
+//
+// The -loss and -jitter flags impair datagrams both ways, for trying the
+// transport out on a good network.
+
+import (
+    "encoding/binary"
+    "errors"
+    "log"
+    "math/rand"
+    "net"
+    "strconv"
+    "time"
+)
+
+type UDPTransition struct {
+    Seq uint32
+    Key uint8
+    On uint8
+    At uint32
+}
+
+// A Playout is a Msg waiting for its time to be played.
+
+type Playout struct {
+    At time.Time
+    Msg Msg
+}
+
+// A UDPLink is the client's end of the transport. Its clock counts
+// milliseconds from Start. Seq and Recent belong to Audio, which sends the
+// user's keying, while Heard, Keying and Ahead, the least the client's clock
+// has been seen to lead the server's, belong to UDPLink.Listen().
+
+type UDPLink struct {
+    Conn net.Conn
+    Token uint64
+    Start time.Time
+    Seq uint32
+    Recent []UDPTransition
+    Heard uint32
+    Keying []bool
+    Ahead int64
+    Timed bool
+}
+
+// dialUDP() opens a UDPLink to the server's host, given its answer to a
+// MSG_UDP.
+
+func dialUDP(server net.Conn, m *Msg) (*UDPLink, error) {
+    token, err := strconv.ParseUint(m.Name, 16, 64)
+    if err != nil || m.Hz < 1 || m.Hz > 65535 {
+        return nil, errors.New("Bad UDP details from the server.")
+    }
+    host, _, err := net.SplitHostPort(server.RemoteAddr().String())
+    if err != nil {
+        return nil, err
+    }
+    addr := net.JoinHostPort(host, strconv.Itoa(int(m.Hz)))
+    c, err := net.Dial("udp", addr)
+    if err != nil {
+        return nil, err
+    }
+    return &UDPLink{Conn: c, Token: token, Start: time.Now(),
+                    Keying: make([]bool, USERS_MAX)}, nil
+}
+
+func (u *UDPLink) millis() uint32 {
+    return uint32(time.Since(u.Start).Milliseconds())
+}
+
+// UDPLink.Key() sends a transition of the user's own, and sends it again
+// shortly after in case it is lost.
+
+func (u *UDPLink) Key(on bool) {
+    u.Seq++
+    t := UDPTransition{Seq: u.Seq, At: u.millis()}
+    if on {
+        t.On = 1
+    }
+    u.Recent = append(u.Recent, t)
+    if len(u.Recent) > UDP_REDUNDANCY {
+        u.Recent = u.Recent[1:]
+    }
+    ts := append([]UDPTransition{}, u.Recent...)
+    u.send(ts)
+    for i := 1; i <= UDP_RESENDS; i++ {
+        time.AfterFunc(time.Duration(i) * UDP_RESEND, func() { u.send(ts) })
+    }
+}
+
+func (u *UDPLink) send(ts []UDPTransition) {
+    p := binary.BigEndian.AppendUint64(nil, u.Token)
+    p = binary.BigEndian.AppendUint32(p, u.millis())
+    p = append(p, uint8(len(ts)))
+    for _, t := range ts {
+        p = binary.BigEndian.AppendUint32(p, t.Seq)
+        p = append(p, t.On)
+        p = binary.BigEndian.AppendUint32(p, t.At)
+    }
+    impair(func() {
+        if _, err := u.Conn.Write(p); err != nil {
+            log.Println(err)
+        }
+    })
+}
+
+// UDPLink.Keepalive() lets the server know where to find the client, and
+// has it send the room's keying in return.
+
+func (u *UDPLink) Keepalive(done chan struct{}) {
+    tick := time.NewTicker(UDP_KEEPALIVE)
+    defer tick.Stop()
+    for {
+        u.send(nil)
+        select {
+        case <- tick.C:
+        case <- done:
+            return
+        }
+    }
+}
+
+// UDPLink.Listen() passes the room's keying along as MSG_ON and MSG_OFF, in
+// order and without repeats, until done is closed. Datagrams go through
+// impair() on their way in, then are handled one at a time, and what they
+// hold waits in a queue until it is due.
+
+func (u *UDPLink) Listen(from chan Msg, done chan struct{}) {
+    arrived := make(chan []byte, UDP_QUEUE)
+    go func() {
+        buf := make([]byte, UDP_PACKET_MAX)
+        for {
+            n, err := u.Conn.Read(buf)
+            if err != nil {
+                select {
+                case <- done:
+                    return
+                default:
+                }
+                // Nothing is listening yet, or the port was refused
+                time.Sleep(UDP_KEEPALIVE)
+                continue
+            }
+            p := append([]byte{}, buf[:n]...)
+            impair(func() {
+                select {
+                case arrived <- p:
+                default:
+                }
+            })
+        }
+    }()
+    var queue []Playout
+    timer := time.NewTimer(UDP_KEEPALIVE)
+    defer timer.Stop()
+    for {
+        select {
+        case p := <- arrived:
+            for _, po := range u.handle(p) {
+                i := len(queue)
+                for i > 0 && queue[i-1].At.After(po.At) {
+                    i--
+                }
+                queue = append(queue[:i], append([]Playout{po},
+                                                 queue[i:]...)...)
+            }
+        case <- timer.C:
+        case <- done:
+            return
+        }
+        for len(queue) > 0 && !queue[0].At.After(time.Now()) {
+            select {
+            case from <- queue[0].Msg:
+                queue = queue[1:]
+            case <- done:
+                return
+            }
+        }
+        if !timer.Stop() {
+            select {
+            case <- timer.C:
+            default:
+            }
+        }
+        if len(queue) > 0 {
+            timer.Reset(time.Until(queue[0].At))
+        } else {
+            timer.Reset(UDP_KEEPALIVE)
+        }
+    }
+}
+
+// UDPLink.handle() turns a datagram into Msgs, each due UDP_PLAYOUT after
+// the time it was made, on the client's clock. The room's keying is only
+// trusted from a datagram no older than any already heard, and anything it
+// puts right is due UDP_PLAYOUT from now.
+
+func (u *UDPLink) handle(p []byte) []Playout {
+    var ps []Playout
+    seq, sent, ts, keying, err := parseDownlink(p)
+    if err != nil {
+        return nil
+    }
+    if ahead := int64(u.millis()) - int64(sent); !u.Timed || ahead < u.Ahead {
+        u.Ahead, u.Timed = ahead, true
+    }
+    key := func(k uint8, on bool, at time.Time) {
+        if int(k) >= len(u.Keying) {
+            return
+        }
+        u.Keying[k] = on
+        m := Msg{Type: MSG_OFF, Key: k}
+        if on {
+            m.Type = MSG_ON
+        }
+        ps = append(ps, Playout{at.Add(UDP_PLAYOUT), m})
+    }
+    for _, t := range ts {
+        if t.Seq > u.Heard {
+            u.Heard = t.Seq
+            ms := time.Duration(int64(t.At) + u.Ahead) * time.Millisecond
+            key(t.Key, t.On == 1, u.Start.Add(ms))
+        }
+    }
+    if seq < u.Heard {
+        return ps
+    }
+    u.Heard = seq
+    for k, on := range keying {
+        if k < len(u.Keying) && on != u.Keying[k] {
+            key(uint8(k), on, time.Now())
+        }
+    }
+    return ps
+}
+
+func parseDownlink(p []byte) (uint32, uint32, []UDPTransition, []bool,
+                                error) {
+    if len(p) < 9 || len(p) < 9 + int(p[8]) * 10 {
+        return 0, 0, nil, nil, errors.New("Malformed datagram.")
+    }
+    seq := binary.BigEndian.Uint32(p)
+    sent := binary.BigEndian.Uint32(p[4:])
+    ts := make([]UDPTransition, p[8])
+    for i, _ := range ts {
+        q := p[9 + i * 10:]
+        ts[i] = UDPTransition{binary.BigEndian.Uint32(q), q[4], q[5],
+                              binary.BigEndian.Uint32(q[6:])}
+    }
+    var keying []bool
+    for _, b := range p[9 + len(ts) * 10:] {
+        for i := 0; i < 8; i++ {
+            keying = append(keying, b & (1 << i) != 0)
+        }
+    }
+    return seq, sent, ts, keying, nil
+}
+
+// impair() runs f, unless the simulated loss drops it, after a random delay
+// of up to the simulated jitter. Delayed datagrams may well arrive out of
+// order, as they would on a real network.
+
+func impair(f func()) {
+    if UDP_LOSS > 0.0 && rand.Float64() < UDP_LOSS {
+        return
+    }
+    if UDP_JITTER > 0 {
+        time.AfterFunc(time.Duration(rand.Int63n(int64(UDP_JITTER))), f)
+        return
+    }
+    f()
+}
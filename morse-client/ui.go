@@ -4,44 +4,158 @@ package main
 
 /*
 #cgo CFLAGS: -I/usr/include
-#cgo LDFLAGS: -L/usr/lib -lcurses
+#cgo LDFLAGS: -L/usr/lib -lncursesw
+#include <stdlib.h>
+#include "audio-output.h"
 #include "curses-ui.h"
 Screen S;
 */
 import "C"
 
 import (
+    "fmt"
     "os"
+    "os/signal"
     "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "syscall"
+    "time"
+    "unsafe"
 )
 
+// A Member is what the roster shows of a User.
+
+type Member struct {
+    Name string
+    Hz float64
+    On bool
+    Muted bool
+    Whispering bool
+    Presence Presence
+}
+
 // The UI contains a pointer to the C Screen struct, which captures key and 
 // mouse events. These events are communicated to the Audio struct and server
-// by Msgs.
+// by Msgs. The roster and status bar are kept up to date from the Msgs that
+// Audio passes along, so they are only touched by the display loop, apart
+// from the input loop reading names from the roster for tab completion.
+// Typed holds the command history, and Sending counts /send commands so that
+// each may tell when it has been taken over. Key is the user's own, and
+// Whisper is whoever they are whispering to, if anyone. Presence is what the
+// user publishes of themselves, which belongs to the input loop.
 
 type UI struct {
     FromAudio chan Msg
     ToAudio chan Msg
+    Name string
+    Key uint8
+    Whisper string
+    Spectator bool
+    Keyer *Keyer
+    Log *Logbook
+    Prefs *Preferences
+    Band *C.Conditions
+    Out *C.Out
     Screen *C.Screen
+    Roster []Member
+    RosterLock sync.Mutex
+    Volume float64
+    RTT time.Duration
+    History History
+    View int32
+    Shown int32
+    Typed []string
+    Recalled int
+    Sending int32
+    Presence Presence
 }
 
 // The display loop. Updates to Audio are signaled through Msgs, and the curses
-// session is updated accordingly. Scrolling through Msg history is not
-// implemented for the time being, since all relevant information can be
-// obtained through pressing the 'n' or 'h' keys whenever.
+// session is updated accordingly. The message pane is scrolled with PgUp and
+// PgDn, which the C code handles by itself.
 
 func (ui *UI) ListenToAudio(userAudioOn *C.uint) {
     ui.Screen = &C.S
+    ui.Roster = make([]Member, USERS_MAX)
+    ui.Volume = 1.0
+    ui.History = NewHistory()
     C.initScreen(ui.Screen, userAudioOn)
-    helpMessage()
+    ui.drawStatus()
+    printLine("Click to key, or type to chat. Type /help for a list of " +
+              "commands.")
     go ui.ListenToInput()
+    go ui.ListenToResize()
+    tick := time.NewTicker(VIEW_REFRESH)
     for {
-        m := <- ui.FromAudio
-        ui.HandleAudioMsg(&m)
+        select {
+        case m := <- ui.FromAudio:
+            ui.HandleAudioMsg(&m)
+        case now := <- tick.C:
+            if ui.Shown != VIEW_MESSAGES || atomic.LoadInt32(&ui.View) !=
+               VIEW_MESSAGES {
+                ui.drawView(now)
+            }
+        }
     }
 }
 
 func (ui *UI) HandleAudioMsg(m *Msg) {
+    var was Presence
+    ui.RosterLock.Lock()
+    switch m.Type {
+    case MSG_ON, MSG_OFF:
+        ui.Roster[m.Key].On = m.Type == MSG_ON
+        ui.History.Add(m.Key, m.Type == MSG_ON, time.Now())
+    case MSG_HZ, MSG_ENTER:
+        ui.Roster[m.Key].Name = m.Name
+        ui.Roster[m.Key].Hz = m.Hz
+    case MSG_LEAVE:
+        ui.Roster[m.Key] = Member{}
+        ui.History[m.Key] = nil
+    case MSG_INTERNAL_MUTE:
+        if m.Key != 255 {
+            ui.Roster[m.Key].Muted = m.On == 1
+        }
+    case MSG_WHISPER:
+        if m.Key != ui.Key {
+            ui.Roster[m.Key].Whispering = m.On == 1
+        }
+    case MSG_PRESENCE:
+        was = ui.Roster[m.Key].Presence
+        ui.Roster[m.Key].Presence = presenceOf(m)
+    }
+    ui.RosterLock.Unlock()
+    switch m.Type {
+    case MSG_ON, MSG_OFF:
+        ui.drawRoster()
+        return
+    case MSG_HZ, MSG_ENTER, MSG_LEAVE, MSG_INTERNAL_MUTE, MSG_PRESENCE:
+        ui.drawRoster()
+    case MSG_PING:
+        ui.RTT = time.Duration(m.Hz * float64(time.Second))
+        ui.drawStatus()
+        return
+    case MSG_INTERNAL_VOLUME:
+        ui.Volume = m.Hz
+        ui.drawStatus()
+        return
+    case MSG_INTERNAL_WPM:
+        ui.drawStatus()
+    case MSG_WHISPER:
+        if m.Key == ui.Key {
+            // A refusal leaves any whisper as it was
+            if m.On == 1 {
+                ui.Whisper = m.Name
+            } else if m.Name == "" {
+                ui.Whisper = ""
+            }
+            ui.drawStatus()
+        } else {
+            ui.drawRoster()
+        }
+    }
     switch m.Type {
     case MSG_HZ:
         s := C.CString(m.Name + " = " + 
@@ -54,20 +168,157 @@ func (ui *UI) HandleAudioMsg(m *Msg) {
     case MSG_LEAVE:
         s := C.CString(m.Name + " has left.")
         C.cursesPrintln(s)
+    case MSG_FLOOR:
+        if m.On == 1 {
+            printLine(m.Name + " has the floor.")
+        } else {
+            printLine("The floor is open.")
+        }
+    case MSG_FLOOR_REQUEST:
+        printLine(m.Name + " wants to send.")
+    case MSG_INTERNAL_FIST, MSG_INTERNAL_HISTOGRAM:
+        for _, l := range strings.Split(m.Text, "\n") {
+            printLine(l)
+        }
+    case MSG_UDP:
+        switch {
+        case m.On == 1:
+            printLine("Keying over UDP.")
+        case m.Name != "":
+            printLine("Could not key over UDP: " + m.Name)
+        default:
+            printLine("This server does not take keying over UDP.")
+        }
+    case MSG_PITCH:
+        near := m.Name + "'s pitch of " +
+                strconv.FormatFloat(m.Hz, 'f', 0, 64) + "Hz"
+        if m.On == 1 {
+            printLine("Moved clear of " + near + ".")
+        } else {
+            printLine("Too close to " + near + " to tell apart easily.")
+        }
+    case MSG_MUTE:
+        printLine("Muted by the server for " +
+                  strconv.FormatFloat(m.Hz, 'f', 0, 64) +
+                  " seconds for flooding.")
+    case MSG_INTERNAL_MUTE:
+        switch {
+        case m.Key == 255:
+            printLine("There is no " + m.Name + " here to mute.")
+        case m.On == 1:
+            printLine(m.Name + " is muted.")
+        default:
+            printLine(m.Name + " is no longer muted.")
+        }
+        if m.Key != 255 {
+            ui.save(func(c *Config) {
+                if m.On == 1 {
+                    c.Mutes[m.Name] = true
+                } else {
+                    delete(c.Mutes, m.Name)
+                }
+            })
+        }
+    case MSG_HISTORY:
+        ui.recall(m)
+    case MSG_TEXT:
+        if m.On == 1 {
+            printChat(m.Name, m.Text)
+        } else {
+            printLine("Text chat is off in this room.")
+        }
+    case MSG_WHISPER:
+        switch {
+        case m.Key != ui.Key && m.On == 1:
+            printLine(m.Name + " is whispering to you.")
+        case m.Key != ui.Key:
+            printLine(m.Name + " has stopped whispering to you.")
+        case m.On == 1:
+            printLine("Whispering to " + m.Name + ". /whisper alone keys " +
+                      "to the room again.")
+        case m.Name != "":
+            printLine("Cannot whisper to " + m.Name + ".")
+        default:
+            printLine("Keying to the room again.")
+        }
+    case MSG_INTERNAL_WPM:
+        printLine("WPM = " + strconv.FormatFloat(m.Hz, 'f', 0, 64))
+    case MSG_INTERNAL_NAMES:
+        s := m.Name + " = " + strconv.FormatFloat(m.Hz, 'f', 3, 64) + "Hz"
+        if m.Text != "" {
+            s += ", " + m.Text
+        }
+        printLine(s + ".")
+    case MSG_PRESENCE:
+        if m.Key != ui.Key {
+            ui.tellPresence(m.Key, was, presenceOf(m))
+        }
+    case MSG_INTERNAL_JOIN:
+        if m.On == 0 {
+            printLine("Could not join: " + m.Text)
+            return
+        }
+        if !ui.Spectator {
+            ui.Screen.audioOn = &C.getInstance(ui.Out, C.uint(m.Key)).on
+        }
+        ui.Key = m.Key
+        ui.Whisper = ""
+        ui.drawStatus()
+        printLine("Joined " + m.Text + ".")
     }
 }
 
-// The input loop. Key and mouse events are sent back to Audio to update state. 
+// The input loop. Mouse events are sent back to Audio to update state, and
+// lines typed in are run as commands.
 
 func (ui *UI) ListenToInput() {
+    buf := (*C.char)(C.malloc(C.TEXT_MAX))
+    n := C.int(0)
+    ui.publish(nil)
     for {
-        C.getInput(ui.Screen)
-        ui.HandleInput(ui.Screen.ch)
+        switch C.getResponse(ui.Screen, buf, C.TEXT_MAX, &n) {
+        case C.RESPONSE_KEY:
+            ui.HandleInput(ui.Screen.ch)
+        case C.RESPONSE_LINE:
+            line := C.GoString(buf)
+            n = 0
+            ui.Remember(line)
+            ui.RunCommand(line)
+        case C.RESPONSE_TAB:
+            setInput(buf, &n, ui.Complete(C.GoString(buf)))
+        case C.RESPONSE_UP:
+            setInput(buf, &n, ui.Recall(-1))
+        case C.RESPONSE_DOWN:
+            setInput(buf, &n, ui.Recall(1))
+        case C.RESPONSE_FUNCTION:
+            key := fmt.Sprintf("F%d", ui.Screen.ch)
+            if line := ui.Prefs.Bind(key); line != "" {
+                printLine(key + ": " + line)
+                ui.RunCommand(line)
+            }
+        }
+    }
+}
+
+// The terminal size is watched from Go, since the runtime catches SIGWINCH
+// before curses can.
+
+func (ui *UI) ListenToResize() {
+    winch := make(chan os.Signal, 1)
+    signal.Notify(winch, syscall.SIGWINCH)
+    for range winch {
+        C.resizeScreen()
     }
 }
 
 func (ui *UI) HandleInput(ch C.int) {
     var m Msg
+    if ui.Spectator {
+        if ch == KEY_O {
+            printLine("Spectators cannot key.")
+        }
+        return
+    }
     switch ch {
         // The C code returns mouse on/off events as keys 'o' and 'p'.
     case KEY_O:
@@ -76,61 +327,112 @@ func (ui *UI) HandleInput(ch C.int) {
     case KEY_P:
         m.Type = MSG_OFF
         ui.ToAudio <- m
-    case KEY_V:
-        s := C.CString("Enter new volume: (0.0 to 1.0)")
-        C.cursesPrintln(s)
-        d := C.getText()
-        if d > VOLUME_MAX {
-            d = VOLUME_MAX
-        } else if d < VOLUME_MIN {
-            d = VOLUME_MIN
-        }
-        m.Type = MSG_INTERNAL_VOLUME
-        m.Hz = float64(d)
-        s = C.CString("Volume = " + strconv.FormatFloat(m.Hz, 'f', 3, 64))
-        C.cursesPrintln(s)
-        ui.ToAudio <- m
-    case KEY_E:
-        s := C.CString("Enter new Hz value:")
-        C.cursesPrintln(s)
-        d := C.getText()
-        m.Type = MSG_HZ
-        if d > FREQ_MAX {
-            d = FREQ_MAX
-        } else if d < FREQ_MIN {
-            d = FREQ_MIN
-        }
-        m.Hz = float64(d)
-        ui.ToAudio <- m
-    case KEY_N:
-        m.Type = MSG_INTERNAL_NAMES
-        ui.ToAudio <- m
-    case KEY_Q:
-        C.endwin()
-        os.Exit(1)
-    case KEY_H:
-        helpMessage()
-    case KEY_ENTER:
-        s := C.CString(" ")
-        C.cursesPrintln(s)
     }
 }
 
-func helpMessage() {
-    s := C.CString("click - sound")
-    C.cursesPrintln(s)
-    s = C.CString("o - lock sound on")
-    C.cursesPrintln(s)
-    s = C.CString("p - lock sound off")
-    C.cursesPrintln(s)
-    s = C.CString("e - pitch")
-    C.cursesPrintln(s)
-    s = C.CString("v - volume")
-    C.cursesPrintln(s)
-    s = C.CString("n - list names")
-    C.cursesPrintln(s)
-    s = C.CString("q - quit")
-    C.cursesPrintln(s)
-    s = C.CString("h - help")
-    C.cursesPrintln(s)
+func printLine(s string) {
+    cs := C.CString(s)
+    C.cursesPrintln(cs)
+    C.free(unsafe.Pointer(cs))
+}
+
+// printChat() shows a line of text chat, set apart from notices and copy.
+
+func printChat(name string, text string) {
+    cs := C.CString("<" + name + "> " + text)
+    C.cursesPrintChat(cs)
+    C.free(unsafe.Pointer(cs))
+}
+
+// fit() pads or cuts s to exactly w columns, going by how wide the terminal
+// draws each character, so that names in any script line up.
+
+func fit(s string, w int) string {
+    var b strings.Builder
+    used := 0
+    for _, r := range s {
+        cw := int(C.wcwidth(C.wchar_t(r)))
+        if cw < 0 {
+            cw = 1
+        }
+        if used + cw > w {
+            break
+        }
+        b.WriteRune(r)
+        used += cw
+    }
+    return b.String() + strings.Repeat(" ", w - used)
+}
+
+func readLine() string {
+    buf := (*C.char)(C.malloc(C.TEXT_MAX))
+    defer C.free(unsafe.Pointer(buf))
+    C.getLine(buf, C.TEXT_MAX)
+    return C.GoString(buf)
+}
+
+// UI.save() makes a change to the preferences, which are written back to the
+// config file.
+
+func (ui *UI) save(f func(*Config)) {
+    if err := ui.Prefs.Change(f); err != nil {
+        printLine("Could not save settings: " + err.Error())
+    }
+}
+
+// UI.names() returns the names of those in the room, for completion.
+
+func (ui *UI) names() []string {
+    ui.RosterLock.Lock()
+    defer ui.RosterLock.Unlock()
+    var names []string
+    for _, u := range ui.Roster {
+        if u.Name != "" {
+            names = append(names, u.Name)
+        }
+    }
+    return names
+}
+
+// UI.drawRoster() lists every User in the roster pane, with a mark beside
+// those keying, those whispering to the user, those muted, and those away
+// or idle.
+
+func (ui *UI) drawRoster() {
+    n := 0
+    for _, u := range ui.Roster {
+        if u.Name == "" {
+            continue
+        }
+        mark := ' '
+        if u.On {
+            mark = '*'
+        } else if u.Whispering {
+            mark = '~'
+        } else if u.Muted {
+            mark = '-'
+        } else if u.Presence.Away() != "" {
+            mark = 'z'
+        }
+        s := C.CString(fmt.Sprintf("%c %s %5.0f", mark, fit(u.Name, 14), u.Hz))
+        C.setRoster(C.int(n), s)
+        C.free(unsafe.Pointer(s))
+        n++
+    }
+    C.drawRoster(C.int(n))
+}
+
+func (ui *UI) drawStatus() {
+    rtt := "--"
+    if ui.RTT > 0 {
+        rtt = ui.RTT.Round(time.Millisecond).String()
+    }
+    whisper := ""
+    if ui.Whisper != "" {
+        whisper = " | whisper " + ui.Whisper
+    }
+    s := C.CString(fmt.Sprintf("%s | vol %.2f | %.0f wpm | rtt %s%s", ui.Name,
+                               ui.Volume, WPM, rtt, whisper))
+    C.drawStatus(s)
+    C.free(unsafe.Pointer(s))
 }
@@ -0,0 +1,211 @@
+package main
+
+// Graphical views of the room's keying, drawn in place of the message pane.
+// The timeline gives each User a row, with their keying scrolling off to the
+// left. The waterfall gives each pitch a column, with the newest keying at
+// the top, much like the waterfall on a radio. Both are drawn from the on/off
+// Msgs that Audio passes along to the UI.
+
+/*
+#include <stdlib.h>
+#include "curses-ui.h"
+*/
+import "C"
+
+import (
+    "fmt"
+    "math"
+    "strings"
+    "sync/atomic"
+    "time"
+    "unsafe"
+)
+
+const (
+    VIEW_MESSAGES int32 = iota
+    VIEW_TIMELINE
+    VIEW_WATERFALL
+    VIEW_COUNT
+)
+
+// Names for /view, in the same order.
+
+var VIEW_NAMES = []string{"messages", "timeline", "waterfall"}
+
+// Waterfall cells go from quiet to keyed the whole time.
+
+const WATERFALL_SHADES = " .:-=+*#%@"
+
+// A Transition is a User keying on or off.
+
+type Transition struct {
+    T time.Time
+    On bool
+}
+
+// The History holds each User's recent Transitions, indexed by key. It is
+// only touched by the display loop.
+
+type History [][]Transition
+
+func NewHistory() History {
+    return make(History, USERS_MAX)
+}
+
+func (h History) Add(key uint8, on bool, t time.Time) {
+    h[key] = append(h[key], Transition{t, on})
+}
+
+// History.Trim() forgets Transitions from before t, keeping the last of them
+// so that it is still known whether the User was on at t.
+
+func (h History) Trim(t time.Time) {
+    for k, ts := range h {
+        i := 0
+        for i < len(ts) - 1 && ts[i + 1].T.Before(t) {
+            i++
+        }
+        h[k] = ts[i:]
+    }
+}
+
+// History.On() returns the fraction of the time from one time to another that
+// a User was keying.
+
+func (h History) On(key int, from time.Time, to time.Time) float64 {
+    var on time.Duration
+    ts := h[key]
+    for i, tr := range ts {
+        if !tr.On {
+            continue
+        }
+        start, end := tr.T, to
+        if i + 1 < len(ts) {
+            end = ts[i + 1].T
+        }
+        if start.Before(from) {
+            start = from
+        }
+        if end.After(to) {
+            end = to
+        }
+        if end.After(start) {
+            on += end.Sub(start)
+        }
+    }
+    return float64(on) / float64(to.Sub(from))
+}
+
+// UI.CycleView() switches to the next view. It is called from the input loop,
+// so the display loop only picks up the change on its next tick.
+
+func (ui *UI) CycleView() {
+    v := atomic.LoadInt32(&ui.View)
+    atomic.StoreInt32(&ui.View, (v + 1) % VIEW_COUNT)
+}
+
+// UI.drawView() redraws the current view, switching the message pane over to
+// it (or back to messages) first if it has changed.
+
+func (ui *UI) drawView(now time.Time) {
+    v := atomic.LoadInt32(&ui.View)
+    if v != ui.Shown {
+        C.showView(C.int(v))
+        ui.Shown = v
+    }
+    ui.History.Trim(now.Add(-VIEW_HISTORY))
+    var lines []string
+    w, h := int(C.viewWidth()), int(C.viewHeight())
+    switch v {
+    case VIEW_TIMELINE:
+        lines = ui.timeline(now, w, h)
+    case VIEW_WATERFALL:
+        lines = ui.waterfall(now, w, h)
+    default:
+        return
+    }
+    for i, l := range lines {
+        s := C.CString(l)
+        C.setView(C.int(i), s)
+        C.free(unsafe.Pointer(s))
+    }
+    C.drawView(C.int(len(lines)))
+}
+
+// Each column of the timeline is TIMELINE_STEP long. A column is drawn full
+// if the User was keying for most of it, and half full if for any of it.
+
+func (ui *UI) timeline(now time.Time, w int, h int) []string {
+    cols := w - 12
+    if cols < 1 {
+        return nil
+    }
+    lines := []string{fmt.Sprintf("Timeline, %s a column", TIMELINE_STEP)}
+    for k, u := range ui.Roster {
+        if u.Name == "" || len(lines) >= h {
+            continue
+        }
+        bar := make([]byte, cols)
+        for c, _ := range bar {
+            to := now.Add(-time.Duration(cols - 1 - c) * TIMELINE_STEP)
+            f := ui.History.On(k, to.Add(-TIMELINE_STEP), to)
+            switch {
+            case f >= 0.5:
+                bar[c] = '#'
+            case f > 0.0:
+                bar[c] = '+'
+            default:
+                bar[c] = ' '
+            }
+        }
+        lines = append(lines, fmt.Sprintf("%s |%s", fit(u.Name, 10), bar))
+    }
+    return lines
+}
+
+// The waterfall spans the room's pitches with a little room on either side.
+// Each row is WATERFALL_STEP long, and each cell is shaded by how long the
+// loudest User at that pitch was keying for.
+
+func (ui *UI) waterfall(now time.Time, w int, h int) []string {
+    lo, hi := math.Inf(1), math.Inf(-1)
+    for _, u := range ui.Roster {
+        if u.Name != "" {
+            lo, hi = math.Min(lo, u.Hz), math.Max(hi, u.Hz)
+        }
+    }
+    if math.IsInf(lo, 0) {
+        lo, hi = PRACTICE_HZ, PRACTICE_HZ
+    }
+    if w < 20 || h < 2 {
+        return nil
+    }
+    mid := (lo + hi) / 2.0
+    span := math.Max(hi - lo + WATERFALL_MARGIN * 2.0, WATERFALL_SPAN)
+    lo = mid - span / 2.0
+    scale := []byte(strings.Repeat(" ", w))
+    for c := 0 ; c + 10 < w ; c += 20 {
+        copy(scale[c:], fmt.Sprintf("|%.0fHz", lo + span * float64(c) /
+                                    float64(w - 1)))
+    }
+    lines := []string{string(scale)}
+    for r := 0 ; r < h - 1 ; r++ {
+        to := now.Add(-time.Duration(r) * WATERFALL_STEP)
+        row := make([]float64, w)
+        for k, u := range ui.Roster {
+            if u.Name == "" {
+                continue
+            }
+            c := int(math.Round((u.Hz - lo) / span * float64(w - 1)))
+            f := ui.History.On(k, to.Add(-WATERFALL_STEP), to)
+            row[c] = math.Max(row[c], f)
+        }
+        cells := make([]byte, w)
+        for c, f := range row {
+            cells[c] = WATERFALL_SHADES[int(f * float64(len(WATERFALL_SHADES) -
+                                                        1))]
+        }
+        lines = append(lines, string(cells))
+    }
+    return lines
+}
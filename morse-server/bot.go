@@ -0,0 +1,273 @@
+package main
+
+// A practice partner that lives inside the server, for rooms that should be
+// open to students around the clock. The bot holds a key like any other
+// user, sends words in morse, copies its student's reply and answers in
+// morse whether it was right.
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/gob"
+    "io"
+    "log"
+    "math/rand"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Words the bot sends when it isn't given a list of its own.
+
+var BOT_WORDS = []string{
+    "CQ", "DE", "TEST", "NAME", "RST", "QTH", "WX", "RIG", "ANT", "PWR",
+    "THE", "AND", "FOR", "ARE", "BUT", "NOT", "YOU", "ALL", "ANY", "CAN",
+    "HER", "WAS", "ONE", "OUR", "OUT", "DAY", "GET", "HAS", "HIM", "HIS",
+    "HOW", "MAN", "NEW", "NOW", "OLD", "SEE", "TWO", "WAY", "WHO", "BOY",
+    "HELLO", "MORSE", "RADIO", "SIGNAL", "COPY", "GOOD", "FINE", "HOME",
+}
+
+// The Bot type is driven by two goroutines. Bot.Run() sends words and waits
+// for answers, while Bot.Listen() follows the room on the bot's Client and
+// copies whoever is answering. Decoded copy is handed over on Answers. The
+// Mutex guards the bookkeeping that both of them read.
+
+type Bot struct {
+    sync.Mutex
+    Client Client
+    Words []string
+    Present map[uint8]string
+    Copy map[uint8]*Recorder
+    Answers chan string
+}
+
+func NewBot() *Bot {
+    b := Bot{
+        Words: BOT_WORDS,
+        Present: make(map[uint8]string),
+        Copy: make(map[uint8]*Recorder),
+        Answers: make(chan string, 1),
+    }
+    if BOT_WORDS_FILE != "" {
+        words, err := readWords(BOT_WORDS_FILE)
+        if err != nil {
+            log.Fatal(err)
+        }
+        b.Words = words
+    }
+    return &b
+}
+
+func readWords(path string) ([]string, error) {
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+    words := []string{}
+    s := bufio.NewScanner(f)
+    for s.Scan() {
+        for _, w := range strings.Fields(strings.ToUpper(s.Text())) {
+            words = append(words, w)
+        }
+    }
+    if len(words) == 0 {
+        return nil, io.ErrUnexpectedEOF
+    }
+    return words, s.Err()
+}
+
+// Bot.Run() enters the room through the same handshake as a network client,
+// except that the handshake's replies are kept in a buffer, from which the
+// bot learns who was already in the room. It then loops over words forever.
+// A word that is missed is sent again, up to BOT_TRIES times.
+
+func (b *Bot) Run(cs *Clients) {
+    cli := &b.Client
+    cli.Name = BOT_NAME
+    cli.Hz = BOT_HZ
+    var handshake bytes.Buffer
+    cli.Writer = gob.NewEncoder(&handshake)
+    cli.FromServer = make(chan OMsg, QUEUE_LEN)
+    cs.FromClient <- Msg{Type: MSG_ENTER, Hz: cli.Hz, Name: cli.Name,
+                         Client: cli}
+    if om := <- cli.FromServer; om.Type > MSG_ERROR_OK {
+        log.Println("Bot could not join the room.")
+        return
+    }
+    log.Println("Bot", cli.Name, "has joined the room.")
+    b.Replay(&handshake)
+    go b.Listen()
+    for {
+        b.AwaitStudent()
+        word := b.Words[rand.Intn(len(b.Words))]
+        for try := 0; try < BOT_TRIES; try++ {
+            b.Send(cs, word)
+            answer, ok := b.Await()
+            if !ok {
+                continue
+            }
+            if strings.ReplaceAll(answer, " ", "") == word {
+                b.Send(cs, "OK")
+                break
+            }
+            b.Send(cs, "NO")
+        }
+        time.Sleep(BOT_PAUSE)
+    }
+}
+
+// Bot.Replay() follows the OMsgs that Clients wrote during the handshake, as a
+// network client would read them. The first reply names the bot before it
+// has a key, and is skipped along with anything else that isn't a member.
+
+func (b *Bot) Replay(handshake io.Reader) {
+    r := gob.NewDecoder(handshake)
+    for {
+        var om OMsg
+        if err := r.Decode(&om); err != nil {
+            break
+        }
+        if om.Key - 1 < uint8(USERS_MAX) {
+            b.Follow(om)
+        }
+    }
+}
+
+// Bot.AwaitStudent() holds the bot back while there is nobody to teach.
+
+func (b *Bot) AwaitStudent() {
+    for {
+        b.Lock()
+        n := 0
+        for _, name := range b.Present {
+            if BOT_STUDENT == "" || name == BOT_STUDENT {
+                n++
+            }
+        }
+        b.Unlock()
+        if n > 0 {
+            return
+        }
+        time.Sleep(time.Second)
+    }
+}
+
+// Bot.Await() waits BOT_PATIENCE for an answer. Copy that arrived while the
+// bot was still sending is thrown away first.
+
+func (b *Bot) Await() (string, bool) {
+    for {
+        select {
+        case <- b.Answers:
+        default:
+            select {
+            case answer := <- b.Answers:
+                return answer, true
+            case <- time.After(BOT_PATIENCE):
+                return "", false
+            }
+        }
+    }
+}
+
+// Bot.Send() keys text into the room at BOT_WPM.
+
+func (b *Bot) Send(cs *Clients, text string) {
+    t := NewTiming(BOT_WPM, BOT_FARNSWORTH_WPM)
+    key := func(on bool) {
+        m := Msg{Type: MSG_OFF, Key: b.Client.Key}
+        if on {
+            m.Type = MSG_ON
+        }
+        cs.FromClient <- m
+    }
+    for i, word := range strings.Fields(text) {
+        if i > 0 {
+            time.Sleep(t.Word)
+        }
+        for j, ch := range word {
+            if j > 0 {
+                time.Sleep(t.Char)
+            }
+            for e, el := range MORSE[ch] {
+                if e > 0 {
+                    time.Sleep(t.Element)
+                }
+                key(true)
+                if el == '.' {
+                    time.Sleep(t.Dit)
+                } else {
+                    time.Sleep(t.Dah)
+                }
+                key(false)
+            }
+        }
+    }
+}
+
+// Bot.Listen() keeps track of who is in the room and records the keying of
+// anyone who might be the student. Once a student has been quiet for long
+// enough to have finished their word, their copy is decoded and passed on.
+
+func (b *Bot) Listen() {
+    tick := time.NewTicker(100 * time.Millisecond)
+    for {
+        select {
+        case om := <- b.Client.FromServer:
+            b.Follow(om)
+        case now := <- tick.C:
+            b.Lock()
+            for key, r := range b.Copy {
+                unit := r.Keying.Unit()
+                if idle := r.Idle(now); idle > BOT_ANSWER_GAP &&
+                                        idle > 10 * unit {
+                    k := r.Take()
+                    b.Answer(k.Decode())
+                }
+                if len(r.Keying.Marks) == 0 && !r.On {
+                    delete(b.Copy, key)
+                }
+            }
+            b.Unlock()
+        }
+    }
+}
+
+// Bot.Answer() never blocks, since Bot.Listen() must keep draining the bot's
+// Client for Clients' sake. An answer nobody has picked up yet is replaced.
+
+func (b *Bot) Answer(answer string) {
+    select {
+    case <- b.Answers:
+    default:
+    }
+    b.Answers <- answer
+}
+
+func (b *Bot) Follow(om OMsg) {
+    key := om.Key - 1
+    if key == b.Client.Key {
+        return
+    }
+    b.Lock()
+    defer b.Unlock()
+    switch om.Type {
+    case MSG_ENTER:
+        b.Present[key] = om.Name
+    case MSG_LEAVE:
+        delete(b.Present, key)
+        delete(b.Copy, key)
+    case MSG_ON, MSG_OFF:
+        if BOT_STUDENT != "" && b.Present[key] != BOT_STUDENT {
+            return
+        }
+        r, ok := b.Copy[key]
+        if !ok {
+            r = &Recorder{}
+            b.Copy[key] = r
+        }
+        r.Key(om.Type == MSG_ON, time.Now())
+    }
+}
@@ -9,6 +9,7 @@ import (
     "io"
     "log"
     "net"
+    "time"
 )
 
 // The Client type is a bridge between the server and the application running
@@ -21,6 +22,16 @@ type Client struct {
     Key uint8
     Hz float64
     Name string
+    Spectator bool
+    Behind bool
+    Via *Remote
+    Whisper *Client
+    Presence Presence
+    Active time.Time
+    UDP *UDPSession
+    OnSince time.Time
+    Limits Limiter
+    Conn net.Conn
     Reader *gob.Decoder
     Writer *gob.Encoder
     FromServer chan OMsg
@@ -29,24 +40,33 @@ type Client struct {
 // Client.ListenToClient() initializes the connection, adds Client data to the
 // master Clients array, and awaits Msgs from the user, which it passes along
 // to Clients. After initialization, it spawns the Client.ListenToServer()
-// process in a separate goroutine. 
+// process in a separate goroutine. Another server linking to this one is
+// handed off to Clients.Accept() instead.
 
 func (cli *Client) ListenToClient(c net.Conn, cs *Clients) {
     var m Msg
     defer log.Println(c.RemoteAddr(), "disconnected")
     defer c.Close()
     log.Println(c.RemoteAddr(), "connected")
+    cli.Conn = c
     cli.Reader = gob.NewDecoder(c)
     cli.Writer = gob.NewEncoder(c)
-    cli.FromServer = make(chan OMsg)
-    if err := cli.Reader.Decode(&cli.Name); err != nil {
+    cli.FromServer = make(chan OMsg, QUEUE_LEN)
+    if err := cli.Reader.Decode(&m); err != nil {
         log.Println(c.RemoteAddr(), err)
         return
     }
-    cli.Hz = 440.0
-    m.Type = MSG_ENTER
-    m.Hz = cli.Hz
-    m.Name = cli.Name
+    if m.Type == MSG_LINK {
+        cs.Accept(c, cli.Reader, cli.Writer)
+        return
+    }
+    if m.Type != MSG_ENTER && m.Type != MSG_SPECTATE {
+        log.Println(c.RemoteAddr(), "invalid handshake")
+        return
+    }
+    cli.Name = m.Name
+    cli.Spectator = m.Type == MSG_SPECTATE
+    m.Hz = 0.0 // Clients picks a pitch for the newcomer
     m.Client = cli
     cs.FromClient <- m
     om := <- cli.FromServer
@@ -54,16 +74,21 @@ func (cli *Client) ListenToClient(c net.Conn, cs *Clients) {
         return
     }
     go cli.ListenToServer(c)
+    if cli.Spectator {
+        cli.ListenToSpectator(c, cs)
+        return
+    }
     m.Client = nil
+    cli.Limits = NewLimiter()
     for {
-        m.Key = 255
-        m.Name = ""
+        m = Msg{Key: 255}
         if err := cli.Reader.Decode(&m); err != nil {
-            if err == io.EOF {
-                cli.Kick(&m, cs)
-                return
+            // A gob stream that fails once can't be trusted afterwards
+            if err != io.EOF {
+                log.Println(c.RemoteAddr(), err)
             }
-            log.Println(c.RemoteAddr(), err)
+            cli.Kick(&m, cs)
+            return
         }
         m.On-- // Decoding values back to potential zero
         m.Key--
@@ -72,10 +97,36 @@ func (cli *Client) ListenToClient(c net.Conn, cs *Clients) {
             cli.Kick(&m, cs)
             return
         }
+        if err := ValidMsg(&m); err != nil {
+            log.Println(c.RemoteAddr(), err)
+            if cli.Strike(c, cs) {
+                cli.Kick(&m, cs)
+                return
+            }
+            continue
+        }
+        if !cli.Limits.Allow(m.Type) {
+            if cli.Strike(c, cs) {
+                cli.Kick(&m, cs)
+                return
+            }
+            continue
+        }
+        if m.Type == MSG_PING {
+            cli.Pong(&m)
+            continue
+        }
         cs.FromClient <- m
     }
 }
 
+// Client.Pong() answers a ping straight away, without a trip through the
+// Clients struct, so that the client can measure its round trip time.
+
+func (cli *Client) Pong(m *Msg) {
+    cli.FromServer <- OMsg{Type: MSG_PING, On: 1, Key: m.Key + 1, Hz: m.Hz}
+}
+
 // Client.ListenToServer() is a simple loop that accepts OMsgs from the
 // Clients struct and encodes them back to the user. It runs in its own
 // goroutine (as opposed to being in the Clients' main thread) so that the
@@ -90,6 +141,39 @@ func (cli *Client) ListenToServer(c net.Conn) {
     }
 }
 
+// Client.ListenToSpectator() takes the place of the Msg loop for listen-only
+// connections. Spectators are not permitted to key, so anything they send
+// other than a ping or a request for the room's history is discarded. The
+// Client is removed from Clients once the connection drops.
+
+func (cli *Client) ListenToSpectator(c net.Conn, cs *Clients) {
+    var m Msg
+    cli.Limits = NewLimiter()
+    for {
+        m = Msg{}
+        if err := cli.Reader.Decode(&m); err != nil {
+            if err != io.EOF {
+                log.Println(c.RemoteAddr(), err)
+            }
+            break
+        }
+        // Pings and history requests are all that spectators may send
+        if m.Type == MSG_PING && cli.Limits.Allow(m.Type) {
+            m.Key = cli.Key
+            cli.Pong(&m)
+        } else if m.Type == MSG_HISTORY && cli.Limits.Allow(m.Type) {
+            m.On--
+            if ValidMsg(&m) == nil {
+                m.Key = cli.Key
+                m.Client = cli
+                cs.FromClient <- m
+            }
+        }
+    }
+    m = Msg{Type: MSG_LEAVE, Client: cli}
+    cs.FromClient <- m
+}
+
 func (cli *Client) Kick(m *Msg, cs *Clients) {
     m.Type = MSG_LEAVE
     m.Key = cli.Key
@@ -102,12 +186,27 @@ func (cli *Client) Kick(m *Msg, cs *Clients) {
 // Client.Key() field addresses. This means that adding a new Client is an
 // O(n) operation that must check every array index for duplicate names, but 
 // all subsequent operations are able to address the index directly, without 
-// need for hashing.
+// need for hashing. Spectators are kept apart from the keyed Clients, since
+// they neither consume a key nor appear in the room's member list. Users
+// heard over links to other servers have Clients too, with a Via but no
+// connection of their own.
 
 type Clients struct {
     FromClient chan Msg
     Available []uint8
     All []*Client
+    Spectators []*Client
+    Floor Floor
+    Metrics *Metrics
+    Relay *Relay
+    Links Links
+    UDP UDP
+    History History
+}
+
+func NewClients() *Clients {
+    return &Clients{FromClient: make(chan Msg, QUEUE_LEN),
+                    Metrics: NewMetrics(), Links: NewLinks()}
 }
 
 // Gob will not transmit zero-valued variables. Clients.NewOMsg() removes
@@ -116,16 +215,28 @@ type Clients struct {
 // 1 to them ahead of time.
 
 func (cs *Clients) NewOMsg(m *Msg) OMsg {
-    om := OMsg{m.Type, m.On + 1, m.Key + 1, m.Hz, m.Name}
+    om := OMsg{m.Type, m.On + 1, m.Key + 1, m.Hz, m.Name, m.Text}
     switch {
     case m.Type == MSG_ON || m.Type == MSG_OFF:
+        // Hz is only set for keying timed over UDP, and goes no further than
+        // Clients.Broadcast()
+        om.Name = ""
+    case m.Type == MSG_FLOOR:
         om.Hz = 0.0
         om.Name = ""
     case m.Type == MSG_HZ:
         om.On = 0
         om.Name = ""
-    case m.Type == MSG_ENTER:
+    case m.Type == MSG_MUTE:
+        om.Name = ""
+    case m.Type == MSG_WHISPER || m.Type == MSG_TEXT:
+        om.Hz = 0.0
+    case m.Type == MSG_ENTER || m.Type == MSG_PITCH || m.Type == MSG_UDP ||
+         m.Type == MSG_PRESENCE || m.Type == MSG_HISTORY:
         // Keep everything
+    case m.Type == MSG_SPECTATE:
+        om.On = 0
+        om.Hz = 0.0
     default:
         om.On = 0
         om.Hz = 0.0
@@ -135,26 +246,58 @@ func (cs *Clients) NewOMsg(m *Msg) OMsg {
 }
 
 func (cs *Clients) NameExists(name string) bool {
-    for _, cli := range cs.All {
-        if cli != nil && cli.Name == name {
-            return true
-        }
-    }
-    return false
+    return cs.Named(name) != nil
 }
 
+// A whisper reaches only the one user it is meant for, so keying it neither
+// needs the floor nor takes it.
+
 func (cs *Clients) On(m *Msg) error {
+    if cs.All[m.Key].Whisper == nil {
+        if err := cs.TakeFloor(m.Key); err != nil {
+            return err
+        }
+    }
+    if cs.All[m.Key].On == 0 {
+        cs.All[m.Key].OnSince = time.Now()
+    }
     cs.All[m.Key].On = 1
     return nil
 }
 
 func (cs *Clients) Off(m *Msg) error {
+    if FLOOR_TIMEOUT > 0 && cs.All[m.Key].On == 0 {
+        // The MSG_ON this pairs with was suppressed by floor control
+        return errors.New("User is not keying.")
+    }
+    cs.KeyUp(cs.All[m.Key])
     cs.All[m.Key].On = 0
+    if cs.All[m.Key].Whisper == nil {
+        cs.ReleaseFloor(m.Key)
+    }
     return nil
 }
 
+// Clients.Hz() changes a user's pitch. One that crowds somebody else's is
+// dealt with as PITCH_POLICY says, and the user is told about it by a
+// MSG_PITCH naming whoever they crowd. Its On is 1 if they were nudged, in
+// which case the MSG_HZ that follows carries their new pitch.
+
 func (cs *Clients) Hz(m *Msg) error {
-    cs.All[m.Key].Hz = m.Hz
+    cli := cs.All[m.Key]
+    if near := cs.Crowding(m.Key, m.Hz); near != nil &&
+       PITCH_POLICY != PITCH_ALLOW {
+        pm := Msg{Type: MSG_PITCH, Key: near.Key, Hz: near.Hz,
+                  Name: near.Name}
+        if PITCH_POLICY == PITCH_NUDGE {
+            if hz, ok := cs.Nudge(m.Key, m.Hz); ok {
+                m.Hz = hz
+                pm.On = 1
+            }
+        }
+        cli.FromServer <- cs.NewOMsg(&pm)
+    }
+    cli.Hz = m.Hz
     return nil
 }
 
@@ -165,8 +308,9 @@ func (cs *Clients) Enter(m *Msg) error {
     // single method, which is ugly but unavoidable.
     var err error
     var om OMsg
-    if len(m.Name) <= 0 || len(m.Name) > NAME_MAX {
-        m.Type = MSG_ERROR_NAME_LEN
+    m.Name = NFC(m.Name)
+    if e := NameError(m.Name); e != 0 {
+        m.Type = e
     } else if exists := cs.NameExists(m.Name); exists {
         m.Type = MSG_ERROR_NAME_EXISTS
     } else if len(cs.Available) == 0 {
@@ -179,6 +323,7 @@ func (cs *Clients) Enter(m *Msg) error {
         if err != nil {
             log.Println(err)
         }
+        cs.Metrics.HandshakeError(m.Type)
         m.Type = MSG_ERROR_INIT
         m.Client.FromServer <- om
         err = errors.New("Error initializing new user.")
@@ -187,10 +332,16 @@ func (cs *Clients) Enter(m *Msg) error {
     m.Client.Key = cs.Available[len(cs.Available) - 1]
     cs.Available = cs.Available[:len(cs.Available) - 1]
     m.Key = m.Client.Key
+    if m.Hz == 0.0 {
+        // Only the bot arrives with a pitch of its own
+        m.Hz = cs.FreePitch()
+    }
+    m.Client.Hz = m.Hz
     om = cs.NewOMsg(m)
     err = m.Client.Writer.Encode(om)
     if err != nil {
         log.Println(err)
+        cs.Metrics.HandshakeError(MSG_ERROR_INIT)
         m.Type = MSG_ERROR_INIT
         m.Client.FromServer <- om
         err = errors.New("Error initializing new user.")
@@ -198,20 +349,94 @@ func (cs *Clients) Enter(m *Msg) error {
     }
     for _, cli := range cs.All {
         if cli != nil {
-            clim := &Msg{MSG_ENTER, cli.On, cli.Key, cli.Hz, cli.Name, nil}
+            clim := &Msg{MSG_ENTER, cli.OnFor(m.Client), cli.Key, cli.Hz,
+                         cli.Name, "", nil}
             om = cs.NewOMsg(clim)
             err = m.Client.Writer.Encode(om)
             if err != nil {
                 log.Println(err)
             }
+            cs.SendPresence(m.Client, cli)
         }
     }
+    cs.SendFloor(m.Client)
     om = cs.NewOMsg(m)
+    m.Client.Active = time.Now()
     cs.All[m.Client.Key] = m.Client
     m.Client.FromServer <- om
     return nil
 }
 
+// Clients.Spectate() is the listen-only counterpart to Clients.Enter(). The
+// spectator is told the room size and the current members, but never receives
+// a key. Spectators are not announced to the room.
+
+func (cs *Clients) Spectate(m *Msg) error {
+    var err error
+    var om OMsg
+    m.Name = NFC(m.Name)
+    if e := NameError(m.Name); e != 0 {
+        m.Type = e
+    } else if len(cs.Spectators) >= SPECTATORS_MAX {
+        m.Type = MSG_ERROR_SPECTATORS_MAX
+    }
+    m.Key = uint8(USERS_MAX)
+    om = cs.NewOMsg(m)
+    err = m.Client.Writer.Encode(om)
+    if err != nil || m.Type != MSG_SPECTATE {
+        if err != nil {
+            log.Println(err)
+        }
+        cs.Metrics.HandshakeError(m.Type)
+        om.Type = MSG_ERROR_INIT
+        m.Client.FromServer <- om
+        err = errors.New("Error initializing new spectator.")
+        return err
+    }
+    for _, cli := range cs.All {
+        if cli != nil {
+            clim := &Msg{MSG_ENTER, cli.OnFor(m.Client), cli.Key, cli.Hz,
+                         cli.Name, "", nil}
+            om = cs.NewOMsg(clim)
+            err = m.Client.Writer.Encode(om)
+            if err != nil {
+                log.Println(err)
+            }
+            cs.SendPresence(m.Client, cli)
+        }
+    }
+    cs.SendFloor(m.Client)
+    om = cs.NewOMsg(m)
+    cs.Spectators = append(cs.Spectators, m.Client)
+    m.Client.FromServer <- om
+    return nil
+}
+
+// Clients.SendFloor() lets a newcomer know who is sending in a room that is
+// under floor control.
+
+func (cs *Clients) SendFloor(cli *Client) {
+    if !cs.Floor.Held {
+        return
+    }
+    fm := cs.FloorMsg()
+    if err := cli.Writer.Encode(cs.NewOMsg(&fm)); err != nil {
+        log.Println(err)
+    }
+}
+
+func (cs *Clients) Unspectate(m *Msg) error {
+    for i, cli := range cs.Spectators {
+        if cli == m.Client {
+            cs.Spectators = append(cs.Spectators[:i], cs.Spectators[i+1:]...)
+            return nil
+        }
+    }
+    err := errors.New("Unknown spectator.")
+    log.Println(err)
+    return err
+}
+
 func (cs *Clients) Leave(m *Msg) error {
     var err error
     if m.Key >= uint8(USERS_MAX) {
@@ -224,43 +449,176 @@ func (cs *Clients) Leave(m *Msg) error {
         log.Println(err)
         return err
     }
+    cs.KeyUp(cs.All[m.Key])
+    cs.ForgetUDP(cs.All[m.Key])
+    cs.Unwhisper(cs.All[m.Key])
     cs.Available = append(cs.Available, cs.All[m.Key].Key)
     cs.All[m.Key] = nil
+    cs.Floor.Dequeue(m.Key)
+    if cs.Floor.Held && cs.Floor.Holder == m.Key {
+        cs.Floor.StopTimer()
+        cs.PassFloor()
+    }
     return nil
 }
 
+// Clients.KeyUp() tallies how long a Client was keying for, if it was.
+
+func (cs *Clients) KeyUp(cli *Client) {
+    if cli.On == 1 {
+        cs.Metrics.AddKeyDown(time.Since(cli.OnSince))
+    }
+}
+
 // The main server loop. Accepts Msgs from connected clients, updates state
 // based upon their contents, and sends updates back to clients as OMsgs.
 
 func (cs *Clients) Listen() {
-    var err error
     var m Msg
     cs.All = make([]*Client, USERS_MAX)
     cs.Available = make([]uint8, USERS_MAX)
     for i, _ := range cs.Available {
         cs.Available[i] = uint8(i)
     }
+    cs.Floor.Init()
+    cs.History.Init()
+    var idle, copying <- chan time.Time
+    if IDLE_TIMEOUT > 0 {
+        idle = time.NewTicker(IDLE_TIMEOUT / IDLE_CHECKS).C
+    }
+    if HISTORY_SPAN > 0 {
+        copying = time.NewTicker(HISTORY_CHECK).C
+    }
     for {
-        m = <- cs.FromClient
-        switch m.Type {
-        case MSG_ON:
-            err = cs.On(&m)
-        case MSG_OFF:
-            err = cs.Off(&m)
-        case MSG_HZ:
-            err = cs.Hz(&m)
-        case MSG_ENTER:
-            err = cs.Enter(&m)
-        case MSG_LEAVE:
-            err = cs.Leave(&m)
+        select {
+        case m = <- cs.FromClient:
+            cs.Route(&m)
+        case now := <- idle:
+            cs.Idle(now)
+        case now := <- copying:
+            cs.History.Tick(now)
+        case <- cs.Floor.Expire:
+            cs.PassFloor()
+        case e := <- cs.Links.FromPeer:
+            cs.HandlePeer(e)
+        case s := <- cs.UDP.Hello:
+            cs.SendUDP(s, nil, 0)
         }
-        if err == nil {
-            om := cs.NewOMsg(&m)
-            for _, cli := range cs.All {
-                if cli != nil {
-                    cli.FromServer <- om
-                }
-            }
+        cs.Metrics.Update(cs)
+    }
+}
+
+// Clients.Route() updates state based upon a single Msg, and passes it along
+// to everyone if nothing went wrong.
+
+func (cs *Clients) Route(m *Msg) {
+    var err error
+    if (m.Type == MSG_ON || m.Type == MSG_OFF) && m.Client != nil &&
+       cs.All[m.Key] != m.Client {
+        // Keying that came over UDP from a user who has since left
+        return
+    }
+    if m.Type != MSG_ENTER && m.Type != MSG_SPECTATE &&
+       m.Type != MSG_LEAVE && int(m.Key) < len(cs.All) &&
+       cs.All[m.Key] != nil &&
+       (m.Client == nil || m.Client == cs.All[m.Key]) {
+        // A spectator's requests don't count for whoever holds their key
+        cs.Active(cs.All[m.Key])
+    }
+    switch m.Type {
+    case MSG_ON:
+        err = cs.On(m)
+    case MSG_OFF:
+        err = cs.Off(m)
+    case MSG_HZ:
+        err = cs.Hz(m)
+    case MSG_FLOOR_REQUEST:
+        err = cs.Request(m)
+    case MSG_UDP:
+        cs.StartUDP(m)
+        return
+    case MSG_WHISPER:
+        cs.Whisper(m)
+        return
+    case MSG_HISTORY:
+        cs.Replay(m)
+        return
+    case MSG_TEXT:
+        err = cs.Text(m)
+    case MSG_PRESENCE:
+        err = cs.Present(m)
+    case MSG_ENTER:
+        err = cs.Enter(m)
+    case MSG_SPECTATE:
+        // Spectators come and go without the room being told
+        cs.Spectate(m)
+        return
+    case MSG_LEAVE:
+        if m.Client != nil && m.Client.Spectator {
+            cs.Unspectate(m)
+            return
         }
+        err = cs.Leave(m)
+    default:
+        err = errors.New("Unknown Msg type.")
+        log.Println(err)
+    }
+    if err == nil {
+        cs.Broadcast(cs.NewOMsg(m))
+    }
+}
+
+// Clients.Broadcast() sends an OMsg to every keyed Client and spectator, and
+// to the audio relay and linked servers if there are any. Keying goes by UDP
+// to those who use it, timed by the Hz of keying that came over UDP, or else
+// as it is sent, and only as far as the one whispered to if the user is
+// whispering.
+
+func (cs *Clients) Broadcast(om OMsg) {
+    keying := om.Type == MSG_ON || om.Type == MSG_OFF
+    at := millis()
+    if keying && om.Hz != 0.0 {
+        at = uint32(om.Hz)
+        om.Hz = 0.0
+    }
+    cs.Metrics.Route(om.Type)
+    if keying && cs.All[om.Key - 1].Whisper != nil {
+        cs.SendWhisper(om, at, cs.All[om.Key - 1])
+        return
+    }
+    when := UDP_EPOCH.Add(time.Duration(at) * time.Millisecond)
+    if cs.Relay != nil {
+        cs.Relay.Hear(om, when)
+    }
+    cs.History.Hear(om, when)
+    cs.Tell(om)
+    for _, cli := range cs.All {
+        if cli == nil || cli.Via != nil {
+            continue
+        }
+        if keying && cli.UDP != nil && cs.SendUDP(cli.UDP, &om, at) {
+            continue
+        }
+        cli.FromServer <- om
+    }
+    for _, cli := range cs.Spectators {
+        cs.ToSpectator(cli, om)
+    }
+}
+
+// Clients.ToSpectator() passes an OMsg to a spectator without waiting, since
+// listening in must never hold up the room. A spectator whose queue has
+// filled is hung up on, and ListenToSpectator() then sees them out as usual.
+
+func (cs *Clients) ToSpectator(cli *Client, om OMsg) {
+    if cli.Behind {
+        return
+    }
+    select {
+    case cli.FromServer <- om:
+    default:
+        log.Println(cli.Conn.RemoteAddr(), "spectator fell behind")
+        cli.Behind = true
+        cli.Conn.Close()
     }
 }
@@ -2,10 +2,150 @@ package main
 
 // Global variables that are referenced by the rest of the program
 
+import (
+    "time"
+)
+
 const (
-    // The maximum username length
+    // The maximum username length, in characters (graphemes), and in bytes
+    // once encoded as UTF-8
     NAME_MAX = 32
+    NAME_BYTES_MAX = 128
+
+    // The longest line of text chat, likewise
+    TEXT_MAX = 200
+    TEXT_BYTES_MAX = 800
+
+    // The number of Msgs that may wait on a channel before its sender blocks
+    QUEUE_LEN = 64
+
+    // The range of pitches a user may choose, as in morse-client
+    FREQ_MIN = 20.0
+    FREQ_MAX = 20000.0
+
+    // The range of speeds a user may say they prefer, as in morse-client,
+    // and the longest status they may give, in characters and bytes
+    WPM_MIN = 5.0
+    WPM_MAX = 60.0
+    STATUS_MAX = 60
+    STATUS_BYTES_MAX = 240
+
+    // How many times per IDLE_TIMEOUT users are checked for idleness
+    IDLE_CHECKS = 10
+
+    // How many events the room's history holds at most, and how often it
+    // checks for keying to copy, which is done after HISTORY_COPY_GAP of
+    // silence, as the practice bot does
+    HISTORY_MAX = 20000
+    HISTORY_CHECK = 100 * time.Millisecond
+    HISTORY_COPY_GAP = 2 * time.Second
+
+    // How the practice bot paces itself. It tries each word BOT_TRIES times,
+    // waits BOT_PATIENCE for an answer each time, and considers an answer
+    // finished after BOT_ANSWER_GAP of silence. It rests for BOT_PAUSE
+    // between words.
+    BOT_TRIES = 3
+    BOT_PATIENCE = 30 * time.Second
+    BOT_ANSWER_GAP = 2 * time.Second
+    BOT_PAUSE = 3 * time.Second
+
+    // How the audio relay renders the room: samples per second, samples per
+    // chunk sent to listeners, and the length of its sine wavetable, as in
+    // morse-client. It runs STREAM_DELAY behind real time, and listeners may
+    // fall STREAM_QUEUE chunks behind before they are cut off.
+    STREAM_RATE = 48000
+    STREAM_CHUNK = STREAM_RATE / 50
+    WAVELEN = 4096
+    STREAM_DELAY = 100 * time.Millisecond
+    STREAM_QUEUE = 50
+
+    // How long to wait before dialing a dropped link again, how many
+    // LinkMsgs may wait for a slow link before it is cut off, and how many
+    // nodes a user may be passed through
+    LINK_RETRY = 10 * time.Second
+    LINK_QUEUE = 1024
+    LINK_PATH_MAX = 16
+
+    // How many of the latest transitions each keying datagram repeats, how
+    // many times it is sent again in case it is lost, how far apart, and the
+    // largest datagram read
+    UDP_REDUNDANCY = 4
+    UDP_RESENDS = 2
+    UDP_RESEND = 20 * time.Millisecond
+    UDP_PACKET_MAX = 512
+
 )
 
 // The maximum number of connected users, specified by os.Args[2]
 var USERS_MAX int
+
+// The maximum number of listen-only connections, specified by -spectators
+var SPECTATORS_MAX int
+
+// How long a floor holder may stay silent before the floor passes on. Floor
+// control is off when this is zero. Specified by -floor
+var FLOOR_TIMEOUT time.Duration
+
+// The name of the room, used when reporting on it. Specified by -room
+var ROOM_NAME string
+
+// Text chat is refused when this is set, for rooms kept to CW. Specified by
+// -no-text
+var TEXT_OFF bool
+
+// How long a user may do nothing before they are marked idle. Nobody is when
+// this is zero. Specified by -idle
+var IDLE_TIMEOUT time.Duration
+
+// How far back the room's history goes for those who arrive late. No history
+// is kept when this is zero. Specified by -history
+var HISTORY_SPAN time.Duration
+
+// Where to serve /metrics and /status. Nothing is served if this is empty.
+// Specified by -http
+var HTTP_ADDR string
+
+// Where to serve the room's audio. There is no relay if this is empty.
+// Specified by -stream
+var STREAM_ADDR string
+
+// Where to take keying over UDP. Keying only goes by TCP if this is empty.
+// Specified by -udp
+var UDP_ADDR string
+
+// The server's clock for keying over UDP counts milliseconds from here
+var UDP_EPOCH = time.Now()
+
+// Flood protection thresholds. Keying (MSG_ON/MSG_OFF), text chat and other
+// requests (MSG_HZ and the like) are metered separately, in Msgs per second.
+// Specified by -key-rate, -key-burst, -text-rate, -text-burst, -hz-rate and
+// -hz-burst
+var KEY_RATE, KEY_BURST, TEXT_RATE, TEXT_BURST, HZ_RATE, HZ_BURST float64
+
+// Dropped Msgs before a client is muted, and again before it is kicked, along
+// with how long a mute lasts. Specified by -strikes and -mute
+var STRIKES_MAX int
+var MUTE_TIME time.Duration
+
+// Connection attempts allowed per IP per minute, and how many may arrive at
+// once. Specified by -conn-rate and -conn-burst
+var CONN_RATE, CONN_BURST float64
+
+// The practice bot's name, which enables it, along with its student, speeds,
+// pitch and list of words. Specified by -bot, -bot-student, -bot-wpm,
+// -bot-fwpm, -bot-hz and -bot-words
+var BOT_NAME, BOT_STUDENT, BOT_WORDS_FILE string
+var BOT_WPM, BOT_FARNSWORTH_WPM, BOT_HZ float64
+
+// The band newcomers' pitches are picked from, how far apart pitches ought to
+// be, and whether a user who chooses one too close to somebody else's is
+// allowed it, warned, or nudged clear. Specified by -pitch-low, -pitch-high,
+// -pitch-spacing and -pitch-policy
+var PITCH_LOW, PITCH_HIGH, PITCH_SPACING float64
+var PITCH_POLICY string
+
+// This server's name among linked servers, the servers to link to, and the
+// secret that linked servers share. Links are refused without a secret.
+// Specified by -node, -link and -link-secret
+var NODE_NAME, LINK_SECRET string
+var LINKS []string
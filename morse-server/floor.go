@@ -0,0 +1,152 @@
+package main
+
+// Optional half-duplex room discipline, much like a net control station.
+// When FLOOR_TIMEOUT is set, only one user may key at a time. Everyone else's
+// keying is suppressed by Clients until the floor is passed along.
+
+import (
+    "errors"
+    "time"
+)
+
+// The Floor type tracks who currently holds the floor. The first MSG_ON in an
+// open room takes it, and it is kept until its holder has been silent for
+// FLOOR_TIMEOUT. Users who ask to send are queued in order of request, and
+// the floor passes to the head of the Queue when the holder falls silent.
+// Expire is nil when floor control is off, which blocks forever in a select.
+
+type Floor struct {
+    Held bool
+    Holder uint8
+    Queue []uint8
+    Timer *time.Timer
+    Expire <-chan time.Time
+}
+
+func (f *Floor) Init() {
+    if FLOOR_TIMEOUT <= 0 {
+        return
+    }
+    f.Timer = time.NewTimer(FLOOR_TIMEOUT)
+    f.StopTimer()
+    f.Expire = f.Timer.C
+}
+
+func (f *Floor) StartTimer() {
+    f.StopTimer()
+    f.Timer.Reset(FLOOR_TIMEOUT)
+}
+
+func (f *Floor) StopTimer() {
+    if !f.Timer.Stop() {
+        select {
+        case <- f.Timer.C:
+        default:
+        }
+    }
+}
+
+func (f *Floor) Dequeue(key uint8) {
+    for i, k := range f.Queue {
+        if k == key {
+            f.Queue = append(f.Queue[:i], f.Queue[i+1:]...)
+            return
+        }
+    }
+}
+
+func (f *Floor) Queued(key uint8) bool {
+    for _, k := range f.Queue {
+        if k == key {
+            return true
+        }
+    }
+    return false
+}
+
+// Clients.FloorMsg() describes the current state of the floor. The holder is
+// addressed by Msg.Key, with Msg.On set. An open floor has neither.
+
+func (cs *Clients) FloorMsg() Msg {
+    if cs.Floor.Held {
+        return Msg{Type: MSG_FLOOR, On: 1, Key: cs.Floor.Holder}
+    }
+    return Msg{Type: MSG_FLOOR, Key: uint8(USERS_MAX)}
+}
+
+// Clients.TakeFloor() is consulted on every MSG_ON but a whisper's. It returns
+// an error if somebody else holds the floor, in which case the Msg goes no
+// further.
+
+func (cs *Clients) TakeFloor(key uint8) error {
+    f := &cs.Floor
+    if FLOOR_TIMEOUT <= 0 {
+        return nil
+    }
+    if f.Held && f.Holder != key {
+        return errors.New("Floor is held by another user.")
+    }
+    f.StopTimer()
+    if !f.Held {
+        f.Held = true
+        f.Holder = key
+        f.Dequeue(key)
+        m := cs.FloorMsg()
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+    return nil
+}
+
+// Clients.ReleaseFloor() starts the silence countdown once the holder stops
+// keying.
+
+func (cs *Clients) ReleaseFloor(key uint8) {
+    f := &cs.Floor
+    if FLOOR_TIMEOUT > 0 && f.Held && f.Holder == key {
+        f.StartTimer()
+    }
+}
+
+// Clients.PassFloor() is called when the holder's silence runs out, or when
+// the holder leaves. The floor goes to the next user in the Queue, who then
+// has FLOOR_TIMEOUT to begin keying before it moves on again.
+
+func (cs *Clients) PassFloor() {
+    f := &cs.Floor
+    f.Held = false
+    for len(f.Queue) > 0 {
+        key := f.Queue[0]
+        f.Queue = f.Queue[1:]
+        if cs.All[key] != nil {
+            f.Held = true
+            f.Holder = key
+            f.StartTimer()
+            break
+        }
+    }
+    m := cs.FloorMsg()
+    cs.Broadcast(cs.NewOMsg(&m))
+}
+
+// A MSG_FLOOR_REQUEST is granted immediately in an open room, in which case
+// the Msg is rewritten to announce the new holder. Otherwise the user is
+// queued and the request itself is announced.
+
+func (cs *Clients) Request(m *Msg) error {
+    f := &cs.Floor
+    if FLOOR_TIMEOUT <= 0 {
+        return errors.New("Floor control is off.")
+    }
+    if (f.Held && f.Holder == m.Key) || f.Queued(m.Key) {
+        return errors.New("Floor already requested.")
+    }
+    if !f.Held {
+        f.Held = true
+        f.Holder = m.Key
+        f.StartTimer()
+        *m = cs.FloorMsg()
+        return nil
+    }
+    f.Queue = append(f.Queue, m.Key)
+    return nil
+}
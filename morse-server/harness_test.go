@@ -0,0 +1,618 @@
+package main
+
+// A harness that runs the whole server in-process and puts it through its
+// paces, for confidence when changing how Msgs are routed. Each scenario in
+// scenario_test.go starts a fresh Clients hub and has headless users connect
+// to it through a Proxy that impairs their connections. The users enter, key
+// and leave as the scenario says, and every one of them must end up seeing
+// the room just as the hub does, without having been sent anything out of
+// order on the way: keying from a key nobody holds, two MSG_ONs in a row, a
+// departure by somebody who never arrived, and so on. Impair the network
+// with:
+//
+//     go test -args -test-latency 80ms -test-loss 0.05
+//
+// The server's own logging is silenced meanwhile.
+
+import (
+    "encoding/gob"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "log"
+    "math/rand"
+    "net"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+const (
+    // The impairing proxy reads TEST_CHUNK bytes at most at a time, and as
+    // many as TEST_QUEUE chunks wait to be written. A lost chunk costs
+    // TEST_RTO, doubled each time it is lost again, as TCP's retransmissions
+    // do. Users must agree with the hub within TEST_SETTLE, checked every
+    // TEST_POLL, key TEST_ELEMENTS elements at a time and say TEST_LINES
+    // lines of text. They are marked idle after TEST_IDLE, send Morse at
+    // TEST_WPM, and the room keeps TEST_HISTORY of history.
+    TEST_CHUNK = 4096
+    TEST_QUEUE = 1024
+    TEST_RTO = 200 * time.Millisecond
+    TEST_SETTLE = 30 * time.Second
+    TEST_POLL = 20 * time.Millisecond
+    TEST_ELEMENTS = 20
+    TEST_LINES = 3
+    TEST_IDLE = 2 * time.Second
+    TEST_WPM = 10.0
+    TEST_HISTORY = time.Minute
+)
+
+// Users in each scenario, and how their connections are impaired.
+// Specified by -test-users, -test-latency, -test-jitter, -test-loss and
+// -test-bandwidth, after go test's -args
+var TEST_USERS int
+var TEST_IMPAIRMENT Impairment
+
+func init() {
+    flag.IntVar(&TEST_USERS, "test-users", 8, "users in each scenario")
+    flag.DurationVar(&TEST_IMPAIRMENT.Latency, "test-latency", 0,
+                     "scenario latency")
+    flag.DurationVar(&TEST_IMPAIRMENT.Jitter, "test-jitter", 0,
+                     "scenario jitter")
+    flag.Float64Var(&TEST_IMPAIRMENT.Loss, "test-loss", 0.0,
+                    "scenario loss, 0.0 to 1.0")
+    flag.IntVar(&TEST_IMPAIRMENT.Bandwidth, "test-bandwidth", 0,
+                "scenario bytes per second")
+}
+
+// TestMain() checks the flags, then readies the server for the scenarios.
+// Every connection comes from the Proxy, so none are refused for arriving
+// too often, the room has space for everyone the scenarios bring, users go
+// idle quickly enough to be seen to, history is kept, and other nodes may
+// link to the hub as node alpha.
+
+func TestMain(m *testing.M) {
+    flag.Parse()
+    imp := TEST_IMPAIRMENT
+    if TEST_USERS < 2 || TEST_USERS > 100 || imp.Latency < 0 ||
+       imp.Jitter < 0 || imp.Loss < 0.0 || imp.Loss >= 1.0 ||
+       imp.Bandwidth < 0 {
+        log.Fatal("Invalid scenario users or impairment.")
+    }
+    log.SetOutput(io.Discard)
+    USERS_MAX = min(TEST_USERS * 2 + 3, 254)
+    CONN_RATE, CONN_BURST = 1e6, 1e6
+    IDLE_TIMEOUT = TEST_IDLE
+    HISTORY_SPAN = TEST_HISTORY
+    NODE_NAME, LINK_SECRET = "alpha", "sesame"
+    os.Exit(m.Run())
+}
+
+// A Headless user speaks to the server as morse-client does, without the
+// sound or the curses. It keeps its own view of the room from what it is
+// sent, along with the arrivals and departures it has seen, as "+name" and
+// "-name", how many times it has heard each name key down, the text it has
+// been sent by each name, who it is whispering to, and every history it has
+// been sent. Anything it is sent that makes no sense is noted in Faults. Gone
+// is set once it has left, so that its connection closing is not taken for a
+// fault.
+
+type Headless struct {
+    sync.Mutex
+    Name string
+    Key uint8
+    Conn net.Conn
+    Writer *gob.Encoder
+    Room map[uint8]Member
+    Changes []string
+    Keyed map[string]int
+    Said map[string][]string
+    Whispering string
+    Histories [][]Past
+    Faults []string
+    Gone bool
+}
+
+// Dial() enters a user through the same handshake as morse-client: the room
+// size comes first, then the user's own key and pitch.
+
+func Dial(addr string, name string) (*Headless, error) {
+    c, err := net.Dial("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    u := &Headless{Name: name, Conn: c, Writer: gob.NewEncoder(c),
+                   Room: make(map[uint8]Member), Keyed: make(map[string]int),
+                   Said: make(map[string][]string)}
+    r := gob.NewDecoder(c)
+    if err := u.Writer.Encode(OMsg{Type: MSG_ENTER, Name: name}); err != nil {
+        c.Close()
+        return nil, err
+    }
+    var om OMsg
+    for i := 0; i < 2; i++ {
+        om = OMsg{}
+        if err := r.Decode(&om); err != nil {
+            c.Close()
+            return nil, err
+        }
+        if om.Type != MSG_ENTER {
+            c.Close()
+            return nil, fmt.Errorf("%s was refused with Msg type %d.", name,
+                                   om.Type)
+        }
+    }
+    u.Key = om.Key - 1
+    u.Apply(om)
+    go u.Read(r)
+    return u, nil
+}
+
+func (u *Headless) Read(r *gob.Decoder) {
+    for {
+        var om OMsg
+        if err := r.Decode(&om); err != nil {
+            u.Lock()
+            if !u.Gone {
+                u.Gone = true
+                u.Fault("was disconnected: %v", err)
+            }
+            u.Unlock()
+            return
+        }
+        u.Lock()
+        u.Apply(om)
+        u.Unlock()
+    }
+}
+
+func (u *Headless) Fault(format string, a ...interface{}) {
+    u.Faults = append(u.Faults, u.Name + " " + fmt.Sprintf(format, a...))
+}
+
+// Headless.Apply() follows an OMsg, undoing the + 1 that was added to its On
+// and Key for gob. A user is told of their own arrival more than once, which
+// does no harm.
+
+func (u *Headless) Apply(om OMsg) {
+    key := om.Key - 1
+    m, present := u.Room[key]
+    switch om.Type {
+    case MSG_ENTER:
+        if present && m.Name == om.Name {
+            return
+        } else if present {
+            u.Fault("saw %s enter on the key of %s, who never left", om.Name,
+                    m.Name)
+        }
+        u.Room[key] = Member{Name: om.Name, Key: key, Hz: om.Hz,
+                             On: om.On - 1 == 1}
+        u.Changes = append(u.Changes, "+" + om.Name)
+    case MSG_LEAVE:
+        if !present {
+            u.Fault("saw key %d leave without entering", key)
+            return
+        }
+        delete(u.Room, key)
+        u.Changes = append(u.Changes, "-" + m.Name)
+    case MSG_HZ:
+        if present {
+            m.Hz = om.Hz
+            u.Room[key] = m
+        }
+    case MSG_ON, MSG_OFF:
+        on := om.Type == MSG_ON
+        if !present {
+            u.Fault("heard keying from key %d, which nobody holds", key)
+            return
+        } else if m.On == on {
+            u.Fault("heard %s key %s twice in a row", m.Name,
+                    msgName(om.Type))
+        }
+        m.On = on
+        u.Room[key] = m
+        if on {
+            u.Keyed[m.Name]++
+        }
+    case MSG_WHISPER:
+        if key == u.Key && om.On - 1 == 1 {
+            u.Whispering = om.Name
+        } else if key == u.Key {
+            u.Whispering = ""
+        }
+    case MSG_PRESENCE:
+        if !present {
+            u.Fault("was sent the presence of key %d, which nobody holds",
+                    key)
+            return
+        }
+        m.Presence = Presence{om.On - 1, om.Hz, om.Name, om.Text}
+        m.Away = m.Presence.Away()
+        u.Room[key] = m
+    case MSG_TEXT:
+        if om.On - 1 != 1 {
+            u.Fault("was refused text")
+        } else if !present || m.Name != om.Name {
+            u.Fault("was sent text from key %d as %s", key, om.Name)
+        } else {
+            u.Said[om.Name] = append(u.Said[om.Name], om.Text)
+        }
+    case MSG_HISTORY:
+        var ps []Past
+        if err := json.Unmarshal([]byte(om.Text), &ps); err != nil {
+            u.Fault("was sent a history it could not read: %v", err)
+            return
+        }
+        u.Histories = append(u.Histories, ps)
+    }
+}
+
+// Headless.Send() sends a Msg of the given type, as morse-client would.
+
+func (u *Headless) Send(t uint8) error {
+    return u.Writer.Encode(OMsg{Type: t, On: 1, Key: u.Key + 1})
+}
+
+// Headless.Whisper() asks to whisper to the named user, or to nobody.
+
+func (u *Headless) Whisper(name string) error {
+    return u.Writer.Encode(OMsg{Type: MSG_WHISPER, On: 1, Key: u.Key + 1,
+                                Name: name})
+}
+
+// Headless.Say() sends a line of text chat.
+
+func (u *Headless) Say(text string) error {
+    return u.Writer.Encode(OMsg{Type: MSG_TEXT, On: 1, Key: u.Key + 1,
+                                Text: text})
+}
+
+// Headless.Publish() sends the user's presence.
+
+func (u *Headless) Publish(p Presence) error {
+    return u.Writer.Encode(OMsg{Type: MSG_PRESENCE, On: p.State + 1,
+                                Key: u.Key + 1, Hz: p.WPM, Name: p.Skill,
+                                Text: p.Status})
+}
+
+// Headless.Morse() keys text at the given timing.
+
+func (u *Headless) Morse(text string, t Timing) error {
+    for i, word := range strings.Fields(text) {
+        if i > 0 {
+            time.Sleep(t.Word)
+        }
+        for j, ch := range word {
+            if j > 0 {
+                time.Sleep(t.Char)
+            }
+            for e, el := range MORSE[ch] {
+                if e > 0 {
+                    time.Sleep(t.Element)
+                }
+                d := t.Dit
+                if el == '-' {
+                    d = t.Dah
+                }
+                if err := u.Element(d); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    return nil
+}
+
+// Headless.Recall() asks for the room's history, its keying or its text, and
+// waits to be sent it.
+
+func (u *Headless) Recall(keying bool) ([]Past, error) {
+    u.Lock()
+    n := len(u.Histories)
+    u.Unlock()
+    m := OMsg{Type: MSG_HISTORY, On: 1, Key: u.Key + 1,
+              Hz: TEST_HISTORY.Minutes()}
+    if keying {
+        m.On = 2
+    }
+    if err := u.Writer.Encode(m); err != nil {
+        return nil, err
+    }
+    var ps []Past
+    err := await(func() error {
+        u.Lock()
+        defer u.Unlock()
+        if len(u.Histories) == n {
+            return fmt.Errorf("%s was never sent the history.", u.Name)
+        }
+        ps = u.Histories[n]
+        return nil
+    })
+    return ps, err
+}
+
+func (u *Headless) Lines(name string) []string {
+    u.Lock()
+    defer u.Unlock()
+    return append([]string{}, u.Said[name]...)
+}
+
+func (u *Headless) WhisperingTo() string {
+    u.Lock()
+    defer u.Unlock()
+    return u.Whispering
+}
+
+// Headless.Element() keys down for the given time, then up.
+
+func (u *Headless) Element(d time.Duration) error {
+    if err := u.Send(MSG_ON); err != nil {
+        return err
+    }
+    time.Sleep(d)
+    return u.Send(MSG_OFF)
+}
+
+// Headless.Leave() hangs up, as morse-client does on /quit, whether or not
+// the user is keying.
+
+func (u *Headless) Leave() {
+    u.Lock()
+    u.Gone = true
+    u.Unlock()
+    u.Conn.Close()
+}
+
+// Headless.View() is the room as the user sees it, in order of key.
+
+func (u *Headless) View() []Member {
+    u.Lock()
+    defer u.Unlock()
+    view := []Member{}
+    for _, m := range u.Room {
+        view = append(view, m)
+    }
+    sort.Slice(view, func(i, j int) bool { return view[i].Key < view[j].Key })
+    return view
+}
+
+// Headless.Since() is the arrivals and departures seen after the first n.
+
+func (u *Headless) Since(n int) []string {
+    u.Lock()
+    defer u.Unlock()
+    return append([]string{}, u.Changes[n:]...)
+}
+
+func (u *Headless) Seen() int {
+    u.Lock()
+    defer u.Unlock()
+    return len(u.Changes)
+}
+
+func (u *Headless) Heard(name string) int {
+    u.Lock()
+    defer u.Unlock()
+    return u.Keyed[name]
+}
+
+func describe(room []Member) string {
+    s := []string{}
+    for _, m := range room {
+        s = append(s, fmt.Sprintf("%d:%s@%.0fHz", m.Key, m.Name, m.Hz))
+        if m.On {
+            s[len(s) - 1] += "(on)"
+        }
+        if m.Presence != (Presence{}) {
+            s[len(s) - 1] += fmt.Sprintf("{%d %.0fwpm %s %q}", m.State,
+                                         m.WPM, m.Skill, m.Status)
+        }
+    }
+    return "[" + strings.Join(s, " ") + "]"
+}
+
+// A Harness is one hub, one Proxy in front of it, and the users who have
+// connected through it.
+
+type Harness struct {
+    sync.Mutex
+    Clients *Clients
+    Listener net.Listener
+    Proxy *Proxy
+    Users []*Headless
+}
+
+func NewHarness(imp Impairment) (*Harness, error) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    p, err := NewProxy(l.Addr().String(), imp)
+    if err != nil {
+        l.Close()
+        return nil, err
+    }
+    cs := NewClients()
+    go cs.Listen()
+    go cs.Serve(l)
+    return &Harness{Clients: cs, Listener: l, Proxy: p}, nil
+}
+
+// Harness.Close() sends everyone home and stops accepting connections. The
+// hub is left idle rather than stopped, which is no matter in a test.
+
+func (h *Harness) Close() {
+    for _, u := range h.Present() {
+        u.Leave()
+    }
+    h.Proxy.Listener.Close()
+    h.Listener.Close()
+}
+
+func (h *Harness) Join(name string) (*Headless, error) {
+    u, err := Dial(h.Proxy.Addr(), name)
+    if err != nil {
+        return nil, err
+    }
+    h.Lock()
+    h.Users = append(h.Users, u)
+    h.Unlock()
+    return u, nil
+}
+
+// Harness.JoinAll() enters n users at once, named after the given prefix.
+
+func (h *Harness) JoinAll(prefix string, n int) ([]*Headless, error) {
+    users := make([]*Headless, n)
+    errs := make([]error, n)
+    var wg sync.WaitGroup
+    for i := 0; i < n; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            users[i], errs[i] = h.Join(fmt.Sprintf("%s%d", prefix, i + 1))
+        }(i)
+    }
+    wg.Wait()
+    return users, errors.Join(errs...)
+}
+
+// Harness.Present() is everyone who has yet to leave.
+
+func (h *Harness) Present() []*Headless {
+    h.Lock()
+    defer h.Unlock()
+    present := []*Headless{}
+    for _, u := range h.Users {
+        u.Lock()
+        if !u.Gone {
+            present = append(present, u)
+        }
+        u.Unlock()
+    }
+    return present
+}
+
+// Harness.Agree() checks that the room is made up of the users who are
+// present, and that every one of them sees it just as the hub does.
+
+func (h *Harness) Agree() error {
+    mt := h.Clients.Metrics
+    mt.Lock()
+    room := append([]Member{}, mt.Members...)
+    mt.Unlock()
+    present := h.Present()
+    names := map[string]bool{}
+    for _, m := range room {
+        names[m.Name] = true
+    }
+    if len(room) != len(present) {
+        return fmt.Errorf("The hub has %d users in the room, not %d.",
+                          len(room), len(present))
+    }
+    for _, u := range present {
+        if !names[u.Name] {
+            return fmt.Errorf("%s is missing from the room.", u.Name)
+        }
+        if view := u.View(); describe(view) != describe(room) {
+            return fmt.Errorf("%s sees %s, but the room is %s.", u.Name,
+                              describe(view), describe(room))
+        }
+    }
+    return nil
+}
+
+// Harness.Silent() checks that nobody is keying, as the hub sees it and as
+// every user hears it.
+
+func (h *Harness) Silent() error {
+    for _, u := range h.Present() {
+        for _, m := range u.View() {
+            if m.On {
+                return fmt.Errorf("%s hears a stuck tone from %s.", u.Name,
+                                  m.Name)
+            }
+        }
+    }
+    return nil
+}
+
+// Harness.Settle() waits for the room to agree and fall silent.
+
+func (h *Harness) Settle() error {
+    return await(func() error {
+        if err := h.Agree(); err != nil {
+            return err
+        }
+        return h.Silent()
+    })
+}
+
+// Harness.Faults() gathers whatever every user noted, gone or not. Only the
+// first few are worth reading.
+
+func (h *Harness) Faults() error {
+    h.Lock()
+    defer h.Unlock()
+    faults := []string{}
+    for _, u := range h.Users {
+        u.Lock()
+        faults = append(faults, u.Faults...)
+        u.Unlock()
+    }
+    if len(faults) == 0 {
+        return nil
+    } else if len(faults) > 5 {
+        faults = append(faults[:5], fmt.Sprintf("and %d more",
+                                                len(faults) - 5))
+    }
+    return errors.New(strings.Join(faults, "; "))
+}
+
+// await() retries cond until it succeeds or TEST_SETTLE runs out, returning
+// its last error.
+
+func await(cond func() error) error {
+    deadline := time.Now().Add(TEST_SETTLE)
+    for {
+        err := cond()
+        if err == nil || time.Now().After(deadline) {
+            return err
+        }
+        time.Sleep(TEST_POLL)
+    }
+}
+
+// sameOrder() checks that everyone saw the same arrivals and departures, in
+// the same order, after the marks taken when they were all present.
+
+func sameOrder(users []*Headless, marks []int) error {
+    first := users[0].Since(marks[0])
+    for i, u := range users[1:] {
+        seen := u.Since(marks[i + 1])
+        if strings.Join(seen, " ") != strings.Join(first, " ") {
+            return fmt.Errorf("%s saw %v, but %s saw %v.", users[0].Name,
+                              first, u.Name, seen)
+        }
+    }
+    return nil
+}
+
+func marks(users []*Headless) []int {
+    ms := make([]int, len(users))
+    for i, u := range users {
+        ms[i] = u.Seen()
+    }
+    return ms
+}
+
+// element() is a random length of dit or dah between 20 and 25 wpm.
+
+func element() time.Duration {
+    return time.Duration(48 + rand.Intn(100)) * time.Millisecond
+}
@@ -0,0 +1,186 @@
+package main
+
+// A record of what the room has heard lately, for those who arrive in the
+// middle of a net. The History keeps the latest HISTORY_MAX events in a ring:
+// every key down and key up that the whole room heard, with the sender's name
+// and pitch at the time, and every line of text, whether chatted or copied
+// from keying by the server itself. Keying is copied much as the practice bot
+// copies its student, a line at a time whenever the sender pauses. Whispers
+// are never recorded.
+//
+// A user or spectator asks for the last so many minutes with a MSG_HISTORY,
+// whose Hz is the minutes and whose On is 1 for the keying, to be replayed,
+// or 0 for the text. They alone are answered with a MSG_HISTORY whose On is
+// the same, whose Hz is how many minutes the server keeps, 0 if it keeps
+// none, and whose Text is a JSON list of Pasts, oldest first.
+
+import (
+    "encoding/json"
+    "log"
+    "sort"
+    "time"
+)
+
+// An Event is one key down or up, or one line of text if Text is set.
+
+type Event struct {
+    At time.Time
+    Name string
+    Hz float64
+    On bool
+    Text string
+    Chat bool
+}
+
+// A Past is an Event as a client is sent it, timed in seconds before the
+// MSG_HISTORY that asked for it.
+
+type Past struct {
+    Ago float64 `json:"ago"`
+    Name string `json:"name"`
+    Hz float64 `json:"hz,omitempty"`
+    On bool `json:"on,omitempty"`
+    Text string `json:"text,omitempty"`
+    Chat bool `json:"chat,omitempty"`
+}
+
+// The History belongs to the Clients' thread. Events is the ring, whose
+// oldest Event is at Next once it is Full. Names, Pitches and Copy follow
+// each key. There is no History, and Events is nil, if HISTORY_SPAN is zero.
+
+type History struct {
+    Events []Event
+    Next int
+    Full bool
+    Names []string
+    Pitches []float64
+    Copy []Recorder
+}
+
+func (h *History) Init() {
+    if HISTORY_SPAN == 0 {
+        return
+    }
+    h.Events = make([]Event, HISTORY_MAX)
+    h.Names = make([]string, USERS_MAX)
+    h.Pitches = make([]float64, USERS_MAX)
+    h.Copy = make([]Recorder, USERS_MAX)
+}
+
+func (h *History) add(e Event) {
+    h.Events[h.Next] = e
+    h.Next = (h.Next + 1) % len(h.Events)
+    if h.Next == 0 {
+        h.Full = true
+    }
+}
+
+// History.Hear() records an OMsg that the whole room was sent, at the given
+// time.
+
+func (h *History) Hear(om OMsg, at time.Time) {
+    if h.Events == nil {
+        return
+    }
+    key := om.Key - 1
+    switch om.Type {
+    case MSG_ENTER:
+        h.Names[key], h.Pitches[key] = om.Name, om.Hz
+        h.Copy[key] = Recorder{}
+    case MSG_HZ:
+        h.Pitches[key] = om.Hz
+    case MSG_LEAVE:
+        // Whatever they were in the middle of sending is copied as it is
+        h.flush(key)
+        h.Names[key] = ""
+    case MSG_ON, MSG_OFF:
+        on := om.Type == MSG_ON
+        h.add(Event{At: at, Name: h.Names[key], Hz: h.Pitches[key], On: on})
+        h.Copy[key].Key(on, at)
+    case MSG_TEXT:
+        h.add(Event{At: at, Name: om.Name, Text: om.Text, Chat: true})
+    }
+}
+
+// History.Tick() copies the keying of everyone who has paused for long
+// enough to have finished what they were sending.
+
+func (h *History) Tick(now time.Time) {
+    for key, _ := range h.Copy {
+        r := &h.Copy[key]
+        unit := r.Keying.Unit()
+        if idle := r.Idle(now); idle > HISTORY_COPY_GAP && idle > 10 * unit {
+            h.flush(uint8(key))
+        }
+    }
+}
+
+// History.flush() copies whatever a key has sent, stamped with when they
+// began sending it.
+
+func (h *History) flush(key uint8) {
+    r := &h.Copy[key]
+    if len(r.Keying.Marks) == 0 {
+        return
+    }
+    k := r.Take()
+    began := r.Since
+    for _, d := range append(k.Marks, k.Spaces...) {
+        began = began.Add(-d)
+    }
+    h.add(Event{At: began, Name: h.Names[key], Text: k.Decode()})
+}
+
+// History.Since() lists either the keying or the text from t on, oldest
+// first. Copy is only recorded once its sender has finished, and keying that
+// came over UDP is stamped with when it was made, so either may be recorded
+// out of order, which is put right.
+
+func (h *History) Since(t time.Time, keying bool) []Past {
+    ps := []Past{}
+    now := time.Now()
+    start, n := 0, h.Next
+    if h.Full {
+        start, n = h.Next, len(h.Events)
+    }
+    for i := 0; i < n; i++ {
+        e := h.Events[(start + i) % len(h.Events)]
+        if e.At.Before(t) || keying != (e.Text == "") {
+            continue
+        }
+        ps = append(ps, Past{now.Sub(e.At).Seconds(), e.Name, e.Hz, e.On,
+                             e.Text, e.Chat})
+    }
+    sort.SliceStable(ps, func(i, j int) bool { return ps[i].Ago > ps[j].Ago })
+    return ps
+}
+
+// Clients.Replay() answers a MSG_HISTORY. A spectator's comes with their
+// Client, since they hold no key.
+
+func (cs *Clients) Replay(m *Msg) {
+    cli := m.Client
+    if cli == nil {
+        cli = cs.All[m.Key]
+    }
+    if cli == nil || cli.Via != nil {
+        return
+    }
+    hm := Msg{Type: MSG_HISTORY, On: m.On, Key: cli.Key}
+    if cs.History.Events != nil {
+        hm.Hz = HISTORY_SPAN.Minutes()
+        span := time.Duration(min(m.Hz, hm.Hz) * float64(time.Minute))
+        b, err := json.Marshal(cs.History.Since(time.Now().Add(-span),
+                                                m.On == 1))
+        if err != nil {
+            log.Println(err)
+            return
+        }
+        hm.Text = string(b)
+    }
+    if cli.Spectator {
+        cs.ToSpectator(cli, cs.NewOMsg(&hm))
+    } else {
+        cli.FromServer <- cs.NewOMsg(&hm)
+    }
+}
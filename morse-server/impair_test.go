@@ -0,0 +1,124 @@
+package main
+
+// A TCP proxy that impairs connections the way a bad network would, for the
+// scenarios. Every chunk read from one side is held for the latency plus a
+// random share of the jitter before it is written to the other. TCP resends
+// whatever it loses, so a lost chunk costs a retransmission timeout, or
+// several, and holds up everything behind it, which is the head-of-line
+// blocking that real clients suffer. Bandwidth is capped by pausing after
+// each write for as long as the chunk would take to send.
+
+import (
+    "math/rand"
+    "net"
+    "time"
+)
+
+// Loss is the chance, from 0.0 to 1.0, that a chunk is lost, and Bandwidth
+// is in bytes per second. Zero values leave a connection as it is.
+
+type Impairment struct {
+    Latency time.Duration
+    Jitter time.Duration
+    Loss float64
+    Bandwidth int
+}
+
+// Impairment.Delay() is how long one chunk is held up.
+
+func (imp Impairment) Delay() time.Duration {
+    d := imp.Latency
+    if imp.Jitter > 0 {
+        d += time.Duration(rand.Int63n(int64(imp.Jitter)))
+    }
+    for rto := TEST_RTO; rand.Float64() < imp.Loss; rto *= 2 {
+        d += rto
+    }
+    return d
+}
+
+// Impairment.Pipe() copies src to dst until either end fails, then closes
+// both. Chunks are never delivered out of order, however their delays fall.
+
+func (imp Impairment) Pipe(dst net.Conn, src net.Conn) {
+    type chunk struct {
+        Due time.Time
+        Data []byte
+    }
+    chunks := make(chan chunk, TEST_QUEUE)
+    stop := make(chan struct{})
+    defer close(stop)
+    defer src.Close()
+    defer dst.Close()
+    go func() {
+        defer close(chunks)
+        var last time.Time
+        buf := make([]byte, TEST_CHUNK)
+        for {
+            n, err := src.Read(buf)
+            if err != nil {
+                return
+            }
+            due := time.Now().Add(imp.Delay())
+            if due.Before(last) {
+                due = last
+            }
+            last = due
+            select {
+            case chunks <- chunk{due, append([]byte{}, buf[:n]...)}:
+            case <- stop:
+                return
+            }
+        }
+    }()
+    for c := range chunks {
+        time.Sleep(time.Until(c.Due))
+        if _, err := dst.Write(c.Data); err != nil {
+            return
+        }
+        if imp.Bandwidth > 0 {
+            time.Sleep(time.Duration(len(c.Data)) * time.Second /
+                       time.Duration(imp.Bandwidth))
+        }
+    }
+}
+
+// A Proxy passes every connection made to its Listener on to Target.
+
+type Proxy struct {
+    Listener net.Listener
+    Target string
+    Impairment Impairment
+}
+
+func NewProxy(target string, imp Impairment) (*Proxy, error) {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        return nil, err
+    }
+    p := &Proxy{Listener: l, Target: target, Impairment: imp}
+    go p.Run()
+    return p, nil
+}
+
+func (p *Proxy) Addr() string {
+    return p.Listener.Addr().String()
+}
+
+// Proxy.Run() accepts connections until the Listener is closed.
+
+func (p *Proxy) Run() {
+    for {
+        c, err := p.Listener.Accept()
+        if err != nil {
+            return
+        }
+        s, err := net.Dial("tcp", p.Target)
+        if err != nil {
+            c.Close()
+            continue
+        }
+        go p.Impairment.Pipe(s, c)
+        go p.Impairment.Pipe(c, s)
+    }
+}
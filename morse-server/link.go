@@ -0,0 +1,525 @@
+package main
+
+// Server federation. Servers may be linked to one another, so that a club
+// spread across sites can share one net. Each server is a node with a name of
+// its own, and it tells every node it is linked to about each user in its
+// room, whether connected here or heard over another link. Those users are
+// given keys in the other nodes' rooms like anyone else, and appear to their
+// clients as name@node, node being where the user is actually connected.
+//
+// Nodes may be linked in any shape, loops included. Every user carries the
+// Path of nodes it has been passed through, and is never passed to a node
+// that is already on it, nor back over the link it came in on. Where loops
+// give a node more than one route to the same user, the first is used and the
+// rest are kept in reserve. When a link goes down, the users heard over it
+// leave, unless there is a route in reserve to take over. A user who can
+// still be reached some other way is soon introduced again by that route.
+
+import (
+    "crypto/subtle"
+    "encoding/gob"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net"
+    "time"
+)
+
+// A LinkMsg is what linked nodes send one another. Its Key is the user's key
+// in the sender's room. A MSG_ENTER also says where the user is connected,
+// what their key is there, and the Path they took to get here. A MSG_ENTER
+// for a key that is already known updates its Path. The first LinkMsg each
+// way is a MSG_LINK naming the node, along with the shared secret when it is
+// the one dialing. LinkMsgs are always decoded into a fresh value, so unlike
+// Msgs their zeros need no special handling.
+
+type LinkMsg struct {
+    Type uint8
+    On uint8
+    Key uint8
+    Hz float64
+    Name string
+    Text string
+    Origin string
+    OriginKey uint8
+    Path []string
+    Secret string
+}
+
+// A Peer is the node at the other end of a link. Its Remotes are the users it
+// has told this node about, by its own keys.
+
+type Peer struct {
+    Node string
+    Conn net.Conn
+    ToPeer chan LinkMsg
+    Remotes map[uint8]*Remote
+}
+
+// A Remote is a user as heard over one link. The one in use has a Local
+// Client in this room; any others are kept in reserve, with no Local.
+
+type Remote struct {
+    Peer *Peer
+    Key uint8
+    Origin string
+    OriginKey uint8
+    Name string
+    Path []string
+    On uint8
+    Hz float64
+    Presence Presence
+    Local *Client
+}
+
+func (r *Remote) Identity() string {
+    return fmt.Sprintf("%s\x00%d\x00%s", r.Origin, r.OriginKey, r.Name)
+}
+
+// A PeerEvent passes a LinkMsg from a link's goroutine to the Clients'
+// thread. A link coming up or going down is a MSG_LINK, with On set for up.
+
+type PeerEvent struct {
+    Peer *Peer
+    Msg LinkMsg
+}
+
+// The Links type is the Clients' view of the net. Routes holds every Remote
+// by the user it stands for, in the order they were heard. Told holds, by
+// local key, which Peers have been told about each user.
+
+type Links struct {
+    FromPeer chan PeerEvent
+    Peers []*Peer
+    Routes map[string][]*Remote
+    Told []map[*Peer]bool
+}
+
+func NewLinks() Links {
+    l := Links{FromPeer: make(chan PeerEvent, QUEUE_LEN),
+               Routes: make(map[string][]*Remote),
+               Told: make([]map[*Peer]bool, USERS_MAX)}
+    for i, _ := range l.Told {
+        l.Told[i] = make(map[*Peer]bool)
+    }
+    return l
+}
+
+// Clients.Dial() keeps a link to another node up for as long as the server
+// runs, dialing it again LINK_RETRY after it drops.
+
+func (cs *Clients) Dial(addr string) {
+    for {
+        if err := cs.dial(addr); err != nil {
+            log.Println("Link to", addr, "failed:", err)
+        }
+        time.Sleep(LINK_RETRY)
+    }
+}
+
+func (cs *Clients) dial(addr string) error {
+    c, err := net.Dial("tcp", addr)
+    if err != nil {
+        return err
+    }
+    defer c.Close()
+    r := gob.NewDecoder(c)
+    w := gob.NewEncoder(c)
+    // The other node takes this for a client until it sees MSG_LINK
+    if err := w.Encode(OMsg{Type: MSG_LINK}); err != nil {
+        return err
+    }
+    hello := LinkMsg{Type: MSG_LINK, Name: NODE_NAME, Secret: LINK_SECRET}
+    if err := w.Encode(hello); err != nil {
+        return err
+    }
+    var reply LinkMsg
+    if err := r.Decode(&reply); err != nil {
+        return err
+    }
+    if err := checkPeer(reply.Name); err != nil {
+        return err
+    }
+    cs.Link(c, r, w, reply.Name)
+    return nil
+}
+
+// Clients.Accept() answers a link dialed by another node, which must know the
+// secret. Links are refused altogether when there is none.
+
+func (cs *Clients) Accept(c net.Conn, r *gob.Decoder, w *gob.Encoder) {
+    var hello LinkMsg
+    if err := r.Decode(&hello); err != nil {
+        log.Println(c.RemoteAddr(), err)
+        return
+    }
+    secret, want := []byte(hello.Secret), []byte(LINK_SECRET)
+    if LINK_SECRET == "" || subtle.ConstantTimeCompare(secret, want) != 1 {
+        log.Println(c.RemoteAddr(), "refused a link without the secret")
+        return
+    }
+    if err := checkPeer(hello.Name); err != nil {
+        log.Println(c.RemoteAddr(), err)
+        return
+    }
+    if err := w.Encode(LinkMsg{Type: MSG_LINK, Name: NODE_NAME}); err != nil {
+        log.Println(c.RemoteAddr(), err)
+        return
+    }
+    cs.Link(c, r, w, hello.Name)
+}
+
+func checkPeer(node string) error {
+    if node == NODE_NAME {
+        return errors.New("Node is linked to itself.")
+    }
+    if !ValidNode(node) {
+        return errors.New("Invalid node name.")
+    }
+    return nil
+}
+
+// Clients.Link() runs an established link until it drops. LinkMsgs are
+// written from a goroutine of their own, as with Client.ListenToServer().
+
+func (cs *Clients) Link(c net.Conn, r *gob.Decoder, w *gob.Encoder,
+                        node string) {
+    p := &Peer{Node: node, Conn: c, ToPeer: make(chan LinkMsg, LINK_QUEUE),
+               Remotes: make(map[uint8]*Remote)}
+    log.Println("Linked to", node, "at", c.RemoteAddr())
+    go func() {
+        for lm := range p.ToPeer {
+            if err := w.Encode(lm); err != nil {
+                c.Close()
+            }
+        }
+    }()
+    cs.Links.FromPeer <- PeerEvent{p, LinkMsg{Type: MSG_LINK, On: 1}}
+    for {
+        var lm LinkMsg
+        if err := r.Decode(&lm); err != nil {
+            if err != io.EOF {
+                log.Println(c.RemoteAddr(), err)
+            }
+            break
+        }
+        if err := ValidLinkMsg(&lm); err != nil {
+            log.Println(c.RemoteAddr(), err)
+            continue
+        }
+        cs.Links.FromPeer <- PeerEvent{p, lm}
+    }
+    cs.Links.FromPeer <- PeerEvent{p, LinkMsg{Type: MSG_LINK}}
+    log.Println("Link to", node, "is down")
+}
+
+// Peer.Send() never blocks the Clients' thread. A Peer that falls too far
+// behind is cut off, and will have to link again.
+
+func (p *Peer) Send(lm LinkMsg) {
+    select {
+    case p.ToPeer <- lm:
+    default:
+        log.Println("Link to", p.Node, "fell behind")
+        p.Conn.Close()
+    }
+}
+
+// Clients.HandlePeer() is the Clients' thread's side of every link.
+
+func (cs *Clients) HandlePeer(e PeerEvent) {
+    p, lm := e.Peer, e.Msg
+    switch lm.Type {
+    case MSG_LINK:
+        if lm.On == 1 {
+            cs.LinkUp(p)
+        } else {
+            cs.LinkDown(p)
+        }
+    case MSG_ENTER:
+        cs.RemoteEnter(p, &lm)
+    case MSG_ON, MSG_OFF, MSG_HZ, MSG_PRESENCE:
+        cs.RemoteChange(p, &lm)
+    case MSG_TEXT:
+        cs.RemoteText(p, &lm)
+    case MSG_LEAVE:
+        if r := p.Remotes[lm.Key]; r != nil {
+            cs.RemoteLeave(r)
+        }
+    }
+}
+
+// A new Peer is told about everyone in the room that it ought to know of.
+
+func (cs *Clients) LinkUp(p *Peer) {
+    cs.Links.Peers = append(cs.Links.Peers, p)
+    for key, _ := range cs.All {
+        cs.Advertise(uint8(key), false)
+    }
+}
+
+func (cs *Clients) LinkDown(p *Peer) {
+    for i, peer := range cs.Links.Peers {
+        if peer == p {
+            cs.Links.Peers = append(cs.Links.Peers[:i],
+                                    cs.Links.Peers[i+1:]...)
+            break
+        }
+    }
+    for _, told := range cs.Links.Told {
+        delete(told, p)
+    }
+    for _, r := range p.Remotes {
+        cs.RemoteLeave(r)
+    }
+    close(p.ToPeer)
+}
+
+// Clients.introduce() is the MSG_ENTER that passes a user on to other nodes.
+
+func (cs *Clients) introduce(cli *Client) LinkMsg {
+    lm := LinkMsg{Type: MSG_ENTER, On: cli.OnFor(nil), Key: cli.Key,
+                  Hz: cli.Hz, Name: cli.Name, Origin: NODE_NAME,
+                  OriginKey: cli.Key, Path: []string{NODE_NAME}}
+    if r := cli.Via; r != nil {
+        lm.Name, lm.Origin, lm.OriginKey = r.Name, r.Origin, r.OriginKey
+        lm.Path = append(append([]string{}, r.Path...), NODE_NAME)
+    }
+    return lm
+}
+
+// shouldTell() is whether a Peer ought to know about a user: not if the
+// user came from it, or has already passed through it.
+
+func shouldTell(cli *Client, p *Peer) bool {
+    if cli.Via == nil {
+        return true
+    }
+    if cli.Via.Peer == p {
+        return false
+    }
+    for _, node := range cli.Via.Path {
+        if node == p.Node {
+            return false
+        }
+    }
+    return true
+}
+
+// Clients.Advertise() brings every Peer up to date on the user at a key,
+// introducing them where they ought to be known and withdrawing them where
+// they ought not to be, as when they have left. A user whose route has
+// changed is introduced again to those who already know them, so that their
+// Path is kept current.
+
+func (cs *Clients) Advertise(key uint8, rerouted bool) {
+    cli := cs.All[key]
+    told := cs.Links.Told[key]
+    for _, p := range cs.Links.Peers {
+        should := cli != nil && shouldTell(cli, p)
+        switch {
+        case should && (!told[p] || rerouted):
+            told[p] = true
+            p.Send(cs.introduce(cli))
+            if cli.Presence != (Presence{}) {
+                p.Send(presenceLink(key, cli.Presence))
+            }
+        case !should && told[p]:
+            delete(told, p)
+            p.Send(LinkMsg{Type: MSG_LEAVE, Key: key})
+        }
+    }
+}
+
+// Clients.Tell() passes an OMsg about the room on to the Peers. It is called
+// by Clients.Broadcast(), so it sees events from local and remote users
+// alike.
+
+func (cs *Clients) Tell(om OMsg) {
+    key := om.Key - 1
+    if int(key) >= USERS_MAX {
+        return
+    }
+    switch om.Type {
+    case MSG_ENTER, MSG_LEAVE:
+        cs.Advertise(key, false)
+    case MSG_ON, MSG_OFF, MSG_HZ:
+        for p, _ := range cs.Links.Told[key] {
+            p.Send(LinkMsg{Type: om.Type, Key: key, Hz: om.Hz})
+        }
+    case MSG_TEXT:
+        for p, _ := range cs.Links.Told[key] {
+            p.Send(LinkMsg{Type: om.Type, Key: key, Text: om.Text})
+        }
+    case MSG_PRESENCE:
+        for p, _ := range cs.Links.Told[key] {
+            p.Send(presenceLink(key, cs.All[key].Presence))
+        }
+    }
+}
+
+func presenceLink(key uint8, p Presence) LinkMsg {
+    return LinkMsg{Type: MSG_PRESENCE, On: p.State, Key: key, Hz: p.WPM,
+                   Name: p.Skill, Text: p.Status}
+}
+
+// Clients.RemoteEnter() hears of a user from a Peer. Anyone whose Path
+// already includes this node has come round a loop, and is ignored.
+
+func (cs *Clients) RemoteEnter(p *Peer, lm *LinkMsg) {
+    old := p.Remotes[lm.Key]
+    for _, node := range lm.Path {
+        if node == NODE_NAME {
+            if old != nil {
+                cs.RemoteLeave(old)
+            }
+            return
+        }
+    }
+    r := &Remote{Peer: p, Key: lm.Key, Origin: lm.Origin,
+                 OriginKey: lm.OriginKey, Name: lm.Name, Path: lm.Path,
+                 On: lm.On, Hz: lm.Hz}
+    if old != nil {
+        if old.Identity() == r.Identity() {
+            old.Path = r.Path
+            if old.Local != nil {
+                cs.Advertise(old.Local.Key, true)
+            }
+            return
+        }
+        cs.RemoteLeave(old)
+    }
+    p.Remotes[lm.Key] = r
+    id := r.Identity()
+    routes := cs.Links.Routes[id]
+    cs.Links.Routes[id] = append(routes, r)
+    for _, route := range routes {
+        if route.Local != nil {
+            return
+        }
+    }
+    cs.Place(r)
+}
+
+// Clients.Place() gives a Remote a key in this room, if there is one free.
+// Local names never contain an @, but a node could still claim to be another
+// to pass its users off as the other's, so a name already in the room is
+// refused, though the Remote is kept in reserve all the same.
+
+func (cs *Clients) Place(r *Remote) {
+    name := r.Name + "@" + r.Origin
+    if cs.NameExists(name) {
+        log.Println(name, "from", r.Peer.Node, "is already here")
+        return
+    }
+    if len(cs.Available) == 0 {
+        log.Println("No room for", r.Name, "from", r.Origin)
+        return
+    }
+    key := cs.Available[len(cs.Available) - 1]
+    cs.Available = cs.Available[:len(cs.Available) - 1]
+    cli := &Client{On: r.On, Key: key, Hz: r.Hz, Name: name, Via: r,
+                   Presence: r.Presence}
+    if cli.On == 1 {
+        cli.OnSince = time.Now()
+    }
+    r.Local = cli
+    cs.All[key] = cli
+    m := Msg{MSG_ENTER, cli.On, key, cli.Hz, cli.Name, "", nil}
+    cs.Broadcast(cs.NewOMsg(&m))
+    if cli.Presence != (Presence{}) {
+        m = cli.Presence.Msg(key)
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+}
+
+// Clients.RemoteChange() follows a remote user's keying, pitch and presence,
+// passing them on to the room if the Remote is the one in use.
+
+func (cs *Clients) RemoteChange(p *Peer, lm *LinkMsg) {
+    r := p.Remotes[lm.Key]
+    if r == nil {
+        return
+    }
+    switch lm.Type {
+    case MSG_ON:
+        r.On = 1
+    case MSG_OFF:
+        r.On = 0
+    case MSG_HZ:
+        r.Hz = lm.Hz
+    case MSG_PRESENCE:
+        r.Presence = Presence{lm.On, lm.Hz, lm.Name, lm.Text}
+    }
+    if r.Local != nil {
+        cs.Follow(r.Local, r)
+    }
+}
+
+// Clients.Follow() brings a remote user's Client into line with a Remote,
+// telling the room of anything that changed.
+
+func (cs *Clients) Follow(cli *Client, r *Remote) {
+    if cli.Presence != r.Presence {
+        cli.Presence = r.Presence
+        m := cli.Presence.Msg(cli.Key)
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+    if cli.Hz != r.Hz {
+        cli.Hz = r.Hz
+        m := Msg{Type: MSG_HZ, Key: cli.Key, Hz: cli.Hz}
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+    if cli.On != r.On {
+        m := Msg{Type: MSG_OFF, Key: cli.Key}
+        if r.On == 1 {
+            m.Type = MSG_ON
+            cli.OnSince = time.Now()
+        } else {
+            cs.KeyUp(cli)
+        }
+        cli.On = r.On
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+}
+
+// Clients.RemoteLeave() forgets a Remote. If it was in use, the shortest of
+// any others kept in reserve takes over. Otherwise the user leaves the room.
+
+func (cs *Clients) RemoteLeave(r *Remote) {
+    delete(r.Peer.Remotes, r.Key)
+    id := r.Identity()
+    var next *Remote
+    routes := cs.Links.Routes[id][:0]
+    for _, route := range cs.Links.Routes[id] {
+        if route == r {
+            continue
+        }
+        routes = append(routes, route)
+        if next == nil || len(route.Path) < len(next.Path) {
+            next = route
+        }
+    }
+    if len(routes) == 0 {
+        delete(cs.Links.Routes, id)
+    } else {
+        cs.Links.Routes[id] = routes
+    }
+    cli := r.Local
+    if cli == nil {
+        return
+    }
+    r.Local = nil
+    if next != nil {
+        next.Local = cli
+        cli.Via = next
+        cs.Follow(cli, next)
+        cs.Advertise(cli.Key, true)
+        return
+    }
+    m := Msg{Type: MSG_LEAVE, Key: cli.Key}
+    if cs.Leave(&m) == nil {
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+}
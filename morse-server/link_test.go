@@ -0,0 +1,226 @@
+package main
+
+// Only one node can run in a process, so linked servers are tried out on a
+// single hub, node alpha, and two FakeNodes, bravo and charlie, that link to
+// it. Taking bravo and charlie to be linked to one another as well makes a
+// triangle. The FakeNodes speak the link protocol by hand, so that a test can
+// say exactly what reaches the hub by each route, and see what the hub
+// passes on.
+
+import (
+    "encoding/gob"
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "strings"
+    "sync"
+    "testing"
+)
+
+// A FakeNode keeps every LinkMsg the hub sends it in Heard.
+
+type FakeNode struct {
+    sync.Mutex
+    Name string
+    Conn net.Conn
+    Writer *gob.Encoder
+    Heard []LinkMsg
+}
+
+// LinkTo() links a FakeNode to the hub, dialing it as Clients.dial() does.
+
+func LinkTo(addr string, node string) (*FakeNode, error) {
+    c, err := net.Dial("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    n := &FakeNode{Name: node, Conn: c, Writer: gob.NewEncoder(c)}
+    r := gob.NewDecoder(c)
+    hello := LinkMsg{Type: MSG_LINK, Name: node, Secret: LINK_SECRET}
+    if err := n.Writer.Encode(OMsg{Type: MSG_LINK}); err != nil {
+        c.Close()
+        return nil, err
+    }
+    if err := n.Writer.Encode(hello); err != nil {
+        c.Close()
+        return nil, err
+    }
+    var reply LinkMsg
+    if err := r.Decode(&reply); err != nil {
+        c.Close()
+        return nil, err
+    }
+    if reply.Type != MSG_LINK || reply.Name != NODE_NAME {
+        c.Close()
+        return nil, fmt.Errorf("%s was answered by %q.", node, reply.Name)
+    }
+    go n.Read(r)
+    return n, nil
+}
+
+func (n *FakeNode) Read(r *gob.Decoder) {
+    for {
+        var lm LinkMsg
+        if err := r.Decode(&lm); err != nil {
+            return
+        }
+        n.Lock()
+        n.Heard = append(n.Heard, lm)
+        n.Unlock()
+    }
+}
+
+// FakeNode.Introduce() tells the hub of a user, by this node's key for them,
+// who is connected to the first node on the Path.
+
+func (n *FakeNode) Introduce(key uint8, name string, originKey uint8,
+                             path ...string) error {
+    return n.Writer.Encode(LinkMsg{Type: MSG_ENTER, Key: key, Hz: 600.0,
+                                   Name: name, Origin: path[0],
+                                   OriginKey: originKey, Path: path})
+}
+
+func (n *FakeNode) Withdraw(key uint8) error {
+    return n.Writer.Encode(LinkMsg{Type: MSG_LEAVE, Key: key})
+}
+
+// FakeNode.Told() is the Path the hub last gave for a user connected to the
+// origin node, or "" if the hub has not told this node of them or has since
+// withdrawn them.
+
+func (n *FakeNode) Told(origin string, name string) string {
+    n.Lock()
+    defer n.Unlock()
+    path, key := "", uint8(0)
+    for _, lm := range n.Heard {
+        switch {
+        case lm.Type == MSG_ENTER && lm.Origin == origin && lm.Name == name:
+            path, key = strings.Join(lm.Path, " "), lm.Key
+        case lm.Type == MSG_ENTER && lm.Key == key:
+            path = ""
+        case lm.Type == MSG_LEAVE && lm.Key == key:
+            path = ""
+        }
+    }
+    return path
+}
+
+// roster() is everyone a user sees in the room, by name.
+
+func roster(u *Headless) string {
+    names := []string{}
+    for _, m := range u.View() {
+        names = append(names, m.Name)
+    }
+    sort.Strings(names)
+    return strings.Join(names, " ")
+}
+
+// told() waits for a FakeNode to be given the Path it should have for a user,
+// which is "" for none.
+
+func told(n *FakeNode, origin string, name string, path string) error {
+    return await(func() error {
+        if got := n.Told(origin, name); got != path {
+            return fmt.Errorf("%s was told %s@%s came by %q, not %q.",
+                              n.Name, name, origin, got, path)
+        }
+        return nil
+    })
+}
+
+// sees() waits for a user to see just the given roster.
+
+func sees(u *Headless, want string) error {
+    return await(func() error {
+        if got := roster(u); got != want {
+            return fmt.Errorf("%s sees %q, not %q.", u.Name, got, want)
+        }
+        return nil
+    })
+}
+
+func TestLinkTriangle(t *testing.T) {
+    runScenario(t, testTriangle)
+}
+
+// The hub hears of bob on bravo directly, and round the triangle by way of
+// charlie. Bob must enter the room once, never be passed back towards bravo,
+// and outlast the direct link going down. Alice, in the room, must never come
+// back round the loop, and nobody may pass themselves off as somebody already
+// in the room, whether by a name with an @ or by a node speaking for another.
+
+func testTriangle(h *Harness) error {
+    alice, err := h.Join("alice")
+    if err != nil {
+        return err
+    }
+    if _, err := h.Join("bob@bravo"); err == nil {
+        return errors.New("A local user was let in as bob@bravo.")
+    }
+    bravo, err := LinkTo(h.Listener.Addr().String(), "bravo")
+    if err != nil {
+        return err
+    }
+    defer bravo.Conn.Close()
+    charlie, err := LinkTo(h.Listener.Addr().String(), "charlie")
+    if err != nil {
+        return err
+    }
+    defer charlie.Conn.Close()
+    for _, n := range []*FakeNode{bravo, charlie} {
+        if err := told(n, "alpha", "alice", "alpha"); err != nil {
+            return err
+        }
+    }
+    if err := bravo.Introduce(0, "bob", 0, "bravo"); err != nil {
+        return err
+    }
+    if err := sees(alice, "alice bob@bravo"); err != nil {
+        return err
+    }
+    if err := told(charlie, "bravo", "bob", "bravo alpha"); err != nil {
+        return err
+    }
+    // The reserve route, alice come round the loop, a node that speaks for
+    // another's bob, and a name no node could have given
+    err = errors.Join(charlie.Introduce(5, "bob", 0, "bravo", "charlie"),
+                      charlie.Introduce(6, "alice", alice.Key, "alpha",
+                                        "bravo", "charlie"),
+                      charlie.Introduce(7, "bob", 9, "bravo", "charlie"),
+                      charlie.Introduce(8, "eve@bravo", 0, "charlie"),
+                      charlie.Introduce(9, "carol", 0, "charlie"))
+    if err != nil {
+        return err
+    }
+    // Carol is heard of last, so the rest have been dealt with by then
+    if err := sees(alice, "alice bob@bravo carol@charlie"); err != nil {
+        return err
+    }
+    if err := told(bravo, "bravo", "bob", ""); err != nil {
+        return err
+    }
+    if err := told(bravo, "charlie", "carol", "charlie alpha"); err != nil {
+        return err
+    }
+    seen := alice.Seen()
+    bravo.Conn.Close()
+    // Bob now comes by way of charlie, so charlie is no longer told of them
+    if err := told(charlie, "bravo", "bob", ""); err != nil {
+        return err
+    }
+    if err := sees(alice, "alice bob@bravo carol@charlie"); err != nil {
+        return err
+    }
+    if err := charlie.Withdraw(5); err != nil {
+        return err
+    }
+    if err := sees(alice, "alice carol@charlie"); err != nil {
+        return err
+    }
+    if changes := alice.Since(seen); len(changes) != 1 {
+        return fmt.Errorf("Alice saw %v when bravo went down.", changes)
+    }
+    return nil
+}
@@ -0,0 +1,294 @@
+package main
+
+// An optional HTTP listener that exposes what the server is doing. Counters
+// are kept in Prometheus' text format at /metrics, and the room and its
+// members are listed as JSON at /status.
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "sync"
+    "time"
+)
+
+// The Member type is the public view of a keyed Client, including whatever
+// they have published of themselves. Away is "away" or "idle", if either.
+
+type Member struct {
+    Name string `json:"name"`
+    Key uint8 `json:"key"`
+    Hz float64 `json:"hz"`
+    On bool `json:"on"`
+    Away string `json:"away,omitempty"`
+    Presence
+}
+
+// The Metrics type is a copy of server state that is safe to read outside of
+// the Clients' thread. Clients writes to it as Msgs are routed and refreshes
+// the rest after every event. The HTTP handlers only ever read it.
+
+type Metrics struct {
+    sync.Mutex
+    Routed map[uint8]uint64
+    HandshakeErrors map[uint8]uint64
+    Floods map[uint8]uint64
+    KeyDown time.Duration
+    Members []Member
+    Spectators int
+    Floor string
+    FloorQueue int
+    InboundQueue int
+    OutboundQueue int
+}
+
+func NewMetrics() *Metrics {
+    return &Metrics{
+        Routed: make(map[uint8]uint64),
+        HandshakeErrors: make(map[uint8]uint64),
+        Floods: make(map[uint8]uint64),
+    }
+}
+
+func (mt *Metrics) Route(t uint8) {
+    mt.Lock()
+    mt.Routed[t]++
+    mt.Unlock()
+}
+
+// Failures that happen after validation are counted as MSG_ERROR_INIT.
+
+func (mt *Metrics) HandshakeError(t uint8) {
+    if t <= MSG_ERROR_OK {
+        t = MSG_ERROR_INIT
+    }
+    mt.Lock()
+    mt.HandshakeErrors[t]++
+    mt.Unlock()
+}
+
+// Flood protection is counted by what was done about it: MSG_MUTE for mutes,
+// MSG_LEAVE for kicks and MSG_ERROR_INIT for refused connections.
+
+func (mt *Metrics) Flood(t uint8) {
+    mt.Lock()
+    mt.Floods[t]++
+    mt.Unlock()
+}
+
+func (mt *Metrics) AddKeyDown(d time.Duration) {
+    mt.Lock()
+    mt.KeyDown += d
+    mt.Unlock()
+}
+
+// Metrics.Update() copies the parts of Clients that change from event to
+// event. It must be called from the Clients' thread.
+
+func (mt *Metrics) Update(cs *Clients) {
+    mt.Lock()
+    defer mt.Unlock()
+    mt.Members = mt.Members[:0]
+    mt.OutboundQueue = 0
+    for _, cli := range cs.All {
+        if cli != nil {
+            mt.Members = append(mt.Members,
+                                Member{cli.Name, cli.Key, cli.Hz,
+                                       cli.OnFor(nil) == 1,
+                                       cli.Presence.Away(), cli.Presence})
+            mt.OutboundQueue += len(cli.FromServer)
+        }
+    }
+    for _, cli := range cs.Spectators {
+        mt.OutboundQueue += len(cli.FromServer)
+    }
+    mt.Spectators = len(cs.Spectators)
+    mt.Floor = ""
+    if cs.Floor.Held && cs.All[cs.Floor.Holder] != nil {
+        mt.Floor = cs.All[cs.Floor.Holder].Name
+    }
+    mt.FloorQueue = len(cs.Floor.Queue)
+    mt.InboundQueue = len(cs.FromClient)
+}
+
+// Names used to label Msg types in /metrics.
+
+func msgName(t uint8) string {
+    switch t {
+    case MSG_ON:
+        return "on"
+    case MSG_OFF:
+        return "off"
+    case MSG_HZ:
+        return "hz"
+    case MSG_ENTER:
+        return "enter"
+    case MSG_LEAVE:
+        return "leave"
+    case MSG_SPECTATE:
+        return "spectate"
+    case MSG_FLOOR:
+        return "floor"
+    case MSG_FLOOR_REQUEST:
+        return "floor_request"
+    case MSG_MUTE:
+        return "mute"
+    case MSG_PING:
+        return "ping"
+    case MSG_PITCH:
+        return "pitch"
+    case MSG_LINK:
+        return "link"
+    case MSG_UDP:
+        return "udp"
+    case MSG_WHISPER:
+        return "whisper"
+    case MSG_TEXT:
+        return "text"
+    case MSG_PRESENCE:
+        return "presence"
+    case MSG_HISTORY:
+        return "history"
+    case MSG_ERROR_INIT:
+        return "init"
+    case MSG_ERROR_NAME_LEN:
+        return "name_len"
+    case MSG_ERROR_NAME_EXISTS:
+        return "name_exists"
+    case MSG_ERROR_USERS_MAX:
+        return "users_max"
+    case MSG_ERROR_SPECTATORS_MAX:
+        return "spectators_max"
+    case MSG_ERROR_NAME_CHARS:
+        return "name_chars"
+    }
+    return fmt.Sprint(t)
+}
+
+func floodName(t uint8) string {
+    switch t {
+    case MSG_MUTE:
+        return "mute"
+    case MSG_LEAVE:
+        return "kick"
+    }
+    return "refuse"
+}
+
+func sortedKeys(counts map[uint8]uint64) []uint8 {
+    keys := make([]uint8, 0, len(counts))
+    for k, _ := range counts {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+    return keys
+}
+
+func copyCounts(counts map[uint8]uint64) map[uint8]uint64 {
+    c := make(map[uint8]uint64, len(counts))
+    for k, v := range counts {
+        c[k] = v
+    }
+    return c
+}
+
+// Metrics.Snapshot() copies the Metrics so that the HTTP handlers can take
+// their time writing them out without holding up Clients.
+
+func (mt *Metrics) Snapshot() *Metrics {
+    mt.Lock()
+    defer mt.Unlock()
+    return &Metrics{
+        Routed: copyCounts(mt.Routed),
+        HandshakeErrors: copyCounts(mt.HandshakeErrors),
+        Floods: copyCounts(mt.Floods),
+        KeyDown: mt.KeyDown,
+        Members: append([]Member{}, mt.Members...),
+        Spectators: mt.Spectators,
+        Floor: mt.Floor,
+        FloorQueue: mt.FloorQueue,
+        InboundQueue: mt.InboundQueue,
+        OutboundQueue: mt.OutboundQueue,
+    }
+}
+
+func (mt *Metrics) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+    snap := mt.Snapshot()
+    room := fmt.Sprintf("room=%q", ROOM_NAME)
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    fmt.Fprintln(w, "# HELP morse_users Connected users.")
+    fmt.Fprintln(w, "# TYPE morse_users gauge")
+    fmt.Fprintf(w, "morse_users{%s} %d\n", room, len(snap.Members))
+    fmt.Fprintln(w, "# HELP morse_users_max Maximum connected users.")
+    fmt.Fprintln(w, "# TYPE morse_users_max gauge")
+    fmt.Fprintf(w, "morse_users_max{%s} %d\n", room, USERS_MAX)
+    fmt.Fprintln(w, "# HELP morse_spectators Connected spectators.")
+    fmt.Fprintln(w, "# TYPE morse_spectators gauge")
+    fmt.Fprintf(w, "morse_spectators{%s} %d\n", room, snap.Spectators)
+    fmt.Fprintln(w, "# HELP morse_messages_routed_total " +
+                    "Msgs broadcast by type.")
+    fmt.Fprintln(w, "# TYPE morse_messages_routed_total counter")
+    for _, t := range sortedKeys(snap.Routed) {
+        fmt.Fprintf(w, "morse_messages_routed_total{%s,type=%q} %d\n",
+                    room, msgName(t), snap.Routed[t])
+    }
+    fmt.Fprintln(w, "# HELP morse_key_down_seconds_total Time spent keying.")
+    fmt.Fprintln(w, "# TYPE morse_key_down_seconds_total counter")
+    fmt.Fprintf(w, "morse_key_down_seconds_total{%s} %f\n",
+                room, snap.KeyDown.Seconds())
+    fmt.Fprintln(w, "# HELP morse_handshake_errors_total Rejected sessions.")
+    fmt.Fprintln(w, "# TYPE morse_handshake_errors_total counter")
+    for _, t := range sortedKeys(snap.HandshakeErrors) {
+        fmt.Fprintf(w, "morse_handshake_errors_total{%s,code=%q} %d\n",
+                    room, msgName(t), snap.HandshakeErrors[t])
+    }
+    fmt.Fprintln(w, "# HELP morse_floods_total Action taken against floods.")
+    fmt.Fprintln(w, "# TYPE morse_floods_total counter")
+    for _, t := range sortedKeys(snap.Floods) {
+        fmt.Fprintf(w, "morse_floods_total{%s,action=%q} %d\n",
+                    room, floodName(t), snap.Floods[t])
+    }
+    fmt.Fprintln(w, "# HELP morse_queue_depth Msgs waiting to be handled.")
+    fmt.Fprintln(w, "# TYPE morse_queue_depth gauge")
+    fmt.Fprintf(w, "morse_queue_depth{%s,queue=\"inbound\"} %d\n",
+                room, snap.InboundQueue)
+    fmt.Fprintf(w, "morse_queue_depth{%s,queue=\"outbound\"} %d\n",
+                room, snap.OutboundQueue)
+    fmt.Fprintf(w, "morse_queue_depth{%s,queue=\"floor\"} %d\n",
+                room, snap.FloorQueue)
+}
+
+// The JSON layout of /status. A server hosts a single room for now, but it is
+// listed as such so that the format need not change if that ever does.
+
+type Room struct {
+    Name string `json:"name"`
+    UsersMax int `json:"users_max"`
+    Users []Member `json:"users"`
+    Spectators int `json:"spectators"`
+    Floor string `json:"floor,omitempty"`
+}
+
+type Status struct {
+    Rooms []Room `json:"rooms"`
+}
+
+func (mt *Metrics) ServeStatus(w http.ResponseWriter, r *http.Request) {
+    snap := mt.Snapshot()
+    room := Room{ROOM_NAME, USERS_MAX, snap.Members, snap.Spectators,
+                 snap.Floor}
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(Status{[]Room{room}}); err != nil {
+        log.Println(err)
+    }
+}
+
+func (mt *Metrics) ListenAndServe(addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/metrics", mt.ServeMetrics)
+    mux.HandleFunc("/status", mt.ServeStatus)
+    log.Println("Serving metrics on", addr, "...")
+    log.Fatal(http.ListenAndServe(addr, mux))
+}
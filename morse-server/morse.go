@@ -0,0 +1,211 @@
+package main
+
+// The morse code itself, along with the timing rules that govern how it is
+// sent. Everything is in terms of the dit, whose length follows from the
+// sending speed in words per minute (PARIS standard). This is the same as
+// morse-client's, so that the server sends and copies the way users do.
+
+import (
+    "time"
+)
+
+var MORSE = map[rune]string{
+    'A': ".-", 'B': "-...", 'C': "-.-.", 'D': "-..", 'E': ".", 'F': "..-.",
+    'G': "--.", 'H': "....", 'I': "..", 'J': ".---", 'K': "-.-", 'L': ".-..",
+    'M': "--", 'N': "-.", 'O': "---", 'P': ".--.", 'Q': "--.-", 'R': ".-.",
+    'S': "...", 'T': "-", 'U': "..-", 'V': "...-", 'W': ".--", 'X': "-..-",
+    'Y': "-.--", 'Z': "--..",
+    '0': "-----", '1': ".----", '2': "..---", '3': "...--", '4': "....-",
+    '5': ".....", '6': "-....", '7': "--...", '8': "---..", '9': "----.",
+    '.': ".-.-.-", ',': "--..--", '?': "..--..", '/': "-..-.", '=': "-...-",
+    '+': ".-.-.", '-': "-....-", '\'': ".----.", '(': "-.--.", ')': "-.--.-",
+    ':': "---...", '@': ".--.-.",
+}
+
+// The Timing type holds the length of each part of a transmission. Element
+// is the gap between the dits and dahs of one character, Char is the gap
+// between characters and Word the gap between words.
+
+type Timing struct {
+    Dit time.Duration
+    Dah time.Duration
+    Element time.Duration
+    Char time.Duration
+    Word time.Duration
+}
+
+// NewTiming() returns the timing for characters sent at wpm. If fwpm is
+// slower, the gaps between characters and words are stretched to bring the
+// overall speed down to fwpm (Farnsworth spacing), while the characters
+// themselves still sound the way they do at full speed.
+
+func NewTiming(wpm float64, fwpm float64) Timing {
+    dit := time.Duration(1.2 / wpm * float64(time.Second))
+    t := Timing{dit, 3 * dit, dit, 3 * dit, 7 * dit}
+    if fwpm > 0.0 && fwpm < wpm {
+        delay := (60.0 * wpm - 37.2 * fwpm) / (wpm * fwpm)
+        t.Char = time.Duration(3.0 * delay / 19.0 * float64(time.Second))
+        t.Word = time.Duration(7.0 * delay / 19.0 * float64(time.Second))
+    }
+    return t
+}
+
+// The reverse of MORSE, for decoding.
+
+var CODES = make(map[string]rune)
+
+func init() {
+    for ch, code := range MORSE {
+        CODES[code] = ch
+    }
+}
+
+// The Keying type is a run of transmission as it was actually keyed: the
+// length of each mark (key down), and of each space between one mark and the
+// next. There is always one less space than there are marks.
+
+type Keying struct {
+    Marks []time.Duration
+    Spaces []time.Duration
+}
+
+// Keying.Unit() estimates the dit length of the sender by splitting marks
+// into two clusters. A run with no clear dahs is assumed to be all dits.
+
+func (k *Keying) Unit() time.Duration {
+    if len(k.Marks) == 0 {
+        return 0
+    }
+    lo, hi := k.Marks[0], k.Marks[0]
+    for _, m := range k.Marks {
+        lo = min(lo, m)
+        hi = max(hi, m)
+    }
+    if hi < 2 * lo {
+        return (lo + hi) / 2
+    }
+    for i := 0; i < 8; i++ {
+        var dits, dahs time.Duration
+        nDits, nDahs := 0, 0
+        split := (lo + hi) / 2
+        for _, m := range k.Marks {
+            if m < split {
+                dits += m
+                nDits++
+            } else {
+                dahs += m
+                nDahs++
+            }
+        }
+        if nDits == 0 || nDahs == 0 {
+            // Marks all of one length, such as several arriving at once
+            break
+        }
+        lo = dits / time.Duration(nDits)
+        hi = dahs / time.Duration(nDahs)
+    }
+    return (lo + hi / 3) / 2
+}
+
+// Keying.Dah() reports whether a mark is a dah for a given dit length.
+
+func (k *Keying) Dah(i int, unit time.Duration) bool {
+    return k.Marks[i] >= 2 * unit
+}
+
+// Keying.Gap() classifies a space by the number of dits it is closest to:
+// 1 between elements, 3 between characters and 7 between words.
+
+func (k *Keying) Gap(i int, unit time.Duration) int {
+    switch {
+    case k.Spaces[i] < 2 * unit:
+        return 1
+    case k.Spaces[i] < 5 * unit:
+        return 3
+    }
+    return 7
+}
+
+// Keying.Characters() splits the run into characters, returning the index of
+// the first mark of each along with its code. Keying.Decode() turns the same
+// into text, with '*' standing in for codes that don't exist.
+
+func (k *Keying) Characters(unit time.Duration) ([]int, []string) {
+    starts := []int{}
+    codes := []string{}
+    code := ""
+    for i, _ := range k.Marks {
+        if i > 0 && k.Gap(i - 1, unit) > 1 {
+            codes = append(codes, code)
+            code = ""
+        }
+        if code == "" {
+            starts = append(starts, i)
+        }
+        if k.Dah(i, unit) {
+            code += "-"
+        } else {
+            code += "."
+        }
+    }
+    if code != "" {
+        codes = append(codes, code)
+    }
+    return starts, codes
+}
+
+func (k *Keying) Decode() string {
+    unit := k.Unit()
+    starts, codes := k.Characters(unit)
+    text := []rune{}
+    for i, code := range codes {
+        if i > 0 && k.Gap(starts[i] - 1, unit) == 7 {
+            text = append(text, ' ')
+        }
+        if ch, ok := CODES[code]; ok {
+            text = append(text, ch)
+        } else {
+            text = append(text, '*')
+        }
+    }
+    return string(text)
+}
+
+// The Recorder turns a stream of on/off events into a Keying.
+
+type Recorder struct {
+    Keying Keying
+    On bool
+    Since time.Time
+}
+
+func (r *Recorder) Key(on bool, t time.Time) {
+    if on == r.On {
+        return
+    }
+    if on && len(r.Keying.Marks) > 0 {
+        r.Keying.Spaces = append(r.Keying.Spaces, t.Sub(r.Since))
+    } else if !on {
+        r.Keying.Marks = append(r.Keying.Marks, t.Sub(r.Since))
+    }
+    r.On = on
+    r.Since = t
+}
+
+// Recorder.Idle() returns how long the key has been up, or zero if it is down
+// or nothing has been keyed yet.
+
+func (r *Recorder) Idle(t time.Time) time.Duration {
+    if r.On || len(r.Keying.Marks) == 0 {
+        return 0
+    }
+    return t.Sub(r.Since)
+}
+
+// Recorder.Take() hands over everything keyed so far and starts afresh.
+
+func (r *Recorder) Take() Keying {
+    k := r.Keying
+    r.Keying = Keying{}
+    return k
+}
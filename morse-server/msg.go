@@ -15,6 +15,18 @@ const (
     MSG_HZ
     MSG_ENTER
     MSG_LEAVE
+    MSG_SPECTATE
+    MSG_FLOOR
+    MSG_FLOOR_REQUEST
+    MSG_MUTE
+    MSG_PING
+    MSG_PITCH
+    MSG_LINK
+    MSG_UDP
+    MSG_WHISPER
+    MSG_TEXT
+    MSG_PRESENCE
+    MSG_HISTORY
     MSG_INTERNAL
     MSG_INTERNAL_VOLUME
     MSG_INTERNAL_NAMES
@@ -23,6 +35,8 @@ const (
     MSG_ERROR_NAME_LEN
     MSG_ERROR_NAME_EXISTS
     MSG_ERROR_USERS_MAX
+    MSG_ERROR_SPECTATORS_MAX
+    MSG_ERROR_NAME_CHARS
 )
 
 // Msg types are used server-side for internal communications.
@@ -33,6 +47,7 @@ type Msg struct {
     Key uint8
     Hz float64
     Name string
+    Text string
     Client *Client
 }
 
@@ -46,4 +61,5 @@ type OMsg struct {
     Key uint8
     Hz float64
     Name string
+    Text string
 }
@@ -0,0 +1,112 @@
+package main
+
+// Everyone is given a pitch of their own on arrival, so that a room full of
+// newcomers is not one tone that nobody can tell apart. Pitches are picked
+// from the band between PITCH_LOW and PITCH_HIGH, as far from everyone else's
+// as the band allows. Users may still choose any pitch they like afterwards;
+// what happens when they choose one within PITCH_SPACING of somebody else's
+// is up to PITCH_POLICY.
+
+import (
+    "math"
+)
+
+const (
+    PITCH_ALLOW = "allow"
+    PITCH_WARN = "warn"
+    PITCH_NUDGE = "nudge"
+)
+
+// Clients.pitches() lists the pitches in use by everyone but the given key.
+
+func (cs *Clients) pitches(key uint8) []float64 {
+    var hz []float64
+    for _, cli := range cs.All {
+        if cli != nil && cli.Key != key {
+            hz = append(hz, cli.Hz)
+        }
+    }
+    return hz
+}
+
+// clearance() is how far hz lies from the nearest of the others.
+
+func clearance(hz float64, others []float64) float64 {
+    d := math.Inf(1)
+    for _, o := range others {
+        d = math.Min(d, math.Abs(hz - o))
+    }
+    return d
+}
+
+// Clients.FreePitch() picks a pitch in the band for a newcomer. The best
+// pitch is either an edge of the band, halfway between two neighbouring
+// pitches, or its centre when the room is empty. Ties go to whichever is
+// nearest the centre, which keeps early arrivals in the middle of the band.
+
+func (cs *Clients) FreePitch() float64 {
+    others := cs.pitches(uint8(USERS_MAX))
+    centre := (PITCH_LOW + PITCH_HIGH) / 2
+    candidates := []float64{PITCH_LOW, PITCH_HIGH, centre}
+    for i, a := range others {
+        for _, b := range others[i+1:] {
+            if mid := (a + b) / 2; mid > PITCH_LOW && mid < PITCH_HIGH {
+                candidates = append(candidates, mid)
+            }
+        }
+    }
+    best, most := centre, -1.0
+    for _, c := range candidates {
+        d := clearance(c, others)
+        if d > most || (d == most &&
+                         math.Abs(c - centre) < math.Abs(best - centre)) {
+            best, most = c, d
+        }
+    }
+    return math.Round(best)
+}
+
+// crowds() tells whether two pitches are closer than PITCH_SPACING, allowing
+// for a pitch that was nudged to exactly that distance.
+
+func crowds(a float64, b float64) bool {
+    return math.Abs(a - b) < PITCH_SPACING - 1e-6
+}
+
+// Clients.Crowding() returns whoever is within PITCH_SPACING of hz, other
+// than the given key, and nearest to it.
+
+func (cs *Clients) Crowding(key uint8, hz float64) *Client {
+    var near *Client
+    for _, cli := range cs.All {
+        if cli == nil || cli.Key == key || !crowds(cli.Hz, hz) {
+            continue
+        }
+        if near == nil || math.Abs(cli.Hz - hz) < math.Abs(near.Hz - hz) {
+            near = cli
+        }
+    }
+    return near
+}
+
+// Clients.Nudge() moves hz the least distance that clears everyone else by
+// PITCH_SPACING, staying within the range of pitches users may choose. The
+// only places worth trying are exactly PITCH_SPACING either side of another
+// pitch. It fails if the room is too crowded for there to be any.
+
+func (cs *Clients) Nudge(key uint8, hz float64) (float64, bool) {
+    others := cs.pitches(key)
+    best, ok := hz, false
+    for _, o := range others {
+        for _, c := range []float64{o - PITCH_SPACING, o + PITCH_SPACING} {
+            if c < FREQ_MIN || c > FREQ_MAX ||
+               crowds(clearance(c, others), 0) {
+                continue
+            }
+            if !ok || math.Abs(c - hz) < math.Abs(best - hz) {
+                best, ok = c, true
+            }
+        }
+    }
+    return best, ok
+}
@@ -0,0 +1,121 @@
+package main
+
+// Users may publish a little about themselves for the rest of the room: the
+// speed they like to work at, their skill, a status of their own choosing,
+// and whether they are away. A MSG_PRESENCE carries all of it at once, with
+// the state as On, the speed in WPM as Hz, the skill as Name and the status
+// as Text, and replaces whatever the user published before. The room is sent
+// one whenever anyone's presence changes, and newcomers are sent one for
+// everyone who has published anything. Users who do nothing for IDLE_TIMEOUT
+// are marked idle by the server until they next key, chat or change anything.
+// Presence belongs to the Client, so it goes when they leave.
+
+import (
+    "errors"
+    "log"
+    "time"
+)
+
+const (
+    PRESENCE_HERE uint8 = iota
+    PRESENCE_AWAY
+    PRESENCE_IDLE
+)
+
+// The skill levels a user may claim, if any
+
+var SKILLS = []string{"beginner", "intermediate", "advanced"}
+
+type Presence struct {
+    State uint8 `json:"-"`
+    WPM float64 `json:"wpm,omitempty"`
+    Skill string `json:"skill,omitempty"`
+    Status string `json:"status,omitempty"`
+}
+
+// Presence.Msg() is the MSG_PRESENCE that describes the user at a key.
+
+func (p Presence) Msg(key uint8) Msg {
+    return Msg{Type: MSG_PRESENCE, On: p.State, Key: key, Hz: p.WPM,
+               Name: p.Skill, Text: p.Status}
+}
+
+// Presence.Away() names the state for /status, or is empty if the user is
+// here.
+
+func (p Presence) Away() string {
+    switch p.State {
+    case PRESENCE_AWAY:
+        return "away"
+    case PRESENCE_IDLE:
+        return "idle"
+    }
+    return ""
+}
+
+func validSkill(skill string) bool {
+    for _, s := range SKILLS {
+        if s == skill {
+            return true
+        }
+    }
+    return false
+}
+
+// Clients.Present() answers a MSG_PRESENCE, which ValidMsg() has checked. It
+// returns an error if nothing changed, so that the room is not told.
+
+func (cs *Clients) Present(m *Msg) error {
+    cli := cs.All[m.Key]
+    if cli == nil || cli.Via != nil {
+        return errors.New("No such user.")
+    }
+    p := Presence{m.On, m.Hz, m.Name, m.Text}
+    if p == cli.Presence {
+        return errors.New("Presence unchanged.")
+    }
+    cli.Presence = p
+    return nil
+}
+
+// Clients.Active() notes that a user has done something, bringing them back
+// if they were idle.
+
+func (cs *Clients) Active(cli *Client) {
+    cli.Active = time.Now()
+    if cli.Presence.State == PRESENCE_IDLE {
+        cli.Presence.State = PRESENCE_HERE
+        m := cli.Presence.Msg(cli.Key)
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+}
+
+// Clients.Idle() marks idle everyone who has done nothing for IDLE_TIMEOUT,
+// unless they are holding their key down. Users on linked servers are left
+// to their own.
+
+func (cs *Clients) Idle(now time.Time) {
+    for _, cli := range cs.All {
+        if cli == nil || cli.Via != nil || cli.On == 1 ||
+           cli.Presence.State != PRESENCE_HERE ||
+           now.Sub(cli.Active) < IDLE_TIMEOUT {
+            continue
+        }
+        cli.Presence.State = PRESENCE_IDLE
+        m := cli.Presence.Msg(cli.Key)
+        cs.Broadcast(cs.NewOMsg(&m))
+    }
+}
+
+// Clients.SendPresence() tells a newcomer of the user at a key, if they have
+// published anything.
+
+func (cs *Clients) SendPresence(to *Client, cli *Client) {
+    if cli.Presence == (Presence{}) {
+        return
+    }
+    m := cli.Presence.Msg(cli.Key)
+    if err := to.Writer.Encode(cs.NewOMsg(&m)); err != nil {
+        log.Println(err)
+    }
+}
@@ -0,0 +1,174 @@
+package main
+
+// Flood protection. Keying Msgs from each Client are metered by token buckets
+// before they ever reach Clients, and new connections are metered per IP
+// before the gob handshake runs.
+
+import (
+    "log"
+    "net"
+    "sync"
+    "time"
+)
+
+// The Bucket type is a token bucket that holds at most Burst tokens and
+// refills at Rate tokens per second. Each Msg or connection spends one.
+
+type Bucket struct {
+    Rate float64
+    Burst float64
+    Tokens float64
+    Last time.Time
+}
+
+func NewBucket(rate float64, burst float64) *Bucket {
+    return &Bucket{rate, burst, burst, time.Now()}
+}
+
+func (b *Bucket) Refill() {
+    now := time.Now()
+    b.Tokens += now.Sub(b.Last).Seconds() * b.Rate
+    if b.Tokens > b.Burst {
+        b.Tokens = b.Burst
+    }
+    b.Last = now
+}
+
+func (b *Bucket) Take() bool {
+    b.Refill()
+    if b.Tokens < 1.0 {
+        return false
+    }
+    b.Tokens--
+    return true
+}
+
+// The Limiter type meters one Client. Every Msg that is dropped for exceeding
+// its bucket is a strike. At STRIKES_MAX strikes the Client is muted for
+// MUTE_TIME, during which all of its Msgs are dropped without counting
+// against it. Reaching STRIKES_MAX again before the strikes are forgiven gets
+// the Client kicked. Strikes, and the mute on record, are forgiven after a
+// minute without one. Keying over UDP is metered from another goroutine,
+// hence the lock.
+
+type Limiter struct {
+    sync.Mutex
+    Key *Bucket
+    Text *Bucket
+    Hz *Bucket
+    Strikes int
+    LastStrike time.Time
+    Muted bool
+    MutedUntil time.Time
+}
+
+func NewLimiter() Limiter {
+    return Limiter{
+        Key: NewBucket(KEY_RATE, KEY_BURST),
+        Text: NewBucket(TEXT_RATE, TEXT_BURST),
+        Hz: NewBucket(HZ_RATE, HZ_BURST),
+    }
+}
+
+func (l *Limiter) Allow(t uint8) bool {
+    l.Lock()
+    defer l.Unlock()
+    if time.Now().Before(l.MutedUntil) {
+        return false
+    }
+    switch t {
+    case MSG_ON, MSG_OFF, MSG_PING:
+        return l.Key.Take()
+    case MSG_TEXT:
+        return l.Text.Take()
+    case MSG_HZ, MSG_FLOOR_REQUEST, MSG_UDP, MSG_WHISPER, MSG_PRESENCE,
+         MSG_HISTORY:
+        return l.Hz.Take()
+    }
+    return true
+}
+
+// Limiter.Strike() counts a strike and says whether it has earned the Client
+// a mute or, with a mute already on record, a kick. Msgs dropped during a
+// mute are not held against the Client, since a user will often go on keying
+// through one, and the minute before strikes are forgiven runs from its end.
+
+func (l *Limiter) Strike() (mute bool, kick bool) {
+    l.Lock()
+    defer l.Unlock()
+    now := time.Now()
+    if now.Before(l.MutedUntil) {
+        return false, false
+    }
+    if now.Sub(l.LastStrike) > time.Minute {
+        l.Strikes = 0
+        l.Muted = false
+    }
+    l.Strikes++
+    l.LastStrike = now
+    if l.Strikes < STRIKES_MAX {
+        return false, false
+    }
+    if l.Muted {
+        return false, true
+    }
+    l.Strikes = 0
+    l.Muted = true
+    l.MutedUntil = now.Add(MUTE_TIME)
+    l.LastStrike = l.MutedUntil
+    return true, false
+}
+
+// Client.Strike() is called whenever the Limiter drops a Msg. It returns true
+// if the Client should be kicked. The Limiter is let go before a mute is
+// passed along, as Clients may be busy and keying over UDP must not wait.
+
+func (cli *Client) Strike(c net.Conn, cs *Clients) bool {
+    mute, kick := cli.Limits.Strike()
+    if kick {
+        log.Println(c.RemoteAddr(), "kicked for flooding")
+        cs.Metrics.Flood(MSG_LEAVE)
+        return true
+    }
+    if !mute {
+        return false
+    }
+    log.Println(c.RemoteAddr(), "muted for flooding")
+    cs.Metrics.Flood(MSG_MUTE)
+    // Nobody should be left listening to a stuck tone
+    cs.FromClient <- Msg{Type: MSG_OFF, Key: cli.Key}
+    mm := Msg{Type: MSG_MUTE, On: 1, Key: cli.Key, Hz: MUTE_TIME.Seconds()}
+    cli.FromServer <- cs.NewOMsg(&mm)
+    return false
+}
+
+// The ConnLimiter type meters connection attempts by IP. It is only touched
+// by the accept loop. Buckets that have filled back up are forgotten once
+// there are enough of them to be worth sweeping.
+
+type ConnLimiter struct {
+    Buckets map[string]*Bucket
+}
+
+func (cl *ConnLimiter) Allow(addr net.Addr) bool {
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        host = addr.String()
+    }
+    if cl.Buckets == nil {
+        cl.Buckets = make(map[string]*Bucket)
+    }
+    if len(cl.Buckets) > 1024 {
+        for h, b := range cl.Buckets {
+            if b.Refill(); b.Tokens >= b.Burst {
+                delete(cl.Buckets, h)
+            }
+        }
+    }
+    b, ok := cl.Buckets[host]
+    if !ok {
+        b = NewBucket(CONN_RATE / 60.0, CONN_BURST)
+        cl.Buckets[host] = b
+    }
+    return b.Take()
+}
@@ -0,0 +1,256 @@
+package main
+
+// An optional relay for listeners who only want sound, such as a transmitter
+// or a stream server. The Relay hears every OMsg the room is sent and
+// synthesizes everyone's keying the way morse-client's playback() does, with
+// plain wavetable sines at each user's pitch. The mix is served over HTTP as
+// 16 bit little-endian mono PCM, either raw at /stream.pcm or with a WAV
+// header at /stream.wav, to any number of listeners. For example:
+//
+//     curl -s http://example.com:7401/stream.wav | aplay
+//
+// The Relay keeps to the wall clock rather than a sound card. It runs
+// STREAM_DELAY behind it, so that each OMsg can be placed on the sample it
+// was keyed at.
+
+import (
+    "bytes"
+    "encoding/binary"
+    "log"
+    "math"
+    "net/http"
+    "sync"
+    "time"
+)
+
+// A Voice is one user's part of the mix. Its pitch is kept as wavetable
+// entries per sample.
+
+type Voice struct {
+    On bool
+    Pitch float64
+    Phase float64
+}
+
+// A Heard OMsg is stamped with when it happened: when it was keyed, for
+// keying that came over UDP, or else when it was routed.
+
+type Heard struct {
+    At time.Time
+    OMsg OMsg
+}
+
+// The Relay is fed from the Clients' thread through Relay.Hear(), which only
+// queues the OMsg under the lock. Everything else belongs to Relay.Run(),
+// apart from the Listeners, who are added and removed under the same lock by
+// their HTTP handlers. A Listener that falls STREAM_QUEUE chunks behind is
+// cut off rather than let it hold up everyone else.
+
+type Relay struct {
+    sync.Mutex
+    Pending []Heard
+    Listeners map[chan []byte]bool
+    Voices []Voice
+    Wave [WAVELEN]float64
+    Amplitude float64
+    Start time.Time
+    Rendered int64
+}
+
+func NewRelay() *Relay {
+    rl := Relay{Listeners: make(map[chan []byte]bool),
+                Voices: make([]Voice, USERS_MAX),
+                Amplitude: 0.95 / float64(USERS_MAX), Start: time.Now()}
+    for i, _ := range rl.Wave {
+        rl.Wave[i] = math.Sin(2.0 * math.Pi * float64(i) / WAVELEN)
+    }
+    return &rl
+}
+
+// Relay.Hear() queues anything that changes what the room sounds like, to be
+// played at time t.
+
+func (rl *Relay) Hear(om OMsg, t time.Time) {
+    switch om.Type {
+    case MSG_ON, MSG_OFF, MSG_HZ, MSG_ENTER, MSG_LEAVE:
+        rl.Lock()
+        rl.Pending = append(rl.Pending, Heard{t, om})
+        rl.Unlock()
+    }
+}
+
+// Relay.sample() is the number of the sample that falls at time t.
+
+func (rl *Relay) sample(t time.Time) int64 {
+    return int64(t.Sub(rl.Start).Seconds() * STREAM_RATE)
+}
+
+// Relay.Run() renders a chunk at a time for as long as the server is up.
+
+func (rl *Relay) Run() {
+    tick := time.NewTicker(time.Second * STREAM_CHUNK / STREAM_RATE)
+    for now := range tick.C {
+        due := rl.sample(now.Add(-STREAM_DELAY))
+        for rl.Rendered + STREAM_CHUNK <= due {
+            rl.Render()
+        }
+    }
+}
+
+// Relay.Render() mixes the next STREAM_CHUNK samples and passes them on to
+// every Listener. With nobody listening, the OMsgs are followed but nothing
+// is synthesized.
+
+func (rl *Relay) Render() {
+    end := rl.Rendered + STREAM_CHUNK
+    rl.Lock()
+    n := 0
+    for n < len(rl.Pending) && rl.sample(rl.Pending[n].At) < end {
+        n++
+    }
+    heard := append([]Heard{}, rl.Pending[:n]...)
+    rl.Pending = rl.Pending[n:]
+    listening := len(rl.Listeners) > 0
+    rl.Unlock()
+    if !listening {
+        for _, h := range heard {
+            rl.Apply(h.OMsg)
+        }
+        rl.Rendered = end
+        return
+    }
+    buf := make([]byte, STREAM_CHUNK * 2)
+    for i := 0; i < STREAM_CHUNK; i++ {
+        for len(heard) > 0 && rl.sample(heard[0].At) <= rl.Rendered {
+            rl.Apply(heard[0].OMsg)
+            heard = heard[1:]
+        }
+        d := 0.0
+        for v, _ := range rl.Voices {
+            voice := &rl.Voices[v]
+            if !voice.On {
+                continue
+            }
+            voice.Phase = math.Mod(voice.Phase + voice.Pitch, WAVELEN)
+            d += rl.Wave[int(voice.Phase)] * rl.Amplitude
+        }
+        d = math.Max(-1.0, math.Min(1.0, d))
+        binary.LittleEndian.PutUint16(buf[i*2:],
+                                      uint16(int16(d * math.MaxInt16)))
+        rl.Rendered++
+    }
+    rl.Send(buf)
+}
+
+// Relay.Apply() updates the Voices from an OMsg, undoing the + 1 that was
+// added to its On and Key for gob.
+
+func (rl *Relay) Apply(om OMsg) {
+    key := om.Key - 1
+    if int(key) >= len(rl.Voices) {
+        return
+    }
+    voice := &rl.Voices[key]
+    switch om.Type {
+    case MSG_ON:
+        voice.On = true
+    case MSG_OFF:
+        voice.On = false
+    case MSG_HZ:
+        voice.Pitch = om.Hz * WAVELEN / STREAM_RATE
+    case MSG_ENTER:
+        voice.On = om.On - 1 == 1
+        voice.Pitch = om.Hz * WAVELEN / STREAM_RATE
+    case MSG_LEAVE:
+        *voice = Voice{}
+    }
+}
+
+func (rl *Relay) Send(buf []byte) {
+    rl.Lock()
+    defer rl.Unlock()
+    for l, _ := range rl.Listeners {
+        select {
+        case l <- buf:
+        default:
+            delete(rl.Listeners, l)
+            close(l)
+        }
+    }
+}
+
+// wavHeader() describes an endless stream. The sizes are left at their
+// largest, which players take to mean that they should read until the
+// connection closes.
+
+func wavHeader() []byte {
+    var b bytes.Buffer
+    le := binary.LittleEndian
+    b.WriteString("RIFF")
+    binary.Write(&b, le, uint32(math.MaxUint32))
+    b.WriteString("WAVEfmt ")
+    binary.Write(&b, le, []uint32{16})
+    binary.Write(&b, le, []uint16{1, 1}) // PCM, mono
+    binary.Write(&b, le, []uint32{STREAM_RATE, STREAM_RATE * 2})
+    binary.Write(&b, le, []uint16{2, 16})
+    b.WriteString("data")
+    binary.Write(&b, le, uint32(math.MaxUint32))
+    return b.Bytes()
+}
+
+func (rl *Relay) ServeWAV(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "audio/wav")
+    rl.Serve(w, r, wavHeader())
+}
+
+func (rl *Relay) ServePCM(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/octet-stream")
+    rl.Serve(w, r, nil)
+}
+
+// Relay.Serve() streams the mix to one Listener until either end gives up.
+
+func (rl *Relay) Serve(w http.ResponseWriter, r *http.Request, header []byte) {
+    l := make(chan []byte, STREAM_QUEUE)
+    rl.Lock()
+    rl.Listeners[l] = true
+    rl.Unlock()
+    log.Println(r.RemoteAddr, "listening to the relay")
+    defer log.Println(r.RemoteAddr, "stopped listening to the relay")
+    defer func() {
+        rl.Lock()
+        if rl.Listeners[l] {
+            delete(rl.Listeners, l)
+            close(l)
+        }
+        rl.Unlock()
+    }()
+    flusher, _ := w.(http.Flusher)
+    if _, err := w.Write(header); err != nil {
+        return
+    }
+    for {
+        select {
+        case buf, ok := <- l:
+            if !ok {
+                return
+            }
+            if _, err := w.Write(buf); err != nil {
+                return
+            }
+            if flusher != nil {
+                flusher.Flush()
+            }
+        case <- r.Context().Done():
+            return
+        }
+    }
+}
+
+func (rl *Relay) ListenAndServe(addr string) {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/stream.wav", rl.ServeWAV)
+    mux.HandleFunc("/stream.pcm", rl.ServePCM)
+    log.Println("Relaying audio on", addr, "...")
+    log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,512 @@
+package main
+
+// The scenarios the Harness puts the server through, one test each. A
+// scenario is given a fresh Harness, which is checked for Faults afterwards.
+
+import (
+    "errors"
+    "fmt"
+    "math/rand"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestScenarioEnter(t *testing.T) {
+    runScenario(t, testEnter)
+}
+
+func TestScenarioLeave(t *testing.T) {
+    runScenario(t, testLeave)
+}
+
+func TestScenarioKeying(t *testing.T) {
+    runScenario(t, testKeying)
+}
+
+func TestScenarioDrop(t *testing.T) {
+    runScenario(t, testDrop)
+}
+
+func TestScenarioChurn(t *testing.T) {
+    runScenario(t, testChurn)
+}
+
+func TestScenarioWhisper(t *testing.T) {
+    runScenario(t, testWhisper)
+}
+
+func TestScenarioText(t *testing.T) {
+    runScenario(t, testText)
+}
+
+func TestScenarioPresence(t *testing.T) {
+    runScenario(t, testPresence)
+}
+
+func TestScenarioHistory(t *testing.T) {
+    runScenario(t, testHistory)
+}
+
+func runScenario(t *testing.T, scenario func(h *Harness) error) {
+    h, err := NewHarness(TEST_IMPAIRMENT)
+    if err != nil {
+        t.Fatal(err)
+    }
+    err = scenario(h)
+    if faults := h.Faults(); faults != nil {
+        err = errors.Join(err, faults)
+    }
+    h.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+// Everyone arrives at once, and all must see the same room.
+
+func testEnter(h *Harness) error {
+    if _, err := h.JoinAll("op", TEST_USERS); err != nil {
+        return err
+    }
+    return h.Settle()
+}
+
+// Half the room leaves one by one while others arrive, and those who stay
+// must see the comings and goings in the same order.
+
+func testLeave(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    leaving, staying := users[:len(users) / 2], users[len(users) / 2:]
+    ms := marks(staying)
+    for i, u := range leaving {
+        u.Leave()
+        time.Sleep(element())
+        if _, err := h.Join(fmt.Sprintf("late%d", i + 1)); err != nil {
+            return err
+        }
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    return sameOrder(staying, ms)
+}
+
+// Everyone keys at once, and must hear every element everyone else keyed
+// with nothing left sounding afterwards.
+
+func testKeying(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    errs := make([]error, len(users))
+    var wg sync.WaitGroup
+    for i, u := range users {
+        wg.Add(1)
+        go func(i int, u *Headless) {
+            defer wg.Done()
+            for j := 0; j < TEST_ELEMENTS && errs[i] == nil; j++ {
+                errs[i] = u.Element(element())
+                time.Sleep(element())
+            }
+        }(i, u)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    // The room falls silent as soon as the hub is, while the last elements
+    // may still be held up on their way to some users
+    return await(func() error {
+        for _, u := range users {
+            for _, v := range users {
+                if n := u.Heard(v.Name); n != TEST_ELEMENTS {
+                    return fmt.Errorf("%s heard %s key %d elements, not %d.",
+                                      u.Name, v.Name, n, TEST_ELEMENTS)
+                }
+            }
+        }
+        return nil
+    })
+}
+
+// Half the room hangs up in the middle of keying down, and nobody may be
+// left hearing them.
+
+func testDrop(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    for _, u := range users[:len(users) / 2] {
+        if err := u.Send(MSG_ON); err != nil {
+            return err
+        }
+    }
+    if err := await(func() error {
+        for _, u := range users {
+            for _, v := range users[:len(users) / 2] {
+                if u.Heard(v.Name) == 0 {
+                    return fmt.Errorf("%s never heard %s key down.", u.Name,
+                                      v.Name)
+                }
+            }
+        }
+        return nil
+    }); err != nil {
+        return err
+    }
+    for _, u := range users[:len(users) / 2] {
+        u.Leave()
+        time.Sleep(element())
+    }
+    return h.Settle()
+}
+
+// Users come, key a little and go, some in the middle of keying down, while
+// a few look on. Those looking on must agree on everything they saw.
+
+func testChurn(h *Harness) error {
+    watchers, err := h.JoinAll("watch", 3)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    ms := marks(watchers)
+    errs := make([]error, TEST_USERS)
+    var wg sync.WaitGroup
+    for i := 0; i < TEST_USERS; i++ {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            for round := 1; round <= 3 && errs[i] == nil; round++ {
+                errs[i] = churn(h, fmt.Sprintf("op%d.%d", i + 1, round))
+            }
+        }(i)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    return sameOrder(watchers, ms)
+}
+
+func churn(h *Harness, name string) error {
+    u, err := h.Join(name)
+    if err != nil {
+        return err
+    }
+    for n := rand.Intn(TEST_ELEMENTS); n > 0; n-- {
+        if err := u.Element(element()); err != nil {
+            return err
+        }
+        time.Sleep(element())
+    }
+    if rand.Intn(2) == 0 {
+        if err := u.Send(MSG_ON); err != nil {
+            return err
+        }
+        time.Sleep(element())
+    }
+    u.Leave()
+    return nil
+}
+
+// One user whispers to another while the rest key to the room, then stops
+// whispering in the middle of keying down. Only the one whispered to may hear
+// the whisperer, and nobody may be left hearing them afterwards.
+
+func testWhisper(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    from, to := users[0], users[1]
+    whisper := func(name string) error {
+        if err := from.Whisper(name); err != nil {
+            return err
+        }
+        return await(func() error {
+            if w := from.WhisperingTo(); w != name {
+                return fmt.Errorf("%s is whispering to %q, not %q.",
+                                  from.Name, w, name)
+            }
+            return nil
+        })
+    }
+    if err := whisper(to.Name); err != nil {
+        return err
+    }
+    errs := make([]error, len(users))
+    var wg sync.WaitGroup
+    for i, u := range users {
+        wg.Add(1)
+        go func(i int, u *Headless) {
+            defer wg.Done()
+            for j := 0; j < TEST_ELEMENTS && errs[i] == nil; j++ {
+                errs[i] = u.Element(element())
+                time.Sleep(element())
+            }
+        }(i, u)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return err
+    }
+    if err := from.Send(MSG_ON); err != nil {
+        return err
+    }
+    if err := whisper(""); err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    return await(func() error {
+        for _, u := range users {
+            want := 0
+            if u == from || u == to {
+                want = TEST_ELEMENTS + 1
+            }
+            if n := u.Heard(from.Name); n != want {
+                return fmt.Errorf("%s heard %s key %d elements, not %d.",
+                                  u.Name, from.Name, n, want)
+            }
+        }
+        return nil
+    })
+}
+
+// Everyone chats at once, padding their lines with spaces and writing their
+// accents apart from their letters. All must be sent everyone's lines, in
+// order, trimmed and composed.
+
+func testText(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    errs := make([]error, len(users))
+    var wg sync.WaitGroup
+    for i, u := range users {
+        wg.Add(1)
+        go func(i int, u *Headless) {
+            defer wg.Done()
+            for j := 1; j <= TEST_LINES && errs[i] == nil; j++ {
+                errs[i] = u.Say(fmt.Sprintf("  %s cafe\u0301 %d ", u.Name, j))
+            }
+        }(i, u)
+    }
+    wg.Wait()
+    if err := errors.Join(errs...); err != nil {
+        return err
+    }
+    return await(func() error {
+        for _, u := range users {
+            for _, v := range users {
+                want := []string{}
+                for j := 1; j <= TEST_LINES; j++ {
+                    want = append(want, fmt.Sprintf("%s caf\u00e9 %d", v.Name,
+                                                    j))
+                }
+                if got := u.Lines(v.Name); strings.Join(got, "|") !=
+                                            strings.Join(want, "|") {
+                    return fmt.Errorf("%s was sent %+q by %s, not %+q.", u.Name,
+                                      got, v.Name, want)
+                }
+            }
+        }
+        return nil
+    })
+}
+
+// Everyone publishes their presence, one going away, and must see everyone
+// else's. The rest are left to go idle, and one comes back by keying. Then
+// the one who went away leaves, and whoever takes their key must arrive with
+// nothing published, though they may have gone idle since.
+
+func testPresence(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    for i, u := range users {
+        p := Presence{WPM: float64(15 + i), Skill: SKILLS[i % len(SKILLS)],
+                      Status: fmt.Sprintf("op %d", i + 1)}
+        if i == 0 {
+            p.State = PRESENCE_AWAY
+        }
+        if err := u.Publish(p); err != nil {
+            return err
+        }
+    }
+    away := func(name string) string {
+        mt := h.Clients.Metrics
+        mt.Lock()
+        defer mt.Unlock()
+        for _, m := range mt.Members {
+            if m.Name == name {
+                return m.Away
+            }
+        }
+        return ""
+    }
+    if err := await(func() error {
+        for i, u := range users {
+            want := "idle"
+            if i == 0 {
+                want = "away"
+            }
+            if got := away(u.Name); got != want {
+                return fmt.Errorf("%s is %q, not %q.", u.Name, got, want)
+            }
+        }
+        return h.Agree()
+    }); err != nil {
+        return err
+    }
+    if err := users[1].Element(element()); err != nil {
+        return err
+    }
+    if err := await(func() error {
+        if got := away(users[1].Name); got != "" {
+            return fmt.Errorf("%s is still %q after keying.", users[1].Name,
+                              got)
+        }
+        return h.Agree()
+    }); err != nil {
+        return err
+    }
+    users[0].Leave()
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    u, err := h.Join("late")
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    for _, m := range u.View() {
+        if m.Key == u.Key && (m.WPM != 0.0 || m.Skill != "" ||
+                              m.Status != "") {
+            return fmt.Errorf("%s arrived with %s's presence.", u.Name,
+                              users[0].Name)
+        }
+    }
+    return nil
+}
+
+// One user keys and another chats, then somebody arrives late and asks for the
+// history. They must be sent every key down and up, in order, by whom and at
+// what pitch, and the chat along with the server's copy of the keying. What
+// the copy says is left unchecked, since impairment spoils its timing.
+
+func testHistory(h *Harness) error {
+    users, err := h.JoinAll("op", TEST_USERS)
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    sender, chatter := users[0], users[1]
+    t := NewTiming(TEST_WPM, 0.0)
+    if err := sender.Morse("CQ", t); err != nil {
+        return err
+    }
+    if err := chatter.Say("QRS please"); err != nil {
+        return err
+    }
+    elements := len(MORSE['C']) + len(MORSE['Q'])
+    if err := await(func() error {
+        for _, u := range users {
+            if got := u.Heard(sender.Name); got != elements {
+                return fmt.Errorf("%s heard %s key down %d times, not %d.",
+                                  u.Name, sender.Name, got, elements)
+            }
+        }
+        return nil
+    }); err != nil {
+        return err
+    }
+    late, err := h.Join("late")
+    if err != nil {
+        return err
+    }
+    if err := h.Settle(); err != nil {
+        return err
+    }
+    hz := 0.0
+    for _, m := range late.View() {
+        if m.Name == sender.Name {
+            hz = m.Hz
+        }
+    }
+    ps, err := late.Recall(true)
+    if err != nil {
+        return err
+    }
+    if len(ps) != elements * 2 {
+        return fmt.Errorf("%s was sent %d key downs and ups, not %d.",
+                          late.Name, len(ps), elements * 2)
+    }
+    for i, p := range ps {
+        if p.Name != sender.Name || p.Hz != hz || p.On != (i % 2 == 0) ||
+           (i > 0 && p.Ago > ps[i-1].Ago) {
+            return fmt.Errorf("%s was sent %+v as keying %d of %s at %.0fHz.",
+                              late.Name, p, i, sender.Name, hz)
+        }
+    }
+    // The copy is only made once the sender has been quiet for a while
+    return await(func() error {
+        ps, err := late.Recall(false)
+        if err != nil {
+            return err
+        }
+        chatted, copied := false, false
+        for _, p := range ps {
+            chatted = chatted || (p.Chat && p.Name == chatter.Name &&
+                                  p.Text == "QRS please")
+            copied = copied || (!p.Chat && p.Name == sender.Name &&
+                                p.Text != "")
+        }
+        if !chatted || !copied {
+            time.Sleep(time.Second)
+            return fmt.Errorf("%s was sent %+v as the text.", late.Name, ps)
+        }
+        return nil
+    })
+}
@@ -4,18 +4,80 @@ package main
 // sessions out of them.
 
 import (
+    "errors"
+    "flag"
     "log"
     "net"
     "os"
     "strconv"
+    "time"
 )
 
+// Flags are registered before main() runs, so that the tests start from the
+// same defaults as the server does.
+
+func init() {
+    flag.IntVar(&SPECTATORS_MAX, "spectators", 100, "listen-only connections")
+    flag.DurationVar(&FLOOR_TIMEOUT, "floor", 0, "half-duplex silence timeout")
+    flag.StringVar(&ROOM_NAME, "room", "morse", "room name used in reports")
+    flag.BoolVar(&TEXT_OFF, "no-text", false, "refuse text chat")
+    flag.DurationVar(&IDLE_TIMEOUT, "idle", 10 * time.Minute,
+                     "inactivity before a user is marked idle")
+    flag.DurationVar(&HISTORY_SPAN, "history", 15 * time.Minute,
+                     "how much of the room to keep for late arrivals")
+    flag.StringVar(&HTTP_ADDR, "http", "", "url:port for /metrics and /status")
+    flag.StringVar(&STREAM_ADDR, "stream", "", "url:port to relay audio on")
+    flag.StringVar(&UDP_ADDR, "udp", "", "url:port for keying over UDP")
+    flag.Float64Var(&KEY_RATE, "key-rate", 60.0, "on/off Msgs per second")
+    flag.Float64Var(&KEY_BURST, "key-burst", 120.0, "on/off Msgs at once")
+    flag.Float64Var(&TEXT_RATE, "text-rate", 1.0, "lines of text per second")
+    flag.Float64Var(&TEXT_BURST, "text-burst", 5.0, "lines of text at once")
+    flag.Float64Var(&HZ_RATE, "hz-rate", 1.0, "other Msgs per second")
+    flag.Float64Var(&HZ_BURST, "hz-burst", 5.0, "other Msgs at once")
+    flag.IntVar(&STRIKES_MAX, "strikes", 30, "dropped Msgs before a mute")
+    flag.DurationVar(&MUTE_TIME, "mute", 30 * time.Second, "flood mute length")
+    flag.Float64Var(&CONN_RATE, "conn-rate", 10.0, "connections per IP/minute")
+    flag.Float64Var(&CONN_BURST, "conn-burst", 5.0,
+                    "connections per IP at once")
+    flag.StringVar(&BOT_NAME, "bot", "", "name of the practice bot")
+    flag.StringVar(&BOT_STUDENT, "bot-student", "", "the bot's only student")
+    flag.Float64Var(&BOT_WPM, "bot-wpm", 15.0, "the bot's character speed")
+    flag.Float64Var(&BOT_FARNSWORTH_WPM, "bot-fwpm", 0.0,
+                    "the bot's overall speed")
+    flag.Float64Var(&BOT_HZ, "bot-hz", 700.0, "the bot's pitch")
+    flag.StringVar(&BOT_WORDS_FILE, "bot-words", "", "file of words to send")
+    flag.Float64Var(&PITCH_LOW, "pitch-low", 400.0, "lowest pitch assigned")
+    flag.Float64Var(&PITCH_HIGH, "pitch-high", 1000.0, "highest pitch assigned")
+    flag.Float64Var(&PITCH_SPACING, "pitch-spacing", 50.0, "Hz between users")
+    flag.StringVar(&PITCH_POLICY, "pitch-policy", PITCH_WARN,
+                   "allow, warn or nudge pitches that are too close")
+    flag.StringVar(&NODE_NAME, "node", "", "this server's name when linked")
+    flag.Func("link", "url:port of a server to link to", func(s string) error {
+        LINKS = append(LINKS, s)
+        return nil
+    })
+    flag.StringVar(&LINK_SECRET, "link-secret", "", "secret shared by links")
+}
+
 func main() {
-    if len(os.Args[1:]) != 2 {
-        log.Println("usage: morse-server url:port max-connections")
+    flag.Parse()
+    if len(flag.Args()) != 2 {
+        log.Println("usage: morse-server [-spectators n] [-floor timeout] " +
+                    "[-room name] [-no-text] [-idle duration] " +
+                    "[-history duration] [-http url:port] " +
+                    "[-stream url:port] [-udp url:port] [-key-rate n] " +
+                    "[-key-burst n] [-text-rate n] [-text-burst n] " +
+                    "[-hz-rate n] [-hz-burst n] [-strikes n] " +
+                    "[-mute duration] [-conn-rate n] [-conn-burst n] " +
+                    "[-bot name] [-bot-student name] [-bot-wpm n] " +
+                    "[-bot-fwpm n] [-bot-hz n] [-bot-words file] " +
+                    "[-pitch-low n] [-pitch-high n] [-pitch-spacing n] " +
+                    "[-pitch-policy allow|warn|nudge] [-node name] " +
+                    "[-link url:port] [-link-secret secret] " +
+                    "url:port max-connections")
         return
     }
-    max, err := strconv.Atoi(os.Args[2])
+    max, err := strconv.Atoi(flag.Arg(1))
     if err != nil {
         log.Fatal(err)
     }
@@ -23,22 +85,88 @@ func main() {
     if USERS_MAX == 0 || USERS_MAX > 254 {
         log.Fatal("Server must accept 1 to 254 users.")
     }
-    l, err := net.Listen("tcp", os.Args[1])
+    if SPECTATORS_MAX < 0 {
+        log.Fatal("Spectator count cannot be negative.")
+    }
+    if IDLE_TIMEOUT < 0 {
+        log.Fatal("Idle timeout cannot be negative.")
+    }
+    if HISTORY_SPAN < 0 {
+        log.Fatal("History cannot be negative.")
+    }
+    if KEY_BURST < 1 || TEXT_BURST < 1 || HZ_BURST < 1 || CONN_BURST < 1 ||
+       STRIKES_MAX < 1 {
+        log.Fatal("Bursts and strikes must be at least 1.")
+    }
+    BOT_NAME, BOT_STUDENT = NFC(BOT_NAME), NFC(BOT_STUDENT)
+    if BOT_NAME != "" && (NameError(BOT_NAME) != 0 || BOT_WPM <= 0 ||
+                          BOT_HZ < FREQ_MIN || BOT_HZ > FREQ_MAX) {
+        log.Fatal("Invalid bot name, speed or pitch.")
+    }
+    if PITCH_LOW < FREQ_MIN || PITCH_HIGH > FREQ_MAX ||
+       PITCH_LOW >= PITCH_HIGH || PITCH_SPACING < 0 {
+        log.Fatal("Invalid pitch band or spacing.")
+    }
+    if PITCH_POLICY != PITCH_ALLOW && PITCH_POLICY != PITCH_WARN &&
+       PITCH_POLICY != PITCH_NUDGE {
+        log.Fatal("Pitch policy must be allow, warn or nudge.")
+    }
+    if NODE_NAME == "" {
+        NODE_NAME, _ = os.Hostname()
+    }
+    NODE_NAME = NFC(NODE_NAME)
+    if (len(LINKS) > 0 || LINK_SECRET != "") && !ValidNode(NODE_NAME) {
+        log.Fatal("Invalid node name.")
+    }
+    l, err := net.Listen("tcp", flag.Arg(0))
     if err != nil {
         log.Fatal(err)
     }
-    cs := Clients{FromClient: make(chan Msg)}
+    cs := NewClients()
+    if STREAM_ADDR != "" {
+        cs.Relay = NewRelay()
+        go cs.Relay.Run()
+        go cs.Relay.ListenAndServe(STREAM_ADDR)
+    }
+    if err := cs.UDP.Init(UDP_ADDR); err != nil {
+        log.Fatal(err)
+    }
+    if cs.UDP.Conn != nil {
+        go cs.UDP.Listen(cs)
+    }
     go cs.Listen()
+    if HTTP_ADDR != "" {
+        go cs.Metrics.ListenAndServe(HTTP_ADDR)
+    }
+    if BOT_NAME != "" {
+        go NewBot().Run(cs)
+    }
+    for _, addr := range LINKS {
+        go cs.Dial(addr)
+    }
     log.Println("Up and listening for clients ...")
+    cs.Serve(l)
+    log.Println("Shutting down...")
+}
+
+// Clients.Serve() accepts connections until l is closed, and attempts to make
+// sessions out of those that don't arrive too often.
+
+func (cs *Clients) Serve(l net.Listener) {
+    cl := ConnLimiter{}
     for {
         c, err := l.Accept()
-        if err != nil {
+        if errors.Is(err, net.ErrClosed) {
+            return
+        } else if err != nil {
             log.Println(err)
+        } else if !cl.Allow(c.RemoteAddr()) {
+            log.Println(c.RemoteAddr(), "refused for connecting too often")
+            cs.Metrics.Flood(MSG_ERROR_INIT)
+            c.Close()
         } else {
             cli := Client{}
-            go cli.ListenToClient(c, &cs)
+            go cli.ListenToClient(c, cs)
         }
     }
-    log.Println("Shutting down...")
-    l.Close()
 }
@@ -0,0 +1,43 @@
+package main
+
+// Text chat, for whatever is impractical to send in Morse: links,
+// corrections, "QRS please". A MSG_TEXT from a user carries a line as Text,
+// which has been checked by ValidMsg() and metered apart from keying. It is
+// passed to the whole room, spectators and linked servers included, with On
+// 1 and the sender's name as Name. A room kept to CW with -no-text passes
+// nothing on, and answers the sender alone with On 0.
+
+import (
+    "errors"
+)
+
+// Clients.Text() answers a MSG_TEXT, returning an error if it is to go no
+// further.
+
+func (cs *Clients) Text(m *Msg) error {
+    cli := cs.All[m.Key]
+    if cli == nil || cli.Via != nil {
+        return errors.New("No such user.")
+    }
+    if TEXT_OFF {
+        tm := Msg{Type: MSG_TEXT, Key: m.Key}
+        cli.FromServer <- cs.NewOMsg(&tm)
+        return errors.New("Text chat is off.")
+    }
+    m.On = 1
+    m.Name = cli.Name
+    return nil
+}
+
+// Clients.RemoteText() passes on a line from a user on a linked server, if
+// the Remote it came by is the one in use.
+
+func (cs *Clients) RemoteText(p *Peer, lm *LinkMsg) {
+    r := p.Remotes[lm.Key]
+    if TEXT_OFF || r == nil || r.Local == nil {
+        return
+    }
+    m := Msg{Type: MSG_TEXT, On: 1, Key: r.Local.Key, Name: r.Local.Name,
+             Text: lm.Text}
+    cs.Broadcast(cs.NewOMsg(&m))
+}
@@ -0,0 +1,269 @@
+package main
+
+// An optional UDP transport for keying, which spares MSG_ON and MSG_OFF the
+// head-of-line blocking that TCP suffers on lossy links. Everything else stays
+// on TCP. A client asks for it with a MSG_UDP, and is answered with the port
+// and a random token that it must put in every datagram. Each datagram
+// carries the latest UDP_REDUNDANCY transitions, numbered in sequence and
+// timed, and is sent again UDP_RESENDS times shortly after, so that losing
+// one costs nothing but a little delay, which the client's playout buffer
+// takes up. The server's datagrams also say who in
+// the room is keying, which puts right any transitions lost beyond that.
+// Clients send keepalives when idle, which are answered the same way, so that
+// no tone is left stuck for long.
+//
+// Times are in milliseconds on the sender's clock. Each side learns how far
+// the other's clock is behind its own from the least difference it has seen
+// between a datagram's time and its arrival, which is the clock offset plus
+// the quickest trip. A client's keying is timed on the server's clock by
+// that difference, so that transitions that arrive late are still passed on
+// with the time they were made.
+//
+// A client's datagram holds its token (8 bytes), when it was sent (4 bytes),
+// a count (1 byte), and that many transitions, each a sequence number (4
+// bytes), on or off (1 byte) and when (4 bytes). One with no transitions is
+// a keepalive. The server's datagram holds the sequence number it is up to,
+// when it was sent, a count, and that many transitions, each a sequence
+// number, key, on or off and when, followed by a bit for every key in the
+// room, set if that user is keying. Numbers are big-endian, and each side
+// numbers its own transitions.
+
+import (
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "log"
+    "net"
+    "strconv"
+    "sync"
+    "time"
+)
+
+type Transition struct {
+    Seq uint32
+    Key uint8
+    On uint8
+    At uint32
+}
+
+// A UDPSession is one client's use of UDP. Its Addr is wherever its latest
+// datagram came from, and is guarded by the UDP lock. Heard and Behind, the
+// least the client's clock has been seen to lag, belong to UDP.Listen(),
+// while Seq and Recent belong to the Clients' thread.
+
+type UDPSession struct {
+    Token uint64
+    Client *Client
+    Addr *net.UDPAddr
+    Heard uint32
+    Behind int64
+    Timed bool
+    Seq uint32
+    Recent []Transition
+}
+
+// The UDP type is off unless it has a Conn. Keepalives are passed to the
+// Clients' thread through Hello, to be answered with the room's keying.
+
+type UDP struct {
+    sync.Mutex
+    Conn *net.UDPConn
+    Port int
+    Sessions map[uint64]*UDPSession
+    Hello chan *UDPSession
+}
+
+func (u *UDP) Init(addr string) error {
+    u.Sessions = make(map[uint64]*UDPSession)
+    u.Hello = make(chan *UDPSession, QUEUE_LEN)
+    if addr == "" {
+        return nil
+    }
+    a, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        return err
+    }
+    if u.Conn, err = net.ListenUDP("udp", a); err != nil {
+        return err
+    }
+    u.Port = u.Conn.LocalAddr().(*net.UDPAddr).Port
+    return nil
+}
+
+// UDP.Listen() reads datagrams from every client. New transitions are passed
+// to Clients like any other keying, after the same flood protection.
+
+func (u *UDP) Listen(cs *Clients) {
+    buf := make([]byte, UDP_PACKET_MAX)
+    for {
+        n, addr, err := u.Conn.ReadFromUDP(buf)
+        if err != nil {
+            log.Println(err)
+            continue
+        }
+        token, sent, ts, err := parseUplink(buf[:n])
+        if err != nil {
+            continue
+        }
+        u.Lock()
+        s := u.Sessions[token]
+        if s != nil {
+            s.Addr = addr
+        }
+        u.Unlock()
+        if s == nil {
+            continue
+        }
+        if behind := int64(millis()) - int64(sent); !s.Timed ||
+           behind < s.Behind {
+            s.Behind, s.Timed = behind, true
+        }
+        if len(ts) == 0 {
+            select {
+            case u.Hello <- s:
+            default:
+            }
+        }
+        for _, t := range ts {
+            if t.Seq > s.Heard {
+                s.Heard = t.Seq
+                u.Key(s.Client, t, s.Behind, cs)
+            }
+        }
+    }
+}
+
+// UDP.Key() passes on one transition. The Msg keeps its Client, so that
+// Clients can tell if the user left while it was on its way, and carries
+// when it was made as Hz, on the server's clock. A flood that calls for a
+// kick closes the TCP connection, which kicks the user from there.
+
+func (u *UDP) Key(cli *Client, t Transition, behind int64, cs *Clients) {
+    m := Msg{Type: MSG_OFF, Key: cli.Key, Client: cli,
+             Hz: float64(uint32(int64(t.At) + behind))}
+    if t.On == 1 {
+        m.Type = MSG_ON
+    }
+    if !cli.Limits.Allow(m.Type) {
+        if cli.Strike(cli.Conn, cs) {
+            cli.Conn.Close()
+        }
+        return
+    }
+    cs.FromClient <- m
+}
+
+// Clients.StartUDP() answers a MSG_UDP. On is 0 if the server has no UDP,
+// and otherwise the port is given as Hz and the token, in hex, as Name.
+
+func (cs *Clients) StartUDP(m *Msg) {
+    cli := cs.All[m.Key]
+    if cli == nil || cli.Via != nil {
+        return
+    }
+    um := Msg{Type: MSG_UDP, Key: m.Key}
+    if cs.UDP.Conn != nil && cli.UDP == nil {
+        var b [8]byte
+        if _, err := rand.Read(b[:]); err != nil {
+            log.Println(err)
+            return
+        }
+        s := &UDPSession{Token: binary.BigEndian.Uint64(b[:]), Client: cli}
+        cs.UDP.Lock()
+        cs.UDP.Sessions[s.Token] = s
+        cs.UDP.Unlock()
+        cli.UDP = s
+    }
+    if s := cli.UDP; s != nil {
+        um.On = 1
+        um.Hz = float64(cs.UDP.Port)
+        um.Name = strconv.FormatUint(s.Token, 16)
+    }
+    cli.FromServer <- cs.NewOMsg(&um)
+}
+
+// Clients.ForgetUDP() is called as a user leaves.
+
+func (cs *Clients) ForgetUDP(cli *Client) {
+    if cli.UDP == nil {
+        return
+    }
+    cs.UDP.Lock()
+    delete(cs.UDP.Sessions, cli.UDP.Token)
+    cs.UDP.Unlock()
+    cli.UDP = nil
+}
+
+// Clients.SendUDP() sends a client its latest transitions and the room's
+// keying, adding om to them unless it is nil, as made at the given time. It
+// returns false if the client has yet to be heard from over UDP, in which
+// case om should go by TCP instead.
+
+func (cs *Clients) SendUDP(s *UDPSession, om *OMsg, at uint32) bool {
+    cs.UDP.Lock()
+    addr := s.Addr
+    cs.UDP.Unlock()
+    if addr == nil || cs.All[s.Client.Key] != s.Client {
+        return false
+    }
+    if om != nil {
+        s.Seq++
+        t := Transition{s.Seq, om.Key - 1, 0, at}
+        if om.Type == MSG_ON {
+            t.On = 1
+        }
+        s.Recent = append(s.Recent, t)
+        if len(s.Recent) > UDP_REDUNDANCY {
+            s.Recent = s.Recent[1:]
+        }
+    }
+    p := binary.BigEndian.AppendUint32(nil, s.Seq)
+    p = binary.BigEndian.AppendUint32(p, millis())
+    p = append(p, uint8(len(s.Recent)))
+    for _, t := range s.Recent {
+        p = binary.BigEndian.AppendUint32(p, t.Seq)
+        p = append(p, t.Key, t.On)
+        p = binary.BigEndian.AppendUint32(p, t.At)
+    }
+    keying := make([]byte, (USERS_MAX + 7) / 8)
+    for _, cli := range cs.All {
+        if cli != nil && cli.OnFor(s.Client) == 1 {
+            keying[cli.Key / 8] |= 1 << (cli.Key % 8)
+        }
+    }
+    p = append(p, keying...)
+    send := func() {
+        if _, err := cs.UDP.Conn.WriteToUDP(p, addr); err != nil {
+            log.Println(addr, err)
+        }
+    }
+    send()
+    for i := 1; om != nil && i <= UDP_RESENDS; i++ {
+        time.AfterFunc(time.Duration(i) * UDP_RESEND, send)
+    }
+    return true
+}
+
+// millis() is the server's clock for keying over UDP.
+
+func millis() uint32 {
+    return uint32(time.Since(UDP_EPOCH).Milliseconds())
+}
+
+func parseUplink(p []byte) (uint64, uint32, []Transition, error) {
+    if len(p) < 13 || len(p) != 13 + int(p[12]) * 9 {
+        return 0, 0, nil, errors.New("Malformed datagram.")
+    }
+    token := binary.BigEndian.Uint64(p)
+    sent := binary.BigEndian.Uint32(p[8:])
+    ts := make([]Transition, p[12])
+    for i, _ := range ts {
+        q := p[13 + i * 9:]
+        ts[i] = Transition{Seq: binary.BigEndian.Uint32(q), On: q[4],
+                           At: binary.BigEndian.Uint32(q[5:])}
+        if ts[i].On > 1 {
+            return 0, 0, nil, errors.New("Malformed datagram.")
+        }
+    }
+    return token, sent, ts, nil
+}
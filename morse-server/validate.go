@@ -0,0 +1,189 @@
+package main
+
+// Everything a client sends is checked here before it reaches Clients. A
+// client is only trusted to key, change pitch, ask for the floor, whisper,
+// chat and say a little about themselves, and then only with sensible values.
+
+import (
+    "errors"
+    "math"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// NameError() returns the MSG_ERROR_* type that a name is refused with, or
+// zero if the name is acceptable. Names must be valid UTF-8 made of printable
+// characters, where the only space allowed is an ordinary one, and they may
+// not begin or end with a space or begin with a combining mark. Invisible
+// formatting characters are refused, except the zero width joiner that emoji
+// need. An @ is refused too, as it is kept for users on linked servers, who
+// are listed as name@node. Names should already be in NFC, so that their
+// length is counted the same way however they were typed.
+
+func NameError(name string) uint8 {
+    if !utf8.ValidString(name) {
+        return MSG_ERROR_NAME_CHARS
+    } else if n := graphemes(name); n <= 0 || n > NAME_MAX ||
+              len(name) > NAME_BYTES_MAX {
+        return MSG_ERROR_NAME_LEN
+    }
+    for _, r := range name {
+        if (!unicode.IsGraphic(r) && r != ZWJ) ||
+           (unicode.IsSpace(r) && r != ' ') || r == '@' {
+            return MSG_ERROR_NAME_CHARS
+        }
+    }
+    first, _ := utf8.DecodeRuneInString(name)
+    last, _ := utf8.DecodeLastRuneInString(name)
+    if first == ' ' || last == ' ' || unicode.Is(unicode.M, first) {
+        return MSG_ERROR_NAME_CHARS
+    }
+    return 0
+}
+
+// ValidText() checks a line of text chat or a status, which are held to the
+// same characters as a name, up to the given number of characters and bytes.
+// The text should already be in NFC and trimmed of spaces.
+
+func ValidText(text string, max int, bytesMax int) bool {
+    if !utf8.ValidString(text) || len(text) > bytesMax {
+        return false
+    } else if n := graphemes(text); n <= 0 || n > max {
+        return false
+    }
+    for _, r := range text {
+        if (!unicode.IsGraphic(r) && r != ZWJ) ||
+           (unicode.IsSpace(r) && r != ' ') {
+            return false
+        }
+    }
+    first, _ := utf8.DecodeRuneInString(text)
+    return !unicode.Is(unicode.M, first)
+}
+
+// ValidPresence() checks what a user has published of themselves.
+
+func ValidPresence(state uint8, wpm float64, skill string,
+                   status string) error {
+    if state > PRESENCE_IDLE {
+        return errors.New("Invalid presence.")
+    } else if wpm != 0.0 && (math.IsNaN(wpm) || wpm < WPM_MIN ||
+                             wpm > WPM_MAX) {
+        return errors.New("Speed out of range.")
+    } else if skill != "" && !validSkill(skill) {
+        return errors.New("Unknown skill level.")
+    } else if status != "" &&
+              !ValidText(status, STATUS_MAX, STATUS_BYTES_MAX) {
+        return errors.New("Invalid status.")
+    }
+    return nil
+}
+
+// ValidNode() checks a node's name, which is held to the same rules as a
+// user's.
+
+func ValidNode(node string) bool {
+    return NameError(node) == 0
+}
+
+// ValidMsg() checks a decoded Msg from a keyed client. Fields that have no
+// meaning for its type are cleared, so that nothing unexpected is passed
+// along to other users.
+
+func ValidMsg(m *Msg) error {
+    name, text := m.Name, m.Text
+    m.Name = ""
+    m.Text = ""
+    m.Client = nil
+    switch m.Type {
+    case MSG_WHISPER:
+        // Name is whoever to whisper to, or nobody
+        m.On = 0
+        m.Hz = 0.0
+        if len(name) > NAME_BYTES_MAX {
+            return errors.New("Name too long to whisper to.")
+        }
+        m.Name = NFC(name)
+    case MSG_TEXT:
+        m.On = 0
+        m.Hz = 0.0
+        if len(text) > TEXT_BYTES_MAX || !utf8.ValidString(text) {
+            return errors.New("Invalid text.")
+        }
+        m.Text = NFC(strings.TrimSpace(text))
+        if !ValidText(m.Text, TEXT_MAX, TEXT_BYTES_MAX) {
+            return errors.New("Invalid text.")
+        }
+    case MSG_PRESENCE:
+        // The state is On, the speed Hz, the skill Name and the status Text,
+        // any of which but the state may be left empty
+        if len(text) > STATUS_BYTES_MAX || !utf8.ValidString(text) {
+            return errors.New("Invalid status.")
+        }
+        m.Name = name
+        m.Text = NFC(strings.TrimSpace(text))
+        if err := ValidPresence(m.On, m.Hz, m.Name, m.Text); err != nil {
+            return err
+        } else if m.On == PRESENCE_IDLE {
+            return errors.New("Only the server marks users idle.")
+        }
+    case MSG_HISTORY:
+        // Hz is how many minutes, and On whether to replay the keying
+        if m.On > 1 || !(m.Hz > 0.0) || math.IsInf(m.Hz, 1) {
+            return errors.New("Invalid history request.")
+        }
+    case MSG_ON, MSG_OFF, MSG_FLOOR_REQUEST, MSG_UDP:
+        m.On = 0
+        m.Hz = 0.0
+    case MSG_PING:
+        // Hz carries the client's clock, which is echoed back untouched
+        m.On = 0
+    case MSG_HZ:
+        m.On = 0
+        if math.IsNaN(m.Hz) || m.Hz < FREQ_MIN || m.Hz > FREQ_MAX {
+            return errors.New("Pitch out of range.")
+        }
+    default:
+        return errors.New("Msg type not allowed.")
+    }
+    return nil
+}
+
+// ValidLinkMsg() checks a LinkMsg from a linked node. Nodes are trusted not
+// to flood, but not to be free of bugs.
+
+func ValidLinkMsg(lm *LinkMsg) error {
+    switch lm.Type {
+    case MSG_ON, MSG_OFF, MSG_LEAVE:
+        return nil
+    case MSG_TEXT:
+        if !ValidText(lm.Text, TEXT_MAX, TEXT_BYTES_MAX) {
+            return errors.New("Invalid text.")
+        }
+        return nil
+    case MSG_PRESENCE:
+        return ValidPresence(lm.On, lm.Hz, lm.Name, lm.Text)
+    case MSG_HZ:
+        if math.IsNaN(lm.Hz) || lm.Hz < FREQ_MIN || lm.Hz > FREQ_MAX {
+            return errors.New("Pitch out of range.")
+        }
+        return nil
+    case MSG_ENTER:
+        if NameError(lm.Name) != 0 || !ValidNode(lm.Origin) || lm.On > 1 ||
+           math.IsNaN(lm.Hz) || lm.Hz < FREQ_MIN || lm.Hz > FREQ_MAX {
+            return errors.New("Invalid remote user.")
+        }
+        if len(lm.Path) == 0 || len(lm.Path) > LINK_PATH_MAX ||
+           lm.Path[0] != lm.Origin {
+            return errors.New("Invalid path.")
+        }
+        for _, node := range lm.Path {
+            if !ValidNode(node) {
+                return errors.New("Invalid path.")
+            }
+        }
+        return nil
+    }
+    return errors.New("LinkMsg type not allowed.")
+}
@@ -0,0 +1,154 @@
+package main
+
+// ValidMsg() stands between every client and the rest of the room, so it is
+// fuzzed with whatever gob will decode into a Msg, as ListenToClient() would
+// decode it. Anything it lets through should be as safe to pass along as a
+// Msg from a well behaved client. The names and text that come with each Msg
+// are run through NameError() and NFC() on the way.
+
+import (
+    "bytes"
+    "encoding/gob"
+    "math"
+    "strings"
+    "testing"
+    "unicode/utf8"
+)
+
+// encodeMsgs() gob encodes OMsgs as a client would send them, with On and Key
+// already raised by one.
+
+func encodeMsgs(f *testing.F, oms ...OMsg) []byte {
+    var b bytes.Buffer
+    w := gob.NewEncoder(&b)
+    for _, om := range oms {
+        if err := w.Encode(om); err != nil {
+            f.Fatal(err)
+        }
+    }
+    return b.Bytes()
+}
+
+func FuzzValidMsg(f *testing.F) {
+    long := strings.Repeat("x", NAME_BYTES_MAX + 1)
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_HZ, On: 1, Key: 1, Hz: 600.0}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_ON, On: 1, Key: 1},
+                     OMsg{Type: MSG_OFF, On: 1, Key: 1}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_FLOOR_REQUEST, On: 1, Key: 1,
+                             Hz: math.NaN(), Name: long}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_WHISPER, On: 1, Key: 1, Name: long}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_WHISPER, On: 1, Key: 1,
+                             Name: "Ame\u0301lie"}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_TEXT, On: 1, Key: 1,
+                             Text: "cq \xff\xfe de"}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_TEXT, On: 1, Key: 1,
+                             Text: strings.Repeat("e\u0301", TEXT_MAX)}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_PRESENCE, On: 1, Key: 1, Hz: 20.0,
+                             Name: "novice", Text: long}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_PRESENCE, On: 1, Key: 1,
+                             Hz: math.NaN()}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_HZ, On: 1, Key: 1, Hz: math.NaN()}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_HZ, On: 1, Key: 1, Hz: math.Inf(1)}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_HZ, On: 1, Key: 1, Hz: -600.0}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_HISTORY, On: 2, Key: 1,
+                             Hz: math.Inf(1)}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_HISTORY, On: 1, Key: 1,
+                             Hz: math.Inf(-1)}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_PING, On: 1, Key: 255,
+                             Hz: math.NaN()}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_ENTER, On: 1,
+                             Key: uint8(USERS_MAX) + 1, Name: "\xc3"}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_ENTER, On: 1, Key: 1, Name: long}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_ENTER, On: 1, Key: 1,
+                             Name: " \u0301Ame\u0301lie\u200b"}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_ENTER, On: 1, Key: 1,
+                             Name: "alice@node"}))
+    f.Add(encodeMsgs(f, OMsg{Type: MSG_ERROR_OK + 1, On: 255, Key: 0}))
+    f.Add(encodeMsgs(f, OMsg{Type: 255, On: 0, Key: 255}))
+    f.Fuzz(func(t *testing.T, data []byte) {
+        r := gob.NewDecoder(bytes.NewReader(data))
+        for {
+            m := Msg{Key: 255}
+            if err := r.Decode(&m); err != nil {
+                return
+            }
+            m.On--
+            m.Key--
+            name := NFC(m.Name)
+            if !utf8.ValidString(name) || NFC(name) != name {
+                t.Fatalf("NFC(%q) = %q is not normalized", m.Name, name)
+            }
+            if NameError(name) == 0 {
+                checkName(t, name)
+            }
+            if s := NFC(m.Text); !utf8.ValidString(s) || NFC(s) != s {
+                t.Fatalf("NFC(%q) = %q is not normalized", m.Text, s)
+            }
+            if ValidMsg(&m) != nil {
+                continue
+            }
+            checkValidMsg(t, &m)
+        }
+    })
+}
+
+// checkName() fails the test if NameError() accepted a name that could
+// not be shown, or that is too long or padded with spaces.
+
+func checkName(t *testing.T, name string) {
+    if !utf8.ValidString(name) || name == "" || len(name) > NAME_BYTES_MAX ||
+       graphemes(name) > NAME_MAX || strings.TrimSpace(name) != name {
+        t.Fatalf("NameError() accepted %q", name)
+    }
+    if strings.ContainsRune(name, '@') {
+        t.Fatalf("NameError() accepted %q, which looks like a remote user",
+                 name)
+    }
+}
+
+// checkValidMsg() fails the test if a Msg that ValidMsg() accepted carries
+// anything a client could not have sent honestly.
+
+func checkValidMsg(t *testing.T, m *Msg) {
+    if m.Client != nil {
+        t.Fatalf("%+v kept a Client", m)
+    }
+    for _, s := range []string{m.Name, m.Text} {
+        if !utf8.ValidString(s) || NFC(s) != s {
+            t.Fatalf("%+v passed %q, which is not valid NFC", m, s)
+        }
+    }
+    switch m.Type {
+    case MSG_ON, MSG_OFF, MSG_FLOOR_REQUEST, MSG_UDP:
+        if m.On != 0 || m.Hz != 0.0 || m.Name != "" || m.Text != "" {
+            t.Fatalf("%+v was not cleared", m)
+        }
+    case MSG_PING:
+        if m.On != 0 || m.Name != "" || m.Text != "" {
+            t.Fatalf("%+v was not cleared", m)
+        }
+    case MSG_HZ:
+        if m.On != 0 || !(m.Hz >= FREQ_MIN && m.Hz <= FREQ_MAX) {
+            t.Fatalf("%+v has a pitch out of range", m)
+        }
+    case MSG_HISTORY:
+        if m.On > 1 || !(m.Hz > 0.0) || math.IsInf(m.Hz, 0) {
+            t.Fatalf("%+v asks for an impossible history", m)
+        }
+    case MSG_WHISPER:
+        if m.On != 0 || m.Hz != 0.0 || m.Text != "" {
+            t.Fatalf("%+v was not cleared", m)
+        }
+    case MSG_TEXT:
+        if !ValidText(m.Text, TEXT_MAX, TEXT_BYTES_MAX) {
+            t.Fatalf("%+v passed invalid text", m)
+        }
+    case MSG_PRESENCE:
+        err := ValidPresence(m.On, m.Hz, m.Name, m.Text)
+        if err != nil || m.On == PRESENCE_IDLE {
+            t.Fatalf("%+v passed an invalid presence", m)
+        }
+    default:
+        t.Fatalf("%+v has a type that should not pass", m)
+    }
+}
@@ -0,0 +1,105 @@
+package main
+
+// A user may whisper, keying to one other user so that nobody else hears
+// them: not the rest of the room, nor spectators, the audio relay or linked
+// servers. A MSG_WHISPER names who to whisper to, or nobody to go back to
+// keying to the room. The user is answered with a MSG_WHISPER from their own
+// key, whose On is 1 and Name is whoever they are whispering to, whose On is
+// 0 and Name is empty once they are back to the room, or whose On is 0 and
+// Name is the one asked for if that user cannot be whispered to. The one
+// whispered to is sent a MSG_WHISPER from the whisperer's key, with On 1
+// when it starts and 0 when it stops. Users heard over links can neither
+// whisper nor be whispered to.
+
+// Client.OnFor() is whether the user is keying, as far as the given Client
+// can hear. A nil Client hears only what the whole room hears.
+
+func (cli *Client) OnFor(to *Client) uint8 {
+    if cli.Whisper != nil && cli.Whisper != to {
+        return 0
+    }
+    return cli.On
+}
+
+// Clients.Named() finds a user in the room by name.
+
+func (cs *Clients) Named(name string) *Client {
+    for _, cli := range cs.All {
+        if cli != nil && cli.Name == name {
+            return cli
+        }
+    }
+    return nil
+}
+
+// Clients.Whisper() answers a MSG_WHISPER. A user who is keying down as they
+// start or stop whispering is keyed up first, so that nobody who could hear
+// them is left with a stuck tone.
+
+func (cs *Clients) Whisper(m *Msg) {
+    cli := cs.All[m.Key]
+    if cli == nil || cli.Via != nil {
+        return
+    }
+    var to *Client
+    if m.Name != "" {
+        to = cs.Named(m.Name)
+        if to == nil || to == cli || to.Via != nil {
+            wm := Msg{Type: MSG_WHISPER, Key: cli.Key, Name: m.Name}
+            cli.FromServer <- cs.NewOMsg(&wm)
+            return
+        }
+    }
+    if cli.On == 1 {
+        off := Msg{Type: MSG_OFF, Key: cli.Key}
+        if cs.Off(&off) == nil {
+            cs.Broadcast(cs.NewOMsg(&off))
+        }
+    }
+    cs.tellWhispered(cli, 0)
+    cli.Whisper = to
+    cs.tellWhispered(cli, 1)
+    wm := Msg{Type: MSG_WHISPER, Key: cli.Key}
+    if to != nil {
+        wm.On = 1
+        wm.Name = to.Name
+    }
+    cli.FromServer <- cs.NewOMsg(&wm)
+}
+
+func (cs *Clients) tellWhispered(cli *Client, on uint8) {
+    if to := cli.Whisper; to != nil {
+        wm := Msg{Type: MSG_WHISPER, On: on, Key: cli.Key, Name: cli.Name}
+        to.FromServer <- cs.NewOMsg(&wm)
+    }
+}
+
+// Clients.Unwhisper() is called as a user leaves. Anyone whispering to them
+// is keyed up, without a word to the room, which never heard them key down,
+// and sent back to keying to the room.
+
+func (cs *Clients) Unwhisper(gone *Client) {
+    for _, cli := range cs.All {
+        if cli == nil || cli.Whisper != gone {
+            continue
+        }
+        if cli.On == 1 {
+            off := Msg{Type: MSG_OFF, Key: cli.Key}
+            cs.Off(&off)
+        }
+        cli.Whisper = nil
+        wm := Msg{Type: MSG_WHISPER, Key: cli.Key}
+        cli.FromServer <- cs.NewOMsg(&wm)
+    }
+}
+
+// Clients.SendWhisper() passes on the keying of a user who is whispering,
+// to them and to the one they are whispering to.
+
+func (cs *Clients) SendWhisper(om OMsg, at uint32, from *Client) {
+    for _, cli := range []*Client{from, from.Whisper} {
+        if cli.UDP == nil || !cs.SendUDP(cli.UDP, &om, at) {
+            cli.FromServer <- om
+        }
+    }
+}